@@ -1,31 +1,32 @@
 package main
 
 import (
-	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
-
-	"tcp_http/internal/headers"
+	"time"
+
+	"tcp_http/internal/accesslog"
+	"tcp_http/internal/cache"
+	"tcp_http/internal/compression"
+	"tcp_http/internal/fileserver"
+	"tcp_http/internal/negotiate"
+	"tcp_http/internal/proxy"
 	"tcp_http/internal/request"
 	"tcp_http/internal/response"
 	"tcp_http/internal/server"
+	"tcp_http/internal/sse"
+	"tcp_http/internal/websocket"
 )
 
 const port = 42069
 
-func toStr(bytes []byte) string {
-	out := ""
-	for _, b := range bytes {
-		out += fmt.Sprintf("%x", b)
-	}
-	return out
-}
-
 func Respond400() []byte {
 	return []byte(`
 		<html>
@@ -71,85 +72,175 @@ func Respond200() []byte {
 	`)
 }
 
+// pageTypes are the formats the demo pages come in, HTML first.
+var pageTypes = []string{"text/html", "application/json", "text/plain"}
+
+// respond sends a demo page in the format the client prefers: the HTML
+// page, or the message as JSON or plain text for API clients.
+func respond(w *response.Writer, req *request.Request, status response.StatusCode, html []byte, message string) {
+	h := response.GetDefaultHeaders(0)
+	contentType, err := negotiate.ContentType(req, h, pageTypes...)
+	if err != nil {
+		negotiate.NotAcceptable("Accept", pageTypes...).Write(w)
+		return
+	}
+	body := html
+	switch contentType {
+	case "application/json":
+		body, _ = json.Marshal(map[string]any{"status": int(status), "message": message})
+	case "text/plain":
+		body = []byte(message + "\n")
+	}
+	h.Replace("content-length", fmt.Sprintf("%d", len(body)))
+	h.Replace("Content-Type", contentType)
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+var assets = fileserver.New("./assets", fileserver.Options{
+	StripPrefix:     "/assets",
+	ListDirectories: true,
+})
+
+// forwardProxy turns the server into a forward proxy for web ports as well
+// when PROXY_USERS lists "user:password" credentials, comma separated.
+// PROXY_ALLOW_HOSTS limits the destinations to the comma separated hosts,
+// domains ("*.example.com") and networks it lists. Loopback and private
+// addresses are never reachable through it.
+func forwardProxy() server.Handler {
+	users := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("PROXY_USERS"), ",") {
+		if user, password, ok := strings.Cut(strings.TrimSpace(pair), ":"); ok {
+			users[user] = password
+		}
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv("PROXY_ALLOW_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return proxy.NewForward(proxy.ForwardOptions{
+		AllowHosts: hosts,
+		AllowPorts: []int{80, 443},
+		Users:      users,
+	})
+}
+
+// accessLog writes access logs to stdout, or to the file ACCESS_LOG names,
+// which is reopened on SIGHUP so it can be rotated. ACCESS_LOG_FORMAT picks
+// common, combined (the default) or json.
+func accessLog() *slog.Logger {
+	format := accesslog.CombinedFormat
+	if name := os.Getenv("ACCESS_LOG_FORMAT"); name != "" {
+		var err error
+		if format, err = accesslog.ParseFormat(name); err != nil {
+			log.Fatalf("Error configuring access log: %v", err)
+		}
+	}
+	path := os.Getenv("ACCESS_LOG")
+	if path == "" || path == "-" {
+		return accesslog.New(os.Stdout, format)
+	}
+	file, err := accesslog.OpenFile(path)
+	if err != nil {
+		log.Fatalf("Error opening access log: %v", err)
+	}
+	file.ReopenOn(syscall.SIGHUP)
+	return accesslog.New(file, format)
+}
+
 func main() {
-	server, err := server.Serve(port, func(w *response.Writer, req *request.Request) {
-		h := response.GetDefaultHeaders(0)
-		body := Respond200()
+	httpbin, err := proxy.New("https://httpbin.org", proxy.Options{
+		StripPrefix: "/httpbin",
+	})
+	if err != nil {
+		log.Fatalf("Error configuring httpbin proxy: %v", err)
+	}
+
+	handler := func(w *response.Writer, req *request.Request) {
 		status := response.StatusOK
+		html, message := Respond200(), "Your request was an absolute banger."
 		if req.RequestLine.RequestTarget == "/yourproblem" {
 			status = response.StatusBadRequest
-			body = Respond400()
+			html, message = Respond400(), "Your request honestly kinda sucked."
 
 		} else if req.RequestLine.RequestTarget == "/myproblem" {
 			status = response.StatusInternalError
-			body = Respond500()
+			html, message = Respond500(), "Okay, you know what? This one is on me."
 
 		} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-			target := req.RequestLine.RequestTarget
-			res, err := http.Get("https://httpbin.org/" + target[len("/httpbin/"):])
+			httpbin(w, req)
+			return
+		} else if req.RequestLine.RequestTarget == "/ws" {
+			upgrader := &websocket.Upgrader{EnableCompression: true}
+			conn, err := upgrader.Upgrade(w, req)
 			if err != nil {
-				body = Respond500()
-				status = response.StatusInternalError
-				w.WriteStatusLine(status)
-				h.Replace("content-length", fmt.Sprintf("%d", len(body)))
-				h.Replace("Content-Type", "text/html")
-				w.WriteHeaders(*h)
-				w.WriteBody(body)
-				return // <--- THIS return is critical
-			} else {
-				w.WriteStatusLine(response.StatusOK)
-				h.Delete("content-length")
-				h.Set("transfer-encoding", "chunked")
-				h.Replace("Content-Type", "text/plain")
-				h.Set("Trailer", "X-Content-SHA256")
-				h.Set("Trailer", "X-Content-Length")
-				w.WriteHeaders(*h)
-				fullBody := []byte{}
-				for {
-					data := make([]byte, 32)
-					n, err := res.Body.Read(data)
-					if err != nil {
-						break
-
-					}
-					fullBody = append(fullBody, data[:n]...)
-					w.WriteBody([]byte(fmt.Sprintf("%x\r\n", n)))
-					w.WriteBody(data[:n])
-					w.WriteBody([]byte("\r\n"))
-				}
-				w.WriteBody([]byte("0\r\n"))
-				trailer := headers.NewHeaders()
-				out := sha256.Sum256(fullBody)
-				trailer.Set("X-Content-SHA256", toStr(out[:]))
-				trailer.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-				w.WriteHeaders(*trailer)
 				return
 			}
-		} else if req.RequestLine.RequestTarget == "/video" {
-			file, err := os.ReadFile("./assets/nature.mp4")
+			defer conn.Close(websocket.CloseNormal, "")
+			for {
+				mt, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := conn.WriteMessage(mt, data); err != nil {
+					return
+				}
+			}
+		} else if req.RequestLine.RequestTarget == "/events" {
+			stream, err := sse.NewStream(w, req, 0)
 			if err != nil {
-				body = Respond500()
-				status = response.StatusInternalError
-				w.WriteStatusLine(status)
-				h.Replace("content-length", fmt.Sprintf("%d", len(body)))
-				h.Replace("Content-Type", "text/html")
-				w.WriteHeaders(*h)
-				w.WriteBody(body)
 				return
 			}
-			h.Replace("Content-Type", "video/mp4")
-			h.Replace("content-length", fmt.Sprintf("%d", len(file)))
-			w.WriteStatusLine(response.StatusOK)
-			w.WriteHeaders(*h)
-			w.WriteBody(file)
+			defer stream.Close()
+			// Resume counting after the last event the client saw.
+			start, _ := strconv.Atoi(stream.LastEventID())
+			for i := start + 1; i <= 100; i++ {
+				select {
+				case <-stream.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				event := sse.Event{ID: strconv.Itoa(i), Event: "progress", Data: fmt.Sprintf("%d%%", i)}
+				if err := stream.Send(event); err != nil {
+					return
+				}
+			}
+			return
+		} else if req.RequestLine.RequestTarget == "/video" {
+			fileserver.ServeFile(w, req, "./assets/nature.mp4")
+			return
+		} else if strings.HasPrefix(req.RequestLine.RequestTarget, "/assets/") {
+			assets(w, req)
 			return
 		}
-		h.Replace("content-length", fmt.Sprintf("%d", len(body)))
-		h.Replace("Content-Type", "text/html")
-		w.WriteStatusLine(status)
-		w.WriteHeaders(*h)
-		w.WriteBody(body)
+		respond(w, req, status, html, message)
+	}
+
+	site := server.Chain(handler,
+		cache.Middleware(cache.Options{}),
+		compression.Middleware(compression.Options{}),
+	)
+	forward := forwardProxy()
+	root := func(w *response.Writer, req *request.Request) {
+		if forward != nil && proxy.IsForwardRequest(req) {
+			forward(w, req)
+			return
+		}
+		site(w, req)
+	}
 
+	logger := accessLog()
+	server, err := server.ServeWithOptions(port, server.Chain(root, accesslog.Middleware(logger)), server.Options{
+		DecodeRequestBodies: true,
+		StreamRequestBodies: true,
+		KeepAlive:           true,
+		Rejected:            accesslog.Rejected(logger),
 	})
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
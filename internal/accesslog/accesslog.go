@@ -0,0 +1,239 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+var ErrUnknownFormat = errors.New("unknown access log format")
+
+// Format selects how access log records are written.
+type Format int
+
+const (
+	// CommonFormat is the NCSA Common Log Format.
+	CommonFormat Format = iota
+	// CombinedFormat is the Common Log Format followed by the Referer and
+	// User-Agent.
+	CombinedFormat
+	// JSONFormat writes one JSON object per request.
+	JSONFormat
+)
+
+// ParseFormat returns the Format named "common", "combined" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "common":
+		return CommonFormat, nil
+	case "combined":
+		return CombinedFormat, nil
+	case "json":
+		return JSONFormat, nil
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+}
+
+// Keys of the attributes each access log record carries. The record's time
+// is when the request came in.
+const (
+	RemoteAddrKey = "remote_addr"
+	UserKey       = "user"
+	MethodKey     = "method"
+	TargetKey     = "target"
+	ProtoKey      = "proto"
+	StatusKey     = "status"
+	BytesKey      = "bytes"
+	DurationKey   = "duration"
+	RefererKey    = "referer"
+	UserAgentKey  = "user_agent"
+)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// NewHandler returns the slog.Handler that writes records in format to w.
+func NewHandler(w io.Writer, format Format) slog.Handler {
+	if format == JSONFormat {
+		return slog.NewJSONHandler(w, nil)
+	}
+	return &lineHandler{w: w, combined: format == CombinedFormat, mu: &sync.Mutex{}}
+}
+
+// New returns a logger writing records in format to w, for Middleware.
+func New(w io.Writer, format Format) *slog.Logger {
+	return slog.New(NewHandler(w, format))
+}
+
+// Middleware logs every request once its response is complete, as an info
+// record with the attributes named by the *Key constants. The bytes are the
+// body as sent, after any content coding and without chunk framing.
+// Upgraded connections are logged when the handler is done with them, with
+// the time it held them as the duration. List it first so the duration
+// covers the other middleware.
+func Middleware(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			// The server does not finish a hijacked response.
+			if w.Hijacked() {
+				logRequest(logger, w, req, start)
+				return
+			}
+			w.AddDoneHook(func() {
+				logRequest(logger, w, req, start)
+			})
+		}
+	}
+}
+
+// Rejected returns a hook for server.Options.Rejected that logs the
+// requests the server answers itself, such as malformed ones, which never
+// reach Middleware. Their records have no duration, and one for a request
+// that could not be parsed has no request line.
+func Rejected(logger *slog.Logger) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		logRequest(logger, w, req, time.Now())
+	}
+}
+
+func logRequest(logger *slog.Logger, w *response.Writer, req *request.Request, start time.Time) {
+	handler := logger.Handler()
+	ctx := req.Context()
+	if !handler.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	record := slog.NewRecord(start, slog.LevelInfo, "request", 0)
+	proto := ""
+	if req.RequestLine.HttpVersion != "" {
+		proto = "HTTP/" + req.RequestLine.HttpVersion
+	}
+	referer, _ := req.Headers.Get("Referer")
+	userAgent, _ := req.Headers.Get("User-Agent")
+	record.AddAttrs(
+		slog.String(RemoteAddrKey, remoteHost(req.RemoteAddr)),
+		slog.String(UserKey, basicUser(req)),
+		slog.String(MethodKey, req.RequestLine.Method),
+		slog.String(TargetKey, req.RequestLine.RequestTarget),
+		slog.String(ProtoKey, proto),
+		slog.Int(StatusKey, int(w.Status())),
+		slog.Int64(BytesKey, w.SentBodyBytes()),
+		slog.Duration(DurationKey, time.Since(start)),
+		slog.String(RefererKey, referer),
+		slog.String(UserAgentKey, userAgent),
+	)
+	handler.Handle(ctx, record)
+}
+
+// remoteHost drops the port from the client's address.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// basicUser returns the user name of Basic credentials, as claimed by the
+// client; it is not checked against anything.
+func basicUser(req *request.Request) string {
+	value, _ := req.Headers.Get("Authorization")
+	scheme, credentials, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return ""
+	}
+	user, _, _ := strings.Cut(string(decoded), ":")
+	return user
+}
+
+// lineHandler writes records as Common or Combined Log Format lines. Only
+// the access log attributes are used; others and groups are ignored.
+type lineHandler struct {
+	w        io.Writer
+	combined bool
+	mu       *sync.Mutex
+}
+
+func (h *lineHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *lineHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *lineHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := map[string]slog.Value{}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.Resolve()
+		return true
+	})
+	field := func(key string) string {
+		if v, ok := attrs[key]; ok && v.String() != "" {
+			return v.String()
+		}
+		return "-"
+	}
+	bytes := field(BytesKey)
+	if bytes == "0" {
+		bytes = "-"
+	}
+
+	requestLine := "-"
+	if method := attrs[MethodKey].String(); method != "" {
+		requestLine = method + " " + attrs[TargetKey].String() + " " + attrs[ProtoKey].String()
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %s %s %s",
+		field(RemoteAddrKey), escape(field(UserKey)), r.Time.Format(clfTime),
+		quote(requestLine), field(StatusKey), bytes)
+	if h.combined {
+		line += " " + quote(field(RefererKey)) + " " + quote(field(UserAgentKey))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+// quote wraps a client supplied value in quotes with quotes, backslashes
+// and control characters escaped, so it cannot break the line apart.
+func quote(s string) string {
+	return `"` + escape(s) + `"`
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			b.WriteString(`\x` + strconv.FormatUint(uint64(c)|0x100, 16)[1:])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,195 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/compression"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+func hello(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(5))
+	w.WriteBody([]byte("hello"))
+}
+
+func empty(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusNoContent)
+	w.WriteHeaders(*response.GetDefaultHeaders(0))
+}
+
+// serve runs a request through handler with access logging in format and
+// returns the log output.
+func serve(t *testing.T, handler server.Handler, format Format, raw string) string {
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.7:51234"
+	logs := &bytes.Buffer{}
+	w := response.NewWriter(&bytes.Buffer{})
+	server.Chain(handler, Middleware(New(logs, format)))(w, req)
+	require.NoError(t, w.Finish())
+	return logs.String()
+}
+
+const get = "GET /index.html?q=1 HTTP/1.1\r\nHost: localhost\r\n" +
+	"Referer: http://example.com/\r\nUser-Agent: test \"agent\"\r\n" +
+	"Authorization: Basic Ym9iOnNlY3JldA==\r\n\r\n"
+
+func TestLineFormats(t *testing.T) {
+	// Test: Common Log Format
+	line := serve(t, hello, CommonFormat, get)
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.7 - bob \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /index\.html\?q=1 HTTP/1\.1" 200 5\n$`), line)
+
+	// Test: Combined Log Format adds the escaped Referer and User-Agent
+	line = serve(t, hello, CombinedFormat, get)
+	assert.True(t, strings.HasSuffix(line, `" 200 5 "http://example.com/" "test \"agent\""`+"\n"), line)
+
+	// Test: Missing fields and empty bodies are dashes
+	line = serve(t, empty, CombinedFormat, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.7 - - \[.*\] "GET / HTTP/1\.1" 204 - "-" "-"\n$`), line)
+
+	// Test: The bytes are those sent, after content coding
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+	logs := &bytes.Buffer{}
+	w := response.NewWriter(&bytes.Buffer{})
+	large := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(4096))
+		w.WriteBody(bytes.Repeat([]byte("a"), 4096))
+	}
+	server.Chain(large, Middleware(New(logs, CommonFormat)), compression.Middleware(compression.Options{}))(w, req)
+	require.NoError(t, w.Finish())
+	fields := strings.Fields(logs.String())
+	sent, err := strconv.Atoi(fields[len(fields)-1])
+	require.NoError(t, err)
+	assert.Equal(t, w.SentBodyBytes(), int64(sent))
+	assert.Less(t, sent, 4096)
+
+	// Test: Control characters cannot split a line
+	assert.Equal(t, `"a\"b\\c\x0a"`, quote("a\"b\\c\n"))
+}
+
+func TestJSONFormat(t *testing.T) {
+	// Test: Each request is one JSON object with all attributes
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(serve(t, hello, JSONFormat, get)), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "192.0.2.7", record[RemoteAddrKey])
+	assert.Equal(t, "bob", record[UserKey])
+	assert.Equal(t, "GET", record[MethodKey])
+	assert.Equal(t, "/index.html?q=1", record[TargetKey])
+	assert.Equal(t, "HTTP/1.1", record[ProtoKey])
+	assert.Equal(t, float64(200), record[StatusKey])
+	assert.Equal(t, float64(5), record[BytesKey])
+	assert.Contains(t, record, DurationKey)
+	assert.Equal(t, "http://example.com/", record[RefererKey])
+	assert.Equal(t, `test "agent"`, record[UserAgentKey])
+
+	// Test: Format names
+	format, err := ParseFormat("JSON")
+	require.NoError(t, err)
+	assert.Equal(t, JSONFormat, format)
+	_, err = ParseFormat("apache")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	f, err := OpenFile(path)
+	require.NoError(t, err)
+	defer f.Close()
+	stop := f.ReopenOn(syscall.SIGHUP)
+	defer stop()
+
+	// Test: After the log is moved away, SIGHUP starts a new file at the path
+	_, err = f.Write([]byte("one\n"))
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(path, path+".1"))
+	_, err = f.Write([]byte("two\n"))
+	require.NoError(t, err)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = f.Write([]byte("three\n"))
+	require.NoError(t, err)
+
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(rotated))
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "three\n", string(current))
+}
+
+// lockedBuffer is a bytes.Buffer that the server's goroutines can write to
+// while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRejected(t *testing.T) {
+	logs := &lockedBuffer{}
+	logger := New(logs, CommonFormat)
+	s, err := server.ServeWithOptions(0, server.Chain(hello, Middleware(logger)), server.Options{
+		Rejected: Rejected(logger),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Addr().(*net.TCPAddr).Port))
+
+	// Test: Requests the server answers itself are logged too
+	for _, raw := range []string{
+		"BAD REQUEST\r\n\r\n",
+		"GET /nohost HTTP/1.1\r\n\r\n",
+		"GET /expect HTTP/1.1\r\nHost: localhost\r\nExpect: magic\r\n\r\n",
+		"GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		conn.Write([]byte(raw))
+		io.ReadAll(conn)
+		conn.Close()
+	}
+	require.Eventually(t, func() bool {
+		return strings.Count(logs.String(), "\n") == 4
+	}, time.Second, 10*time.Millisecond)
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Regexp(t, `^127\.0\.0\.1 - - \[.*\] "-" 400 -$`, lines[0])
+	assert.Regexp(t, `"GET /nohost HTTP/1\.1" 400 \d+$`, lines[1])
+	assert.Regexp(t, `"GET /expect HTTP/1\.1" 417 \d+$`, lines[2])
+	assert.Regexp(t, `"GET /ok HTTP/1\.1" 200 5$`, lines[3])
+}
@@ -0,0 +1,83 @@
+package accesslog
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// File is an append-only log file that can be reopened by path, so a log
+// rotated by renaming it moves on to a fresh file.
+type File struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// OpenFile opens path for appending, creating it if needed.
+func OpenFile(path string) (*File, error) {
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, file: file}, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Reopen opens the path again and switches writes over to it. If that
+// fails writes keep going to the file that was open.
+func (f *File) Reopen() error {
+	file, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+	return old.Close()
+}
+
+// ReopenOn reopens the file each time the process receives one of the
+// signals, typically SIGHUP from logrotate. Calling the returned function
+// stops listening.
+func (f *File) ReopenOn(signals ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, signals...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if err := f.Reopen(); err != nil {
+					log.Printf("Error reopening access log %s: %v", f.path, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
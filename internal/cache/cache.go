@@ -0,0 +1,626 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// DefaultMaxEntrySize is the largest body stored when Options.MaxEntrySize
+// is zero.
+const DefaultMaxEntrySize = 1 << 20
+
+// notStored are fields that describe one transfer rather than the stored
+// response.
+var notStored = []string{
+	"connection",
+	"keep-alive",
+	"transfer-encoding",
+	"trailer",
+	"upgrade",
+	"proxy-connection",
+	"x-cache",
+}
+
+type Options struct {
+	// Store holds the responses. Nil uses a MemoryStore of
+	// DefaultMaxBytes.
+	Store Store
+	// MaxEntrySize is the largest body that is stored. Zero uses
+	// DefaultMaxEntrySize.
+	MaxEntrySize int64
+}
+
+type cache struct {
+	store        Store
+	maxEntrySize int64
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// Middleware is a shared cache (RFC 9111) in front of the handlers it
+// wraps. It stores GET responses that are explicitly or heuristically
+// fresh or that carry a validator, serves them while they are fresh, and
+// revalidates stale ones with a conditional request to the handler. Every
+// response is marked with an X-Cache header: HIT, MISS, STALE or
+// REVALIDATED. List it before middleware that encodes bodies, such as
+// compression, so that it records the bytes actually sent.
+func Middleware(options Options) server.Middleware {
+	c := &cache{
+		store:        options.Store,
+		maxEntrySize: options.MaxEntrySize,
+		revalidating: map[string]bool{},
+	}
+	if c.store == nil {
+		c.store = NewMemoryStore(DefaultMaxBytes)
+	}
+	if c.maxEntrySize == 0 {
+		c.maxEntrySize = DefaultMaxEntrySize
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			c.serve(w, req, next)
+		}
+	}
+}
+
+func headerValue(h *headers.Headers, name string) string {
+	v, _ := h.Get(name)
+	return v
+}
+
+// primaryKey identifies a resource regardless of the fields it varies on.
+func primaryKey(req *request.Request) string {
+	return headerValue(req.Headers, "Host") + req.RequestLine.RequestTarget
+}
+
+func normalizeField(value string) string {
+	parts := strings.Split(value, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+func variantKey(primary string, index *Entry, req *request.Request) string {
+	var b strings.Builder
+	b.WriteString(primary + "\n" + index.VaryID)
+	for _, name := range index.VaryNames {
+		b.WriteString("\n" + name + "=" + normalizeField(headerValue(req.Headers, name)))
+	}
+	return b.String()
+}
+
+func requestDirectives(req *request.Request) directives {
+	value, ok := req.Headers.Get("Cache-Control")
+	if !ok && strings.Contains(strings.ToLower(headerValue(req.Headers, "Pragma")), "no-cache") {
+		return directives{"no-cache": ""}
+	}
+	return parseCacheControl(value)
+}
+
+// lookup finds the stored response matching req, if any.
+func (c *cache) lookup(primary string, req *request.Request) *Entry {
+	entry, ok := c.store.Get(primary)
+	if !ok {
+		return nil
+	}
+	if entry.VaryNames == nil {
+		return entry
+	}
+	entry, ok = c.store.Get(variantKey(primary, entry, req))
+	if !ok {
+		return nil
+	}
+	return entry
+}
+
+func (c *cache) serve(w *response.Writer, req *request.Request, next server.Handler) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		w.AddHeaderHook(c.invalidateHook(req))
+		next(w, req)
+		return
+	}
+	// Ranges and protocol upgrades are passed straight through.
+	_, hasRange := req.Headers.Get("Range")
+	_, hasUpgrade := req.Headers.Get("Upgrade")
+	if hasRange || hasUpgrade {
+		next(w, req)
+		return
+	}
+
+	reqCC := requestDirectives(req)
+	primary := primaryKey(req)
+	now := time.Now()
+	if entry := c.lookup(primary, req); entry != nil {
+		respCC := parseCacheControl(entry.header("cache-control"))
+		age := entry.age(now)
+		lifetime := entry.freshnessLifetime()
+		fresh := age < lifetime
+		if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+			fresh = false
+		}
+		if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+			fresh = false
+		}
+		mustRevalidate := reqCC.has("no-cache") || respCC.has("no-cache")
+		if fresh && !mustRevalidate {
+			c.writeEntry(w, req, entry, now, "HIT")
+			return
+		}
+
+		staleFor := age - lifetime
+		revalidateRequired := mustRevalidate || respCC.has("must-revalidate") || respCC.has("proxy-revalidate")
+		if !revalidateRequired {
+			if maxStale, ok := reqCC["max-stale"]; ok {
+				limit, _ := reqCC.seconds("max-stale")
+				if maxStale == "" || staleFor <= limit {
+					c.writeEntry(w, req, entry, now, "STALE")
+					return
+				}
+			}
+			if window, ok := respCC.seconds("stale-while-revalidate"); ok && staleFor <= window && entry.hasValidator() {
+				c.writeEntry(w, req, entry, now, "STALE")
+				go c.revalidateInBackground(req, next, primary, entry)
+				return
+			}
+		}
+		if reqCC.has("only-if-cached") {
+			gatewayTimeout(w)
+			return
+		}
+		c.revalidate(w, req, next, primary, entry)
+		return
+	}
+
+	if reqCC.has("only-if-cached") {
+		gatewayTimeout(w)
+		return
+	}
+	if method == "GET" && !reqCC.has("no-store") {
+		w.AddHeaderHook(c.storeHook(w, req, primary, now))
+	} else {
+		w.AddHeaderHook(markHook("MISS"))
+	}
+	next(w, req)
+}
+
+func gatewayTimeout(w *response.Writer) {
+	(&server.HandlerError{StatusCode: response.StatusGatewayTimeout, Message: "Not cached"}).Write(w)
+}
+
+func markHook(status string) response.HeaderHook {
+	return func(_ response.StatusCode, h *headers.Headers) response.Encoder {
+		h.Replace("X-Cache", status)
+		return nil
+	}
+}
+
+// invalidateHook drops the stored response for the target of an unsafe
+// request that succeeded (RFC 9111 section 4.4).
+func (c *cache) invalidateHook(req *request.Request) response.HeaderHook {
+	return func(status response.StatusCode, h *headers.Headers) response.Encoder {
+		if status < 400 {
+			c.store.Delete(primaryKey(req))
+		}
+		return nil
+	}
+}
+
+// storable checks a response against the rules for what a shared cache may
+// store (RFC 9111 section 3).
+func storable(req *request.Request, e *Entry) bool {
+	cc := parseCacheControl(e.header("cache-control"))
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if _, ok := req.Headers.Get("Authorization"); ok && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	if strings.TrimSpace(e.header("vary")) == "*" {
+		return false
+	}
+	// Cookies set for one client must not be handed to another.
+	if _, ok := e.Header["set-cookie"]; ok {
+		return false
+	}
+	explicit := cc.has("max-age") || cc.has("s-maxage") || cc.has("public")
+	if _, ok := e.Header["expires"]; ok {
+		explicit = true
+	}
+	if !explicit && !heuristicallyCacheable[e.Status] {
+		return false
+	}
+	return e.freshnessLifetime() > 0 || e.hasValidator()
+}
+
+func newEntry(status response.StatusCode, reason string, h *headers.Headers, body []byte, requestTime, responseTime time.Time) *Entry {
+	e := &Entry{
+		Status:       int(status),
+		Reason:       reason,
+		Header:       map[string][]string{},
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	h.ForEach(func(n, v string) {
+		e.Header[n] = append(e.Header[n], v)
+	})
+	for _, name := range notStored {
+		delete(e.Header, name)
+	}
+	return e
+}
+
+// put stores e for req, keeping an index entry when it varies on request
+// fields.
+func (c *cache) put(req *request.Request, primary string, e *Entry) {
+	if !storable(req, e) || int64(len(e.Body)) > c.maxEntrySize {
+		return
+	}
+	vary := []string{}
+	for _, name := range strings.Split(e.header("vary"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			vary = append(vary, name)
+		}
+	}
+	if len(vary) == 0 {
+		c.store.Set(primary, e)
+		return
+	}
+	sort.Strings(vary)
+	index, ok := c.store.Get(primary)
+	if !ok || strings.Join(index.VaryNames, ",") != strings.Join(vary, ",") {
+		index = &Entry{VaryNames: vary, VaryID: newVaryID()}
+		c.store.Set(primary, index)
+	}
+	c.store.Set(variantKey(primary, index, req), e)
+}
+
+// newVaryID tells apart the variants stored under different index entries,
+// so replacing an index orphans the variants stored under the old one.
+func newVaryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// storeHook records the response as it is written and stores it once the
+// body is complete.
+func (c *cache) storeHook(w *response.Writer, req *request.Request, primary string, requestTime time.Time) response.HeaderHook {
+	return func(status response.StatusCode, h *headers.Headers) response.Encoder {
+		h.Replace("X-Cache", "MISS")
+		// A cheap first look; put checks again with the final headers.
+		probe := newEntry(status, "", h, nil, requestTime, time.Now())
+		if !storable(req, probe) {
+			return nil
+		}
+		// Leave large bodies alone, so file responses keep their zero-copy
+		// path instead of passing through the recorder.
+		if n, err := strconv.ParseInt(probe.header("content-length"), 10, 64); err == nil && n > c.maxEntrySize {
+			return nil
+		}
+		return func(dst io.Writer) io.WriteCloser {
+			return &recorder{
+				dst:   dst,
+				limit: c.maxEntrySize,
+				done: func(body []byte) {
+					// Later hooks may have changed the status and h, and the
+					// recorder sits closest to the connection, so this is
+					// what was sent.
+					if length, ok := h.Get("Content-Length"); ok && length != strconv.Itoa(len(body)) {
+						return
+					}
+					status := w.Status()
+					reason := response.StatusText(status)
+					c.put(req, primary, newEntry(status, reason, h, body, requestTime, time.Now()))
+				},
+			}
+		}
+	}
+}
+
+// recorder copies a body to dst and keeps it, up to limit bytes.
+type recorder struct {
+	dst      io.Writer
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func(body []byte)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if !r.overflow {
+		if int64(r.buf.Len()+len(p)) > r.limit {
+			r.overflow = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p)
+		}
+	}
+	return r.dst.Write(p)
+}
+
+func (r *recorder) Flush() error {
+	if f, ok := r.dst.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (r *recorder) Close() error {
+	if !r.overflow && r.done != nil {
+		r.done(r.buf.Bytes())
+		r.done = nil
+	}
+	return nil
+}
+
+// conditional builds a GET that asks the handler whether entry is still
+// current. It carries req's target, fields and context but no body: the
+// client's body, and the fields that frame it, stay with the client's
+// request.
+func conditional(req *request.Request, entry *Entry) *request.Request {
+	out := &request.Request{
+		RequestLine: req.RequestLine,
+		Headers:     headers.NewHeaders(),
+		RemoteAddr:  req.RemoteAddr,
+	}
+	out.RequestLine.Method = "GET"
+	req.Headers.ForEach(func(n, v string) {
+		switch n {
+		case "if-none-match", "if-modified-since", "if-match", "if-unmodified-since", "if-range",
+			"content-length", "transfer-encoding", "content-type", "content-encoding", "expect":
+			return
+		}
+		out.Headers.Set(n, v)
+	})
+	if _, ok := entry.Header["etag"]; ok {
+		out.Headers.Set("If-None-Match", entry.header("etag"))
+	}
+	if _, ok := entry.Header["last-modified"]; ok {
+		out.Headers.Set("If-Modified-Since", entry.header("last-modified"))
+	}
+	out.SetContext(req.Context())
+	return out
+}
+
+type fetched struct {
+	resp *response.Response
+	body []byte
+	// rest is the unread remainder of a body too large to store, or nil
+	// when body holds all of it. close must be called once it is done
+	// with.
+	rest         io.Reader
+	close        func()
+	requestTime  time.Time
+	responseTime time.Time
+}
+
+// fetch runs the handler for req and parses what it writes, buffering at
+// most limit bytes of the body. A longer body is left in rest so it can be
+// streamed on without being stored.
+func fetch(next server.Handler, req *request.Request, limit int64) (*fetched, error) {
+	requestTime := time.Now()
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := response.NewWriterSize(pw, 0)
+		next(w, req)
+		pw.CloseWithError(w.Finish())
+	}()
+	// stop makes the handler's remaining writes fail and waits for it to
+	// return.
+	stop := func() {
+		pr.Close()
+		<-done
+	}
+	reader := response.NewReader(pr)
+	resp, err := reader.ReadResponse(req.RequestLine.Method)
+	// Interim responses such as 103 Early Hints are not stored.
+	for err == nil && resp.Interim() {
+		resp, err = reader.ReadResponse(req.RequestLine.Method)
+	}
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	f := &fetched{resp: resp, body: body, close: stop, requestTime: requestTime, responseTime: time.Now()}
+	if int64(len(body)) > limit {
+		f.rest = resp.Body
+		return f, nil
+	}
+	stop()
+	return f, nil
+}
+
+// freshen applies the fields of a 304 to a copy of the stored response
+// (RFC 9111 section 4.3.4).
+func freshen(entry *Entry, f *fetched) *Entry {
+	updated := *entry
+	updated.Header = map[string][]string{}
+	for n, values := range entry.Header {
+		updated.Header[n] = values
+	}
+	// A field the 304 carries replaces every stored line of it.
+	replaced := map[string][]string{}
+	f.resp.Headers.ForEach(func(n, v string) {
+		switch n {
+		case "content-length", "content-encoding", "content-type", "content-range":
+			return
+		}
+		replaced[n] = append(replaced[n], v)
+	})
+	for n, values := range replaced {
+		updated.Header[n] = values
+	}
+	for _, name := range notStored {
+		delete(updated.Header, name)
+	}
+	updated.RequestTime = f.requestTime
+	updated.ResponseTime = f.responseTime
+	return &updated
+}
+
+// update stores what a revalidation returned and reports the entry to
+// serve, or nil when the response should be relayed as it is.
+func (c *cache) update(req *request.Request, primary string, entry *Entry, f *fetched) *Entry {
+	if f.resp.StatusLine.StatusCode == response.StatusNotModified {
+		updated := freshen(entry, f)
+		c.put(req, primary, updated)
+		return updated
+	}
+	if _, chunked := f.resp.Headers.Get("Transfer-Encoding"); chunked {
+		f.resp.Headers.Delete("Transfer-Encoding")
+		f.resp.Headers.Replace("Content-Length", strconv.Itoa(len(f.body)))
+	}
+	fresh := newEntry(f.resp.StatusLine.StatusCode, f.resp.StatusLine.ReasonPhrase, f.resp.Headers, f.body, f.requestTime, f.responseTime)
+	c.put(req, primary, fresh)
+	return nil
+}
+
+func (c *cache) revalidate(w *response.Writer, req *request.Request, next server.Handler, primary string, entry *Entry) {
+	f, err := fetch(next, conditional(req, entry), c.maxEntrySize)
+	if err != nil {
+		(&server.HandlerError{StatusCode: response.StatusBadGateway, Message: "Revalidation failed"}).Write(w)
+		return
+	}
+	defer f.close()
+	if f.rest != nil {
+		// The new response is too large to store, and the entry it
+		// replaces is no longer current.
+		c.store.Delete(primary)
+	} else if updated := c.update(req, primary, entry, f); updated != nil {
+		c.writeEntry(w, req, updated, time.Now(), "REVALIDATED")
+		return
+	}
+	h := headers.NewHeaders()
+	f.resp.Headers.ForEach(func(n, v string) {
+		h.Set(n, v)
+	})
+	h.Replace("X-Cache", "MISS")
+	w.WriteStatusLineReason(f.resp.StatusLine.StatusCode, f.resp.StatusLine.ReasonPhrase)
+	w.WriteHeaders(*h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+	w.WriteBody(f.body)
+	if f.rest == nil {
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.rest.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteBody(buf[:n]); werr != nil {
+				return
+			}
+			w.Flush()
+		}
+		if err != nil {
+			if err != io.EOF {
+				w.Abort()
+			}
+			return
+		}
+	}
+}
+
+// revalidateInBackground refreshes a stale entry that has already been
+// served, at most once at a time per resource.
+func (c *cache) revalidateInBackground(req *request.Request, next server.Handler, primary string, entry *Entry) {
+	c.mu.Lock()
+	if c.revalidating[primary] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[primary] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.revalidating, primary)
+		c.mu.Unlock()
+	}()
+
+	// The client's request may be gone by the time this runs, so nothing
+	// it was handed by the middleware around the cache is passed on.
+	out := conditional(req, entry)
+	out.SetContext(context.Background())
+	f, err := fetch(next, out, c.maxEntrySize)
+	if err != nil {
+		return
+	}
+	defer f.close()
+	if f.rest != nil {
+		c.store.Delete(primary)
+		return
+	}
+	c.update(req, primary, entry, f)
+}
+
+// notModified reports whether the client's own conditional headers match
+// the stored response.
+func notModified(req *request.Request, entry *Entry) bool {
+	if inm, ok := req.Headers.Get("If-None-Match"); ok {
+		if _, ok := entry.Header["etag"]; !ok {
+			return false
+		}
+		etag := entry.header("etag")
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, ok := parseTime(headerValue(req.Headers, "If-Modified-Since")); ok {
+		lm, ok := parseTime(entry.header("last-modified"))
+		return ok && !lm.After(ims)
+	}
+	return false
+}
+
+func (c *cache) writeEntry(w *response.Writer, req *request.Request, entry *Entry, now time.Time, status string) {
+	h := headers.NewHeaders()
+	for n, values := range entry.Header {
+		for _, v := range values {
+			h.Add(n, v)
+		}
+	}
+	h.Replace("Age", strconv.Itoa(int(entry.age(now).Seconds())))
+	h.Replace("X-Cache", status)
+
+	if entry.Status == int(response.StatusOK) && notModified(req, entry) {
+		h.Delete("Content-Length")
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(*h)
+		return
+	}
+	h.Replace("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteStatusLineReason(response.StatusCode(entry.Status), entry.Reason)
+	w.WriteHeaders(*h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(entry.Body)
+	}
+}
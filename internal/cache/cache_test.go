@@ -0,0 +1,312 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// origin answers with "v<n>" for its nth call and the given header lines.
+// When etag is set it also honors If-None-Match with a 304.
+type origin struct {
+	calls   atomic.Int32
+	headers []string
+	etag    string
+	// lastRequest records the last request the origin saw.
+	lastRequest atomic.Pointer[request.Request]
+}
+
+func (o *origin) handle(w *response.Writer, req *request.Request) {
+	n := o.calls.Add(1)
+	o.lastRequest.Store(req)
+	if o.etag != "" && headerValue(req.Headers, "If-None-Match") == o.etag {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("ETag", o.etag)
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(*h)
+		return
+	}
+	body := fmt.Sprintf("v%d", n)
+	h := response.GetDefaultHeaders(len(body))
+	for _, line := range o.headers {
+		name, value, _ := strings.Cut(line, ": ")
+		h.Add(name, value)
+	}
+	if o.etag != "" {
+		h.Set("ETag", o.etag)
+	}
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+// do runs one request through handler and returns the parsed response and
+// body.
+func do(t *testing.T, handler server.Handler, method, target string, extraHeaders ...string) (*response.Response, string) {
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	for _, h := range extraHeaders {
+		raw += h + "\r\n"
+	}
+	if method == "POST" {
+		raw += "Content-Length: 0\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.NewReader(out).ReadResponse(method)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func cached(o *origin) server.Handler {
+	return server.Chain(o.handle, Middleware(Options{}))
+}
+
+func TestFreshness(t *testing.T) {
+	// Test: Fresh response is served from the cache
+	o := &origin{headers: []string{"Cache-Control: max-age=60"}}
+	handler := cached(o)
+	resp, body := do(t, handler, "GET", "/a")
+	assert.Equal(t, "MISS", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "v1", body)
+	resp, body = do(t, handler, "GET", "/a")
+	assert.Equal(t, "HIT", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "0", headerValue(resp.Headers, "Age"))
+	assert.Equal(t, int32(1), o.calls.Load())
+	_, hasConnection := resp.Headers.Get("Connection")
+	assert.False(t, hasConnection)
+
+	// Test: HEAD is answered from the stored GET
+	resp, body = do(t, handler, "HEAD", "/a")
+	assert.Equal(t, "HIT", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "2", headerValue(resp.Headers, "Content-Length"))
+	assert.Equal(t, "", body)
+
+	// Test: Repeated fields are replayed line by line
+	o = &origin{headers: []string{"Cache-Control: max-age=60", "Link: </a.css>", "Link: </b.js>"}}
+	handler = cached(o)
+	do(t, handler, "GET", "/a")
+	req, err := request.RequestFromReader(strings.NewReader("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "link: </a.css>\r\n")
+	assert.Contains(t, out.String(), "link: </b.js>\r\n")
+
+	// Test: Other targets are separate entries
+	_, body = do(t, handler, "GET", "/b")
+	assert.Equal(t, "v2", body)
+
+	// Test: s-maxage wins over max-age for a shared cache
+	o = &origin{headers: []string{"Cache-Control: max-age=0, s-maxage=60"}}
+	handler = cached(o)
+	do(t, handler, "GET", "/")
+	resp, _ = do(t, handler, "GET", "/")
+	assert.Equal(t, "HIT", headerValue(resp.Headers, "X-Cache"))
+
+	// Test: Expires in the future
+	o = &origin{headers: []string{"Expires: " + time.Now().Add(time.Hour).UTC().Format(response.TimeFormat)}}
+	handler = cached(o)
+	do(t, handler, "GET", "/")
+	resp, _ = do(t, handler, "GET", "/")
+	assert.Equal(t, "HIT", headerValue(resp.Headers, "X-Cache"))
+
+	// Test: An Age from upstream counts against max-age
+	o = &origin{headers: []string{"Cache-Control: max-age=60", "Age: 100"}}
+	handler = cached(o)
+	do(t, handler, "GET", "/")
+	resp, body = do(t, handler, "GET", "/")
+	assert.Equal(t, "MISS", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "v2", body)
+}
+
+func TestNotStored(t *testing.T) {
+	for _, headers := range [][]string{
+		{"Cache-Control: no-store, max-age=60"},
+		{"Cache-Control: private, max-age=60"},
+		{"Cache-Control: max-age=60", "Vary: *"},
+		{"Cache-Control: max-age=60", "Set-Cookie: id=1"},
+		{},
+	} {
+		o := &origin{headers: headers}
+		handler := cached(o)
+		do(t, handler, "GET", "/")
+		_, body := do(t, handler, "GET", "/")
+		assert.Equal(t, "v2", body, headers)
+	}
+
+	// Test: Requests with credentials are only cached when allowed
+	o := &origin{headers: []string{"Cache-Control: max-age=60"}}
+	handler := cached(o)
+	do(t, handler, "GET", "/", "Authorization: Basic Zm9vOmJhcg==")
+	_, body := do(t, handler, "GET", "/", "Authorization: Basic Zm9vOmJhcg==")
+	assert.Equal(t, "v2", body)
+	o = &origin{headers: []string{"Cache-Control: public, max-age=60"}}
+	handler = cached(o)
+	do(t, handler, "GET", "/", "Authorization: Basic Zm9vOmJhcg==")
+	_, body = do(t, handler, "GET", "/", "Authorization: Basic Zm9vOmJhcg==")
+	assert.Equal(t, "v1", body)
+
+	// Test: Request no-store
+	o = &origin{headers: []string{"Cache-Control: max-age=60"}}
+	handler = cached(o)
+	do(t, handler, "GET", "/", "Cache-Control: no-store")
+	_, body = do(t, handler, "GET", "/")
+	assert.Equal(t, "v2", body)
+}
+
+func TestRevalidation(t *testing.T) {
+	// Test: Stale entry is revalidated with its ETag
+	o := &origin{headers: []string{"Cache-Control: max-age=0"}, etag: `"abc"`}
+	handler := cached(o)
+	do(t, handler, "GET", "/")
+	resp, body := do(t, handler, "GET", "/")
+	assert.Equal(t, "REVALIDATED", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, `"abc"`, headerValue(o.lastRequest.Load().Headers, "If-None-Match"))
+	assert.Equal(t, int32(2), o.calls.Load())
+
+	// Test: A changed resource replaces the entry
+	o.etag = `"def"`
+	resp, body = do(t, handler, "GET", "/")
+	assert.Equal(t, "MISS", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "v3", body)
+
+	// Test: Request no-cache revalidates a fresh entry
+	o = &origin{headers: []string{"Cache-Control: max-age=60"}, etag: `"abc"`}
+	handler = cached(o)
+	do(t, handler, "GET", "/")
+	resp, _ = do(t, handler, "GET", "/", "Cache-Control: no-cache")
+	assert.Equal(t, "REVALIDATED", headerValue(resp.Headers, "X-Cache"))
+	resp, _ = do(t, handler, "GET", "/", "Pragma: no-cache")
+	assert.Equal(t, "REVALIDATED", headerValue(resp.Headers, "X-Cache"))
+
+	// Test: Client's own validator gets a 304 from the cache
+	resp, body = do(t, handler, "GET", "/", `If-None-Match: "abc"`)
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	assert.Equal(t, "HIT", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "", body)
+
+	// Test: only-if-cached
+	resp, _ = do(t, handler, "GET", "/missing", "Cache-Control: only-if-cached")
+	assert.Equal(t, response.StatusGatewayTimeout, resp.StatusLine.StatusCode)
+}
+
+func TestLargeRevalidation(t *testing.T) {
+	var calls atomic.Int32
+	large := strings.Repeat("x", 100)
+	origin := func(w *response.Writer, req *request.Request) {
+		body := "v1"
+		if calls.Add(1) > 1 {
+			body = large
+		}
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Cache-Control", "max-age=0")
+		h.Set("ETag", fmt.Sprintf(`"%d"`, len(body)))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(body))
+	}
+	handler := server.Chain(origin, Middleware(Options{MaxEntrySize: 10}))
+	do(t, handler, "GET", "/")
+
+	// Test: A replacement too large to store is streamed through whole
+	resp, body := do(t, handler, "GET", "/")
+	assert.Equal(t, "MISS", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, large, body)
+
+	// Test: The entry it replaced is dropped rather than revalidated again
+	resp, body = do(t, handler, "GET", "/")
+	assert.Equal(t, "MISS", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, large, body)
+	_, ok := resp.Headers.Get("ETag")
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	o := &origin{headers: []string{"Cache-Control: max-age=10, stale-while-revalidate=60", "Age: 20"}, etag: `"v"`}
+	handler := cached(o)
+	do(t, handler, "GET", "/")
+
+	// Test: Stale entry is served at once and refreshed behind the scenes
+	o.etag = `"w"`
+	resp, body := do(t, handler, "GET", "/")
+	assert.Equal(t, "STALE", headerValue(resp.Headers, "X-Cache"))
+	assert.Equal(t, "v1", body)
+	require.Eventually(t, func() bool {
+		_, body := do(t, handler, "GET", "/")
+		return body == "v2"
+	}, time.Second, 5*time.Millisecond)
+
+	// Test: The background fetch gets neither the client's body nor its context
+	o = &origin{headers: []string{"Cache-Control: max-age=10, stale-while-revalidate=60", "Age: 20"}, etag: `"v"`}
+	handler = cached(o)
+	do(t, handler, "GET", "/")
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody"))
+	require.NoError(t, err)
+	req.SetContext(context.WithValue(req.Context(), contextKey{}, "client"))
+	w := response.NewWriter(io.Discard)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	require.Eventually(t, func() bool {
+		last := o.lastRequest.Load()
+		return last != nil && headerValue(last.Headers, "If-None-Match") != ""
+	}, time.Second, 5*time.Millisecond)
+	background := o.lastRequest.Load()
+	assert.Equal(t, "", background.Body)
+	_, ok := background.Headers.Get("Content-Length")
+	assert.False(t, ok)
+	assert.Nil(t, background.Context().Value(contextKey{}))
+}
+
+type contextKey struct{}
+
+func TestVary(t *testing.T) {
+	o := &origin{headers: []string{"Cache-Control: max-age=60", "Vary: Accept-Language"}}
+	handler := cached(o)
+
+	// Test: Each variant is stored separately
+	_, en := do(t, handler, "GET", "/", "Accept-Language: en")
+	_, fr := do(t, handler, "GET", "/", "Accept-Language: fr")
+	assert.Equal(t, "v1", en)
+	assert.Equal(t, "v2", fr)
+	_, body := do(t, handler, "GET", "/", "Accept-Language: en")
+	assert.Equal(t, "v1", body)
+	_, body = do(t, handler, "GET", "/", "Accept-Language: fr")
+	assert.Equal(t, "v2", body)
+	assert.Equal(t, int32(2), o.calls.Load())
+}
+
+func TestInvalidation(t *testing.T) {
+	o := &origin{headers: []string{"Cache-Control: max-age=60"}}
+	handler := cached(o)
+	do(t, handler, "GET", "/item")
+
+	// Test: A successful POST drops the stored response
+	do(t, handler, "POST", "/item")
+	_, body := do(t, handler, "GET", "/item")
+	assert.Equal(t, "v3", body)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp_http/internal/response"
+)
+
+// heuristicFraction is the share of a response's age since Last-Modified
+// used as its freshness lifetime when it gives none explicitly
+// (RFC 9111 section 4.2.2).
+const heuristicFraction = 10
+
+// maxHeuristicLifetime caps heuristic freshness.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// heuristicallyCacheable are the status codes that may be stored without
+// explicit freshness information (RFC 9110 section 15.1).
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// directives maps Cache-Control directive names to their values; directives
+// without a value map to "".
+type directives map[string]string
+
+func parseCacheControl(value string) directives {
+	d := directives{}
+	for _, item := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(item), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		d[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive. A directive that is present
+// without a valid value is reported as 0, which errs towards staleness.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func parseTime(value string) (time.Time, bool) {
+	t, err := time.Parse(response.TimeFormat, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// freshnessLifetime is how long after it was generated a response stays
+// fresh for a shared cache (RFC 9111 section 4.2.1).
+func (e *Entry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.header("cache-control"))
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := e.date()
+	if _, ok := e.Header["expires"]; ok {
+		t, ok := parseTime(e.header("expires"))
+		if !ok {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if lm, ok := parseTime(e.header("last-modified")); ok && heuristicallyCacheable[e.Status] {
+		return min(date.Sub(lm)/heuristicFraction, maxHeuristicLifetime)
+	}
+	return 0
+}
+
+// date is the Date header, or when the response was received if it has
+// none.
+func (e *Entry) date() time.Time {
+	if t, ok := parseTime(e.header("date")); ok {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// age is how old the response is now (RFC 9111 section 4.2.3).
+func (e *Entry) age(now time.Time) time.Duration {
+	ageValue := time.Duration(0)
+	if n, err := strconv.ParseInt(e.header("age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+func (e *Entry) hasValidator() bool {
+	_, etag := e.Header["etag"]
+	_, lm := e.Header["last-modified"]
+	return etag || lm
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiskStore is a Store that keeps one file per entry in a directory and
+// evicts the least recently used files once they take up more than
+// maxBytes. Entries written by an earlier process are picked up on open.
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// diskRecord is what an entry file holds. The key is kept so a lookup can
+// tell its entry apart from one whose key hashes the same.
+type diskRecord struct {
+	Key   string
+	Entry *Entry
+}
+
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		diskItem
+		modTime int64
+	}
+	found := []existing{}
+	for _, de := range dirEntries {
+		if de.IsDir() || strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{diskItem{de.Name(), info.Size()}, info.ModTime().UnixNano()})
+	}
+	// Oldest first, so the most recently written end up at the front.
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime < found[j].modTime })
+	for _, f := range found {
+		s.items[f.name] = s.lru.PushFront(&diskItem{f.name, f.size})
+		s.size += f.size
+	}
+	s.evict()
+	return s, nil
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	name := fileName(key)
+	s.mu.Lock()
+	el, ok := s.items[name]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	record := diskRecord{}
+	if err := gob.NewDecoder(f).Decode(&record); err != nil || record.Key != key {
+		return nil, false
+	}
+	return record.Entry, true
+}
+
+// Set writes the entry to a temporary file and renames it into place, so
+// a reader never sees a half-written entry.
+func (s *DiskStore) Set(key string, entry *Entry) error {
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(diskRecord{Key: key, Entry: entry}); err != nil {
+		tmp.Close()
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	size := info.Size()
+
+	name := fileName(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size > s.maxBytes {
+		s.remove(name)
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	if el, ok := s.items[name]; ok {
+		item := el.Value.(*diskItem)
+		s.size += size - item.size
+		item.size = size
+		s.lru.MoveToFront(el)
+	} else {
+		s.items[name] = s.lru.PushFront(&diskItem{name, size})
+		s.size += size
+	}
+	s.evict()
+	return nil
+}
+
+func (s *DiskStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(fileName(key))
+	return nil
+}
+
+func (s *DiskStore) evict() {
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*diskItem).name)
+	}
+}
+
+func (s *DiskStore) remove(name string) {
+	el, ok := s.items[name]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.items, name)
+	s.size -= el.Value.(*diskItem).size
+	os.Remove(filepath.Join(s.dir, name))
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a stored response.
+type Entry struct {
+	Status int
+	Reason string
+	// Header holds the end-to-end fields, keyed by lowercase name, with
+	// the value of each line the field had.
+	Header       map[string][]string
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// VaryNames is set on the index entry of a resource whose responses
+	// vary on request fields; the responses themselves are stored under
+	// keys derived from VaryID and the request's values for those fields.
+	VaryNames []string
+	VaryID    string
+}
+
+// Size approximates the memory an entry takes up.
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Body) + len(e.Reason) + len(e.VaryID) + 64)
+	for n, values := range e.Header {
+		for _, v := range values {
+			size += int64(len(n) + len(v))
+		}
+	}
+	for _, n := range e.VaryNames {
+		size += int64(len(n))
+	}
+	return size
+}
+
+// header returns the field's value, with the values of separate lines
+// joined by commas.
+func (e *Entry) header(name string) string {
+	return strings.Join(e.Header[name], ", ")
+}
+
+// Store keeps entries by key. Entries handed to and returned by a Store
+// must not be modified. Implementations must be safe for concurrent use.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry) error
+	Delete(key string) error
+}
+
+// DefaultMaxBytes is the size of the store Middleware creates when none is
+// given.
+const DefaultMaxBytes = 64 << 20
+
+// MemoryStore is a Store that evicts the least recently used entries once
+// it holds more than maxBytes.
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (s *MemoryStore) Set(key string, entry *Entry) error {
+	size := entry.Size() + int64(len(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size > s.maxBytes {
+		s.remove(key)
+		return nil
+	}
+	if el, ok := s.items[key]; ok {
+		item := el.Value.(*memoryItem)
+		s.size += size - item.size
+		item.entry, item.size = entry, size
+		s.lru.MoveToFront(el)
+	} else {
+		s.items[key] = s.lru.PushFront(&memoryItem{key: key, entry: entry, size: size})
+		s.size += size
+	}
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	return nil
+}
+
+func (s *MemoryStore) remove(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.size -= el.Value.(*memoryItem).size
+}
+
+// Len returns the number of stored entries.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
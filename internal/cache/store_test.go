@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func entryOf(body string) *Entry {
+	return &Entry{
+		Status:       200,
+		Reason:       "OK",
+		Header:       map[string][]string{"content-type": {"text/plain"}},
+		Body:         []byte(body),
+		ResponseTime: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	size := entryOf(strings.Repeat("x", 100)).Size() + 1
+	s := NewMemoryStore(3 * size)
+
+	// Test: Least recently used entry is evicted first
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Set(key, entryOf(strings.Repeat("x", 100))))
+	}
+	_, ok := s.Get("a")
+	require.True(t, ok)
+	require.NoError(t, s.Set("d", entryOf(strings.Repeat("x", 100))))
+	_, ok = s.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok = s.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	// Test: Entry larger than the whole store is not kept
+	require.NoError(t, s.Set("huge", entryOf(strings.Repeat("x", 1000))))
+	_, ok = s.Get("huge")
+	assert.False(t, ok)
+	assert.Equal(t, 3, s.Len())
+
+	// Test: Delete
+	require.NoError(t, s.Delete("a"))
+	_, ok = s.Get("a")
+	assert.False(t, ok)
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir, 1<<20)
+	require.NoError(t, err)
+
+	// Test: Round trip
+	require.NoError(t, s.Set("localhost/a", entryOf("hello")))
+	e, ok := s.Get("localhost/a")
+	require.True(t, ok)
+	assert.Equal(t, entryOf("hello"), e)
+
+	// Test: Entries survive reopening
+	s, err = NewDiskStore(dir, 1<<20)
+	require.NoError(t, err)
+	e, ok = s.Get("localhost/a")
+	require.True(t, ok)
+	assert.Equal(t, "hello", string(e.Body))
+
+	// Test: Size limit evicts older files
+	files, _ := os.ReadDir(dir)
+	require.Len(t, files, 1)
+	info, _ := files[0].Info()
+	s, err = NewDiskStore(dir, info.Size()*2+10)
+	require.NoError(t, err)
+	require.NoError(t, s.Set("localhost/b", entryOf("hello")))
+	require.NoError(t, s.Set("localhost/c", entryOf("hello")))
+	_, ok = s.Get("localhost/a")
+	assert.False(t, ok)
+	_, ok = s.Get("localhost/c")
+	assert.True(t, ok)
+	files, _ = os.ReadDir(dir)
+	assert.Len(t, files, 2)
+
+	// Test: Delete removes the file
+	require.NoError(t, s.Delete("localhost/c"))
+	_, ok = s.Get("localhost/c")
+	assert.False(t, ok)
+	files, _ = os.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,435 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/response"
+)
+
+const (
+	DefaultDialTimeout  = 30 * time.Second
+	DefaultIdleTimeout  = 90 * time.Second
+	DefaultMaxRedirects = 10
+	DefaultMaxIdleConns = 2
+)
+
+var ErrTooManyRedirects = fmt.Errorf("stopped after too many redirects")
+
+// Client sends HTTP/1.1 requests and keeps connections alive between them.
+// The zero value is ready to use, and a Client is safe for concurrent use.
+type Client struct {
+	// Timeout bounds a whole exchange, from dialing to the end of the
+	// response body, redirects included. Zero means no limit.
+	Timeout time.Duration
+	// ResponseHeaderTimeout bounds each request from dialing until the
+	// response head has arrived, sending the request body included. The
+	// response body is not limited by it. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+	// DialTimeout bounds establishing a connection, TLS handshake
+	// included. Zero uses DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Control is called for every address a connection is dialed to,
+	// after name resolution and before connecting, as with net.Dialer. An
+	// error from it fails the dial. Nil allows every address.
+	Control func(network, address string, c syscall.RawConn) error
+	// MaxRedirects is how many redirects are followed before Do gives up
+	// with ErrTooManyRedirects. Zero uses DefaultMaxRedirects, a negative
+	// value returns redirect responses as they are.
+	MaxRedirects int
+	// MaxIdleConnsPerHost caps the kept-alive connections per host. Zero
+	// uses DefaultMaxIdleConns, a negative value disables pooling.
+	MaxIdleConnsPerHost int
+	// IdleTimeout is how long an unused connection stays in the pool.
+	// Zero uses DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// TLSConfig is used for https URLs. Nil uses the system roots.
+	TLSConfig *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+var DefaultClient = &Client{}
+
+func Get(url string) (*response.Response, error) {
+	return DefaultClient.Get(url)
+}
+
+func (c *Client) Get(url string) (*response.Response, error) {
+	req, err := NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Head(url string) (*response.Response, error) {
+	req, err := NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Post(url, contentType string, body io.Reader) (*response.Response, error) {
+	req, err := NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Headers.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do sends req and returns the response once its head has arrived. The
+// caller must read Body to EOF or close it; a fully read body hands the
+// connection back to the pool.
+func (c *Client) Do(req *Request) (*response.Response, error) {
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+	for redirects := 0; ; redirects++ {
+		resp, err := c.send(req, deadline)
+		if err != nil {
+			return nil, err
+		}
+		next, err := c.redirect(req, resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if next == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if redirects >= c.maxRedirects() {
+			return nil, ErrTooManyRedirects
+		}
+		req = next
+	}
+}
+
+func (c *Client) maxRedirects() int {
+	if c.MaxRedirects == 0 {
+		return DefaultMaxRedirects
+	}
+	return c.MaxRedirects
+}
+
+// redirect returns the request to send next, or nil when resp is final.
+// A redirect that would have to repeat a body that cannot be sent again is
+// final, so the caller sees it.
+func (c *Client) redirect(req *Request, resp *response.Response) (*Request, error) {
+	if c.MaxRedirects < 0 {
+		return nil, nil
+	}
+	method := req.Method
+	keepBody := true
+	switch resp.StatusLine.StatusCode {
+	case response.StatusMovedPermanently, response.StatusFound:
+		if method == "POST" {
+			method, keepBody = "GET", false
+		} else if !req.replayable() {
+			// Other methods keep their body, which cannot be sent again.
+			return nil, nil
+		}
+	case response.StatusSeeOther:
+		if method != "HEAD" {
+			method = "GET"
+		}
+		keepBody = false
+	case response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		// The method and body must be repeated as they were.
+		if !req.replayable() {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	location, ok := resp.Headers.Get("Location")
+	if !ok {
+		return nil, nil
+	}
+	u, err := req.URL.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("bad redirect location %q: %w", location, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrUnsupportedScheme
+	}
+
+	next := &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+	}
+	sameHost := u.Host == req.URL.Host
+	req.Headers.ForEach(func(n, v string) {
+		switch n {
+		case "host":
+			return
+		case "authorization", "cookie":
+			// Credentials are not handed to another host.
+			if !sameHost {
+				return
+			}
+		case "content-type", "content-encoding":
+			if !keepBody {
+				return
+			}
+		}
+		next.Headers.Set(n, v)
+	})
+	if keepBody && req.Body != nil {
+		next.ContentLength = req.ContentLength
+		next.GetBody = req.GetBody
+		if err := next.rewind(); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// send performs one exchange. A pooled connection the server has closed
+// while idle fails on first use, so that case is retried once on a fresh
+// connection when the request can be replayed.
+func (c *Client) send(req *Request, deadline time.Time) (*response.Response, error) {
+	key := poolKey(req.URL)
+	for attempt := 0; ; attempt++ {
+		headDeadline := deadline
+		if c.ResponseHeaderTimeout > 0 {
+			t := time.Now().Add(c.ResponseHeaderTimeout)
+			if headDeadline.IsZero() || t.Before(headDeadline) {
+				headDeadline = t
+			}
+		}
+		cn, reused, err := c.getConn(key, req.URL, headDeadline)
+		if err != nil {
+			return nil, err
+		}
+		cn.SetDeadline(headDeadline)
+		resp, err := cn.roundTrip(req)
+		if err == nil {
+			cn.SetDeadline(deadline)
+			resp.Body = &body{
+				ReadCloser: resp.Body,
+				client:     c,
+				key:        key,
+				conn:       cn,
+				keepAlive:  resp.KeepAlive(),
+			}
+			return resp, nil
+		}
+		cn.Close()
+		if !reused || attempt > 0 || !req.replayable() || !staleConnError(err) {
+			return nil, err
+		}
+		if err := req.rewind(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func staleConnError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+type conn struct {
+	net.Conn
+	writer    *bufio.Writer
+	reader    *response.Reader
+	idleSince time.Time
+}
+
+func (cn *conn) roundTrip(req *Request) (*response.Response, error) {
+	if err := req.write(cn.writer); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := cn.reader.ReadResponse(req.Method)
+		if err != nil || !resp.Interim() {
+			return resp, err
+		}
+		// Interim responses such as 100 Continue carry no body; the final
+		// response follows on the same connection.
+	}
+}
+
+func poolKey(u *url.URL) string {
+	return u.Scheme + "://" + hostPort(u)
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func (c *Client) dial(u *url.URL, deadline time.Time) (*conn, error) {
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout, Deadline: deadline, Control: c.Control}
+	raw, err := dialer.Dial("tcp", hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+
+	var nc net.Conn = raw
+	if u.Scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(raw, config)
+		handshakeDeadline := time.Now().Add(timeout)
+		if !deadline.IsZero() && deadline.Before(handshakeDeadline) {
+			handshakeDeadline = deadline
+		}
+		tlsConn.SetDeadline(handshakeDeadline)
+		if err := tlsConn.Handshake(); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		nc = tlsConn
+	}
+	return &conn{
+		Conn:   nc,
+		writer: bufio.NewWriter(nc),
+		reader: response.NewReader(nc),
+	}, nil
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c *Client) maxIdle() int {
+	if c.MaxIdleConnsPerHost == 0 {
+		return DefaultMaxIdleConns
+	}
+	return c.MaxIdleConnsPerHost
+}
+
+// getConn takes the most recently used idle connection for key, or dials a
+// new one. reused reports which.
+func (c *Client) getConn(key string, u *url.URL, deadline time.Time) (*conn, bool, error) {
+	c.mu.Lock()
+	for conns := c.idle[key]; len(conns) > 0; conns = c.idle[key] {
+		cn := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if time.Since(cn.idleSince) > c.idleTimeout() {
+			cn.Close()
+			continue
+		}
+		c.mu.Unlock()
+		return cn, true, nil
+	}
+	c.mu.Unlock()
+
+	cn, err := c.dial(u, deadline)
+	return cn, false, err
+}
+
+func (c *Client) putConn(key string, cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = map[string][]*conn{}
+	}
+	if len(c.idle[key]) >= c.maxIdle() {
+		cn.Close()
+		return
+	}
+	cn.SetDeadline(time.Time{})
+	cn.idleSince = time.Now()
+	c.idle[key] = append(c.idle[key], cn)
+}
+
+// CloseIdleConnections closes every pooled connection. Connections in use
+// are not affected.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, cn := range conns {
+			cn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+// maxDrain is how much of an unread body Close reads to save the
+// connection before giving up and closing it.
+const maxDrain = 4096
+
+// body hands its connection back to the pool once the response has been
+// read to the end, or closes it.
+type body struct {
+	io.ReadCloser
+	client    *Client
+	key       string
+	conn      *conn
+	keepAlive bool
+	done      bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release(true)
+	} else if err != nil {
+		b.release(false)
+	}
+	return n, err
+}
+
+func (b *body) release(complete bool) {
+	if b.done {
+		return
+	}
+	b.done = true
+	b.ReadCloser.Close()
+	if complete && b.keepAlive && b.client.maxIdle() > 0 {
+		b.client.putConn(b.key, b.conn)
+		return
+	}
+	b.conn.Close()
+}
+
+func (b *body) Close() error {
+	if b.done {
+		return nil
+	}
+	if _, err := io.CopyN(io.Discard, b, maxDrain); err == nil {
+		b.release(false)
+	}
+	return nil
+}
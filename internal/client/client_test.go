@@ -0,0 +1,342 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return "http://" + s.Addr().String()
+}
+
+func writeText(w *response.Writer, status response.StatusCode, body string) {
+	h := response.GetDefaultHeaders(len(body))
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+func redirectTo(w *response.Writer, status response.StatusCode, location string) {
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", location)
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+}
+
+func readBody(t *testing.T, resp *response.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+// keepAliveServer answers every request on a connection with its target
+// until the client hangs up, counting the connections it accepts. With
+// closeAfterOne it drops each connection after one response without saying
+// so, like a server whose idle timeout has just fired.
+func keepAliveServer(t *testing.T, l net.Listener, closeAfterOne bool) *atomic.Int32 {
+	conns := &atomic.Int32{}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := request.NewReader(conn)
+				for {
+					req, err := reader.ReadRequest()
+					if err != nil {
+						return
+					}
+					target := req.RequestLine.RequestTarget
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(target)) + "\r\n\r\n" + target))
+					if closeAfterOne {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return conns
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return l
+}
+
+func TestGet(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/chunked":
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Done")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(*h)
+			w.WriteChunkedBody([]byte("hello, "))
+			w.WriteChunkedBody([]byte("world"))
+			trailer := headers.NewHeaders()
+			trailer.Set("X-Done", "yes")
+			w.WriteTrailers(*trailer)
+		case "/echo":
+			writeText(w, response.StatusOK, req.RequestLine.Method+" "+req.Body)
+		default:
+			writeText(w, response.StatusNotFound, "nothing here")
+		}
+	})
+	c := &Client{}
+
+	// Test: Content-Length body and status
+	resp, err := c.Get(url + "/missing")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", resp.StatusLine.ReasonPhrase)
+	assert.Equal(t, "nothing here", readBody(t, resp))
+
+	// Test: Chunked body
+	resp, err = c.Get(url + "/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", readBody(t, resp))
+
+	// Test: Request body is sent with its length
+	resp, err = c.Post(url+"/echo", "text/plain", strings.NewReader("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST ping", readBody(t, resp))
+
+	// Test: HEAD has no body even with a Content-Length
+	resp, err = c.Head(url + "/missing")
+	require.NoError(t, err)
+	assert.Equal(t, "12", headerValue(resp.Headers, "Content-Length"))
+	assert.Equal(t, "", readBody(t, resp))
+
+	// Test: Unsupported scheme
+	_, err = c.Get("ftp://localhost/file")
+	require.ErrorIs(t, err, ErrUnsupportedScheme)
+}
+
+func headerValue(h *headers.Headers, name string) string {
+	v, _ := h.Get(name)
+	return v
+}
+
+func TestCloseDelimited(t *testing.T) {
+	l := listen(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		request.NewReader(conn).ReadRequest()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end"))
+		conn.Close()
+	}()
+
+	// Test: Body without framing runs until the connection closes
+	resp, err := (&Client{}).Get("http://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", readBody(t, resp))
+}
+
+func TestKeepAlive(t *testing.T) {
+	l := listen(t)
+	conns := keepAliveServer(t, l, false)
+	url := "http://" + l.Addr().String()
+	c := &Client{}
+
+	// Test: Sequential requests share one connection
+	for _, path := range []string{"/one", "/two", "/three"} {
+		resp, err := c.Get(url + path)
+		require.NoError(t, err)
+		assert.Equal(t, path, readBody(t, resp))
+	}
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: Pooling can be turned off
+	c = &Client{MaxIdleConnsPerHost: -1}
+	for _, path := range []string{"/one", "/two"} {
+		resp, err := c.Get(url + path)
+		require.NoError(t, err)
+		assert.Equal(t, path, readBody(t, resp))
+	}
+	assert.Equal(t, int32(3), conns.Load())
+
+	// Test: A pooled connection closed by the server is replaced
+	l = listen(t)
+	conns = keepAliveServer(t, l, true)
+	url = "http://" + l.Addr().String()
+	c = &Client{}
+	for _, path := range []string{"/one", "/two"} {
+		resp, err := c.Get(url + path)
+		require.NoError(t, err)
+		assert.Equal(t, path, readBody(t, resp))
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestRedirects(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/old":
+			redirectTo(w, response.StatusFound, "/new")
+		case "/form":
+			redirectTo(w, response.StatusSeeOther, "/new")
+		case "/keep":
+			redirectTo(w, response.StatusTemporaryRedirect, "/new")
+		case "/loop":
+			redirectTo(w, response.StatusFound, "/loop")
+		default:
+			writeText(w, response.StatusOK, req.RequestLine.Method+" "+req.RequestLine.RequestTarget+" "+req.Body)
+		}
+	})
+	c := &Client{}
+
+	// Test: Redirect is followed
+	resp, err := c.Get(url + "/old")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /new ", readBody(t, resp))
+
+	// Test: 303 turns a POST into a GET without a body
+	resp, err = c.Post(url+"/form", "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	assert.Equal(t, "GET /new ", readBody(t, resp))
+
+	// Test: 307 repeats the method and body
+	resp, err = c.Post(url+"/keep", "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST /new data", readBody(t, resp))
+
+	// Test: 302 repeats the body of a method other than POST, and leaves
+	// the redirect to the caller when that body cannot be sent again
+	req, err := NewRequest("GET", url+"/old", strings.NewReader("data"))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /new data", readBody(t, resp))
+	req, err = NewRequest("GET", url+"/old", io.MultiReader(strings.NewReader("data")))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+	resp.Body.Close()
+
+	// Test: Redirect loop
+	_, err = c.Get(url + "/loop")
+	require.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: Redirects can be left to the caller
+	resp, err = (&Client{MaxRedirects: -1}).Get(url + "/old")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+	assert.Equal(t, "/new", headerValue(resp.Headers, "Location"))
+	resp.Body.Close()
+}
+
+func TestTimeout(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(300 * time.Millisecond)
+		writeText(w, response.StatusOK, "late")
+	})
+
+	// Test: Slow response runs into the deadline
+	_, err := (&Client{Timeout: 50 * time.Millisecond}).Get(url + "/")
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+
+	// Test: The head timeout applies to a slow head
+	_, err = (&Client{ResponseHeaderTimeout: 50 * time.Millisecond}).Get(url + "/")
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+
+	// Test: A body slower than the head timeout is still read to the end
+	url = startServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		for i := 0; i < 3; i++ {
+			w.WriteBody([]byte("tick"))
+			w.Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	})
+	resp, err := (&Client{ResponseHeaderTimeout: 50 * time.Millisecond}).Get(url + "/")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("tick", 3), readBody(t, resp))
+}
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	conns := keepAliveServer(t, l, false)
+	url := "https://" + l.Addr().String()
+
+	// Test: Untrusted certificate is rejected
+	_, err = (&Client{}).Get(url + "/secure")
+	require.Error(t, err)
+
+	// Test: Trusted certificate, pooled across requests
+	c := &Client{TLSConfig: &tls.Config{RootCAs: pool}}
+	for _, path := range []string{"/secure", "/again"} {
+		resp, err := c.Get(url + path)
+		require.NoError(t, err)
+		assert.Equal(t, path, readBody(t, resp))
+	}
+	assert.Equal(t, int32(2), conns.Load())
+}
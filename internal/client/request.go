@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"tcp_http/internal/headers"
+)
+
+var ErrUnsupportedScheme = fmt.Errorf("unsupported url scheme")
+
+const userAgent = "tcp_http-client/1.0"
+
+// Request is an outgoing request.
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers *headers.Headers
+	Body    io.Reader
+	// ContentLength is the length of Body. -1 means unknown, in which case
+	// the body is sent chunked.
+	ContentLength int64
+	// GetBody returns a fresh copy of Body so the request can be sent again
+	// after a redirect or on a new connection. NewRequest sets it for
+	// in-memory bodies; without it such requests are not replayed.
+	GetBody func() (io.Reader, error)
+}
+
+// NewRequest builds a request for an http or https URL. Bodies that are
+// *bytes.Buffer, *bytes.Reader or *strings.Reader get a Content-Length and
+// can be replayed; any other body is streamed chunked.
+func NewRequest(method, rawURL string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrUnsupportedScheme
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in url %q", rawURL)
+	}
+	req := &Request{
+		Method:  strings.ToUpper(method),
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+
+	var buf []byte
+	switch b := body.(type) {
+	case nil:
+		return req, nil
+	case *bytes.Buffer:
+		buf = b.Bytes()
+	case *bytes.Reader:
+		buf = make([]byte, b.Len())
+		b.ReadAt(buf, b.Size()-int64(b.Len()))
+	case *strings.Reader:
+		buf = make([]byte, b.Len())
+		b.ReadAt(buf, b.Size()-int64(b.Len()))
+	default:
+		req.ContentLength = -1
+		return req, nil
+	}
+	req.ContentLength = int64(len(buf))
+	req.GetBody = func() (io.Reader, error) {
+		return bytes.NewReader(buf), nil
+	}
+	return req, nil
+}
+
+func (r *Request) replayable() bool {
+	return r.Body == nil || r.GetBody != nil
+}
+
+// rewind swaps Body for a fresh copy before the request is sent again.
+func (r *Request) rewind() error {
+	if r.GetBody == nil {
+		return nil
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
+func (r *Request) write(w *bufio.Writer) error {
+	target := r.URL.RequestURI()
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", r.Method, target)
+
+	if _, ok := r.Headers.Get("Host"); !ok {
+		fmt.Fprintf(w, "Host: %s\r\n", r.URL.Host)
+	}
+	if _, ok := r.Headers.Get("User-Agent"); !ok {
+		fmt.Fprintf(w, "User-Agent: %s\r\n", userAgent)
+	}
+	r.Headers.ForEach(func(n, v string) {
+		switch n {
+		case "content-length", "transfer-encoding":
+			return
+		}
+		fmt.Fprintf(w, "%s: %s\r\n", n, v)
+	})
+
+	chunked := r.Body != nil && r.ContentLength < 0
+	if chunked {
+		w.WriteString("Transfer-Encoding: chunked\r\n")
+	} else if r.Body != nil || r.Method == "POST" {
+		fmt.Fprintf(w, "Content-Length: %s\r\n", strconv.FormatInt(r.ContentLength, 10))
+	}
+	w.WriteString("\r\n")
+
+	if r.Body != nil {
+		var err error
+		if chunked {
+			err = writeChunked(w, r.Body)
+		} else {
+			_, err = io.CopyN(flushWriter{w}, r.Body, r.ContentLength)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// flushWriter flushes after every write, so a streamed body goes out as it
+// is read instead of once the buffer fills.
+type flushWriter struct {
+	w *bufio.Writer
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
+
+func writeChunked(w *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+			if ferr := w.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.WriteString("0\r\n\r\n")
+	return err
+}
@@ -0,0 +1,271 @@
+package compression
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/negotiate"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// DefaultMinSize is the smallest body, in bytes, worth compressing when its
+// length is known up front.
+const DefaultMinSize = 1024
+
+// Codec returns a writer that compresses into dst for one content-coding.
+type Codec func(dst io.Writer) io.WriteCloser
+
+// Registry holds the content-codings the server can produce, in order of
+// preference. The zero value is empty; DefaultRegistry has gzip and deflate.
+type Registry struct {
+	names  []string
+	codecs map[string]Codec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{codecs: map[string]Codec{}}
+}
+
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("gzip", func(dst io.Writer) io.WriteCloser {
+		return gzip.NewWriter(dst)
+	})
+	// "deflate" in HTTP is the zlib format (RFC 9110 section 8.4.1.2).
+	r.Register("deflate", func(dst io.Writer) io.WriteCloser {
+		return zlib.NewWriter(dst)
+	})
+	return r
+}
+
+// Register adds a content-coding. Codings registered earlier are preferred
+// when a client accepts several with the same weight. Registering a name
+// again replaces its codec but keeps its position.
+func (r *Registry) Register(name string, codec Codec) {
+	name = strings.ToLower(name)
+	if _, exists := r.codecs[name]; !exists {
+		r.names = append(r.names, name)
+	}
+	r.codecs[name] = codec
+}
+
+func (r *Registry) Lookup(name string) (Codec, bool) {
+	codec, ok := r.codecs[strings.ToLower(name)]
+	return codec, ok
+}
+
+// Negotiate picks the registered coding with the highest q-value in an
+// Accept-Encoding header. It returns "" when the body should be sent as is,
+// and negotiate.ErrNotAcceptable when the header rules out every
+// registered coding and identity too, e.g. "identity;q=0" or "*;q=0"
+// (RFC 9110 section 12.5.3).
+func (r *Registry) Negotiate(acceptEncoding string) (string, error) {
+	weights := map[string]float64{}
+	for _, coding := range negotiate.Parse(acceptEncoding) {
+		name := coding.Value
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		weights[name] = coding.Q
+	}
+	best, bestQ := "", 0.0
+	for _, name := range r.names {
+		q, ok := weights[name]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+	q, ok := weights["identity"]
+	if !ok {
+		q, ok = weights["*"]
+	}
+	if ok && q == 0 {
+		return "", negotiate.ErrNotAcceptable
+	}
+	return "", nil
+}
+
+// incompressibleTypes are media types whose payload is already compressed.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/pdf",
+	"application/octet-stream",
+	"multipart/byteranges",
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+type Options struct {
+	// Registry lists the codings on offer. Nil uses DefaultRegistry.
+	Registry *Registry
+	// MinSize skips bodies whose Content-Length is below it. Zero uses
+	// DefaultMinSize.
+	MinSize int
+}
+
+type compressor struct {
+	registry *Registry
+	minSize  int
+}
+
+// Middleware compresses responses with the best coding the client accepts.
+// Bodies that are already encoded, of an already compressed media type, or
+// known to be tiny are passed through untouched. A compressed response
+// loses its Content-Length and is sent chunked to HTTP/1.1 clients. A
+// client that refuses every coding on offer, identity included, gets 406
+// in place of a response that would have been compressed; one that would
+// not have been is sent as it is.
+func Middleware(options Options) server.Middleware {
+	c := &compressor{
+		registry: options.Registry,
+		minSize:  options.MinSize,
+	}
+	if c.registry == nil {
+		c.registry = DefaultRegistry()
+	}
+	if c.minSize == 0 {
+		c.minSize = DefaultMinSize
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+			coding, err := c.registry.Negotiate(acceptEncoding)
+			w.AddHeaderHook(c.hook(w, req, coding, err != nil))
+			next(w, req)
+		}
+	}
+}
+
+// hasBody reports whether a response with this status has a body, or for
+// HEAD would have one.
+func hasBody(status response.StatusCode) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+// hook compresses the response with coding, the one negotiated for req, or
+// leaves it alone when coding is "". When notAcceptable is set, a response
+// that should be compressed is replaced with a 406.
+func (c *compressor) hook(w *response.Writer, req *request.Request, coding string, notAcceptable bool) response.HeaderHook {
+	return func(status response.StatusCode, h *headers.Headers) response.Encoder {
+		if !hasBody(status) || status == response.StatusPartialContent {
+			return nil
+		}
+		if _, ok := h.Get("Content-Encoding"); ok {
+			return nil
+		}
+		if _, ok := h.Get("Content-Range"); ok {
+			return nil
+		}
+		if ctype, _ := h.Get("Content-Type"); !compressible(ctype) {
+			return nil
+		}
+		// From here on the body depends on Accept-Encoding, whether or not
+		// this particular client gets it compressed.
+		response.AddVary(h, "Accept-Encoding")
+		if length, ok := h.Get("Content-Length"); ok {
+			if n, err := strconv.Atoi(length); err == nil && n < c.minSize {
+				return nil
+			}
+		}
+
+		if notAcceptable {
+			// A HEAD response has no body to encode, so identity will do.
+			if req.RequestLine.Method == "HEAD" {
+				return nil
+			}
+			return c.notAcceptable(w, h)
+		}
+		if coding == "" {
+			return nil
+		}
+		codec, _ := c.registry.Lookup(coding)
+
+		h.Delete("Content-Length")
+		h.Replace("Content-Encoding", coding)
+		// The compressed bytes are a different representation, so a strong
+		// validator of the original no longer applies byte for byte.
+		if etag, ok := h.Get("ETag"); ok && !strings.HasPrefix(etag, "W/") {
+			h.Replace("ETag", "W/"+etag)
+		}
+		// A HEAD response carries the fields the GET would, but has no body
+		// to encode. It is not marked chunked either, since the writer
+		// would then end it with a last chunk.
+		if req.RequestLine.Method == "HEAD" {
+			return nil
+		}
+		if te, _ := h.Get("Transfer-Encoding"); req.RequestLine.HttpVersion == "1.1" && !strings.Contains(strings.ToLower(te), "chunked") {
+			h.Replace("Transfer-Encoding", "chunked")
+		}
+		return response.Encoder(codec)
+	}
+}
+
+// notAcceptable turns the response about to be written into a 406 that
+// lists the codings on offer. The handler's body is discarded as it is
+// written, and the message takes its place.
+func (c *compressor) notAcceptable(w *response.Writer, h *headers.Headers) response.Encoder {
+	he := negotiate.NotAcceptable("Accept-Encoding", c.registry.names...)
+	message := []byte(he.Message + "\n")
+	w.SetStatus(he.StatusCode)
+	*h = *response.GetDefaultHeaders(len(message))
+	he.Headers.ForEach(func(n, v string) {
+		h.Replace(n, v)
+	})
+	return func(dst io.Writer) io.WriteCloser {
+		return &replacement{dst: dst, body: message}
+	}
+}
+
+// replacement swallows the body written through it and sends body instead
+// when it is closed.
+type replacement struct {
+	dst  io.Writer
+	body []byte
+}
+
+func (r *replacement) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (r *replacement) Close() error {
+	_, err := r.dst.Write(r.body)
+	return err
+}
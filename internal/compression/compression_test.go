@@ -0,0 +1,279 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/negotiate"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+var page = strings.Repeat("<p>Your request was an absolute banger.</p>\n", 100)
+
+func serve(t *testing.T, handler server.Handler, acceptEncoding string) (string, string) {
+	raw := "GET / HTTP/1.1\r\nHost: localhost:42069\r\n"
+	if acceptEncoding != "" {
+		raw += "Accept-Encoding: " + acceptEncoding + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	server.Chain(handler, Middleware(Options{}))(w, req)
+	require.NoError(t, w.Finish())
+	head, body, _ := strings.Cut(out.String(), "\r\n\r\n")
+	return head, body
+}
+
+func headerValue(head, name string) string {
+	for _, line := range strings.Split(head, "\r\n") {
+		n, v, ok := strings.Cut(line, ": ")
+		if ok && strings.EqualFold(n, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// dechunk decodes a chunked body and returns it with its trailer section.
+func dechunk(t *testing.T, body string) (string, string) {
+	r := bufio.NewReader(strings.NewReader(body))
+	out := []byte{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		var size int
+		_, err = fmt.Sscanf(strings.TrimSpace(line), "%x", &size)
+		require.NoError(t, err)
+		if size == 0 {
+			rest, _ := io.ReadAll(r)
+			return string(out), string(rest)
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(t, err)
+		out = append(out, chunk[:size]...)
+	}
+}
+
+func htmlHandler(body string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.Replace("Content-Type", "text/html")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func negotiated(t *testing.T, r *Registry, acceptEncoding string) string {
+	coding, err := r.Negotiate(acceptEncoding)
+	require.NoError(t, err)
+	return coding
+}
+
+func TestNegotiate(t *testing.T) {
+	r := DefaultRegistry()
+	assert.Equal(t, "gzip", negotiated(t, r, "gzip, deflate"))
+	assert.Equal(t, "deflate", negotiated(t, r, "gzip;q=0.5, deflate"))
+	assert.Equal(t, "gzip", negotiated(t, r, "*"))
+	assert.Equal(t, "deflate", negotiated(t, r, "*;q=0.1, gzip;q=0"))
+	assert.Equal(t, "", negotiated(t, r, "br, identity"))
+	assert.Equal(t, "", negotiated(t, r, ""))
+	assert.Equal(t, "gzip", negotiated(t, r, "x-gzip"))
+	assert.Equal(t, "deflate", negotiated(t, r, "gzip;q=abc, deflate;q=0.2"))
+	assert.Equal(t, "", negotiated(t, r, "br, identity;q=0.5, *;q=0"))
+
+	// Test: Refusing identity and every registered coding is not acceptable
+	for _, value := range []string{"br, identity;q=0", "*;q=0", "gzip;q=0, deflate;q=0, identity;q=0"} {
+		_, err := r.Negotiate(value)
+		assert.ErrorIs(t, err, negotiate.ErrNotAcceptable, value)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	// Test: Content-Length response becomes chunked gzip
+	head, body := serve(t, htmlHandler(page), "gzip, deflate")
+	assert.Equal(t, "gzip", headerValue(head, "Content-Encoding"))
+	assert.Equal(t, "chunked", headerValue(head, "Transfer-Encoding"))
+	assert.Equal(t, "Accept-Encoding", headerValue(head, "Vary"))
+	assert.Equal(t, "", headerValue(head, "Content-Length"))
+	compressed, _ := dechunk(t, body)
+	assert.Less(t, len(compressed), len(page))
+	gz, err := gzip.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(plain))
+
+	// Test: Deflate
+	head, body = serve(t, htmlHandler(page), "deflate")
+	assert.Equal(t, "deflate", headerValue(head, "Content-Encoding"))
+	compressed, _ = dechunk(t, body)
+	zr, err := zlib.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	plain, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(plain))
+
+	// Test: Client without Accept-Encoding still gets Vary
+	head, body = serve(t, htmlHandler(page), "")
+	assert.Equal(t, "", headerValue(head, "Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", headerValue(head, "Vary"))
+	assert.Equal(t, page, body)
+
+	// Test: A client that refuses identity and every coding gets 406
+	head, body = serve(t, htmlHandler(page), "br, identity;q=0")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 406 Not Acceptable"), head)
+	assert.Equal(t, "Not Acceptable; available: gzip, deflate\n", body)
+	assert.Equal(t, fmt.Sprint(len(body)), headerValue(head, "Content-Length"))
+	assert.Equal(t, "Accept-Encoding", headerValue(head, "Vary"))
+
+	// Test: The 406 also replaces a chunked response
+	head, body = serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(page))
+		w.WriteChunkedBodyDone()
+	}, "*;q=0")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 406 Not Acceptable"), head)
+	assert.Equal(t, "", headerValue(head, "Transfer-Encoding"))
+	assert.Equal(t, "Not Acceptable; available: gzip, deflate\n", body)
+
+	// Test: A response that would not be compressed is sent as it is, even
+	// to a client that refuses identity
+	head, body = serve(t, htmlHandler("<p>hi</p>"), "br, identity;q=0")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"), head)
+	assert.Equal(t, "<p>hi</p>", body)
+	head, _ = serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(*h)
+	}, "br, identity;q=0")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 304 Not Modified"), head)
+	head, body = serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(page))
+		h.Replace("Content-Type", "image/png")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(page))
+	}, "*;q=0")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"), head)
+	assert.Equal(t, page, body)
+
+	// Test: Tiny body is not compressed
+	head, body = serve(t, htmlHandler("<p>hi</p>"), "gzip")
+	assert.Equal(t, "", headerValue(head, "Content-Encoding"))
+	assert.Equal(t, "<p>hi</p>", body)
+
+	// Test: Already compressed media type is skipped
+	head, _ = serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(page))
+		h.Replace("Content-Type", "video/mp4")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(page))
+	}, "gzip")
+	assert.Equal(t, "", headerValue(head, "Content-Encoding"))
+	assert.Equal(t, "", headerValue(head, "Vary"))
+
+	// Test: HEAD gets the encoding fields GET would, and no body
+	req, err := request.RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost:42069\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	server.Chain(func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(page))
+		h.Replace("Content-Type", "text/html")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+	}, Middleware(Options{}))(w, req)
+	require.NoError(t, w.Finish())
+	head, body, _ = strings.Cut(out.String(), "\r\n\r\n")
+	assert.Equal(t, "gzip", headerValue(head, "Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", headerValue(head, "Vary"))
+	assert.Equal(t, "", headerValue(head, "Content-Length"))
+	assert.Equal(t, "", headerValue(head, "Transfer-Encoding"))
+	assert.Equal(t, "", body)
+
+	// Test: HEAD is answered as it is when identity is refused
+	req, err = request.RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost:42069\r\nAccept-Encoding: *;q=0\r\n\r\n"))
+	require.NoError(t, err)
+	out = &bytes.Buffer{}
+	w = response.NewWriter(out)
+	server.Chain(htmlHandler(page), Middleware(Options{}))(w, req)
+	require.NoError(t, w.Finish())
+	head, _, _ = strings.Cut(out.String(), "\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"), head)
+	assert.Equal(t, fmt.Sprint(len(page)), headerValue(head, "Content-Length"))
+}
+
+func TestChunkedWithTrailers(t *testing.T) {
+	// Test: Chunked handler output is compressed and keeps its trailers
+	head, body := serve(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Done")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		for i := 0; i < 10; i++ {
+			w.WriteChunkedBody([]byte(page[:100]))
+		}
+		trailer := headers.NewHeaders()
+		trailer.Set("X-Done", "yes")
+		w.WriteTrailers(*trailer)
+	}, "gzip")
+	assert.Equal(t, "gzip", headerValue(head, "Content-Encoding"))
+	compressed, trailers := dechunk(t, body)
+	assert.Equal(t, "x-done: yes\r\n\r\n", trailers)
+	gz, err := gzip.NewReader(strings.NewReader(compressed))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat(page[:100], 10), string(plain))
+}
+
+func TestCustomCodec(t *testing.T) {
+	// Test: A registered codec is used when the client prefers it
+	r := DefaultRegistry()
+	r.Register("upper", func(dst io.Writer) io.WriteCloser {
+		return upperWriter{dst}
+	})
+	assert.Equal(t, "upper", negotiated(t, r, "gzip;q=0.5, upper"))
+	codec, ok := r.Lookup("UPPER")
+	require.True(t, ok)
+	out := &bytes.Buffer{}
+	w := codec(out)
+	w.Write([]byte("abc"))
+	w.Close()
+	assert.Equal(t, "ABC", out.String())
+}
+
+type upperWriter struct {
+	io.Writer
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.Writer.Write(bytes.ToUpper(p))
+}
+
+func (u upperWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package conditional
+
+import (
+	"strings"
+	"time"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// Validators describe the current state of the selected representation.
+type Validators struct {
+	// ETag is the entity tag, e.g. `"abc"` or `W/"abc"`, or "" when there
+	// is none.
+	ETag string
+	// LastModified is left zero when it is not known.
+	LastModified time.Time
+	// Missing is set when the resource does not exist yet, e.g. for a request
+	// that would create it.
+	Missing bool
+}
+
+// Result is the outcome of evaluating a request's preconditions.
+type Result int
+
+const (
+	// Proceed means the request is handled as if it had no preconditions.
+	Proceed Result = iota
+	NotModified
+	PreconditionFailed
+)
+
+// isWeak reports whether tag is a weak entity tag.
+func isWeak(tag string) bool {
+	return strings.HasPrefix(tag, "W/")
+}
+
+// StrongMatch compares two entity tags: both must be strong and equal.
+func StrongMatch(a, b string) bool {
+	return a != "" && !isWeak(a) && !isWeak(b) && a == b
+}
+
+// WeakMatch compares two entity tags with any W/ prefixes ignored.
+func WeakMatch(a, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// parseETags splits an If-Match or If-None-Match list into entity tags.
+// Entity tags may contain commas, so the list is split at quotes.
+func parseETags(list string) []string {
+	tags := []string{}
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return tags
+		}
+		if list[0] == '*' {
+			tags = append(tags, "*")
+			list = list[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = 2
+		}
+		if len(list) <= start || list[start] != '"' {
+			// Not an entity tag; skip to the next item.
+			_, list, _ = strings.Cut(list, ",")
+			continue
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+}
+
+// matches reports whether an If-Match or If-None-Match list names the
+// representation. "*" matches any current representation.
+func matches(list string, v Validators, match func(a, b string) bool) bool {
+	if v.Missing {
+		return false
+	}
+	for _, tag := range parseETags(list) {
+		if tag == "*" || match(v.ETag, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDate parses an HTTP date, accepting the obsolete formats as
+// recipients must (RFC 9110 section 5.6.7).
+func parseDate(value string) (time.Time, bool) {
+	for _, layout := range []string{response.TimeFormat, "Monday, 02-Jan-06 15:04:05 MST", time.ANSIC} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// dateField returns a date precondition, unless it does not parse or there
+// is no modification date to compare it with, in which case it is ignored.
+func dateField(req *request.Request, name string, v Validators) (time.Time, bool) {
+	value, ok := req.Headers.Get(name)
+	if !ok || v.LastModified.IsZero() || v.Missing {
+		return time.Time{}, false
+	}
+	return parseDate(value)
+}
+
+// Evaluate checks the request's preconditions in the order RFC 9110
+// section 13.2.2 gives: If-Match, If-Unmodified-Since, If-None-Match and
+// If-Modified-Since. It is meant for requests whose response would
+// otherwise be a 2xx. If-Range is left to IfRange.
+func Evaluate(req *request.Request, v Validators) Result {
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+	// Dates on the wire only have second precision.
+	lastModified := v.LastModified.Truncate(time.Second)
+
+	if ifMatch, ok := req.Headers.Get("If-Match"); ok {
+		if !matches(ifMatch, v, StrongMatch) {
+			return PreconditionFailed
+		}
+	} else if date, ok := dateField(req, "If-Unmodified-Since", v); ok && lastModified.After(date) {
+		return PreconditionFailed
+	}
+
+	if ifNoneMatch, ok := req.Headers.Get("If-None-Match"); ok {
+		if matches(ifNoneMatch, v, WeakMatch) {
+			if safe {
+				return NotModified
+			}
+			return PreconditionFailed
+		}
+	} else if date, ok := dateField(req, "If-Modified-Since", v); ok && safe && !lastModified.After(date) {
+		return NotModified
+	}
+	return Proceed
+}
+
+// IfRange reports whether the Range of a request may be honored. If-Range
+// holds an entity tag, compared strongly, or a date that must equal the
+// modification date exactly; without it the range is always honored.
+func IfRange(req *request.Request, v Validators) bool {
+	ifRange, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || isWeak(ifRange) {
+		return StrongMatch(v.ETag, ifRange)
+	}
+	date, ok := parseDate(ifRange)
+	return ok && !v.LastModified.IsZero() && v.LastModified.Truncate(time.Second).Equal(date)
+}
+
+// Check evaluates the request's preconditions and, when they call for a
+// 304 or 412, writes it and returns true. h holds the fields the 2xx
+// response would have had; the 304 keeps them apart from those that
+// describe the body.
+func Check(w *response.Writer, req *request.Request, v Validators, h *headers.Headers) bool {
+	switch Evaluate(req, v) {
+	case NotModified:
+		out := headers.NewHeaders()
+		h.ForEach(func(n, value string) {
+			switch n {
+			case "content-length", "content-type", "transfer-encoding":
+				return
+			}
+			out.Add(n, value)
+		})
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(*out)
+		return true
+	case PreconditionFailed:
+		(&server.HandlerError{StatusCode: response.StatusPreconditionFailed, Message: "Precondition Failed"}).Write(w)
+		return true
+	}
+	return false
+}
+
+// FromHeaders returns the validators a response's ETag and Last-Modified
+// fields describe.
+func FromHeaders(h *headers.Headers) Validators {
+	v := Validators{}
+	v.ETag, _ = h.Get("ETag")
+	if lm, ok := h.Get("Last-Modified"); ok {
+		v.LastModified, _ = parseDate(lm)
+	}
+	return v
+}
@@ -0,0 +1,177 @@
+package conditional
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+func newRequest(t *testing.T, method string, fields ...string) *request.Request {
+	raw := method + " /doc HTTP/1.1\r\nHost: localhost\r\n"
+	for _, f := range fields {
+		raw += f + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestEvaluate(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	v := Validators{ETag: `"v2"`, LastModified: modified}
+	before := modified.Add(-time.Hour).Format(response.TimeFormat)
+	at := modified.Format(response.TimeFormat)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		fields []string
+		want   Result
+	}{
+		{"no preconditions", "GET", nil, Proceed},
+		{"If-Match strong", "POST", []string{`If-Match: "v1", "v2"`}, Proceed},
+		{"If-Match weak never matches", "POST", []string{`If-Match: W/"v2"`}, PreconditionFailed},
+		{"If-Match star", "POST", []string{"If-Match: *"}, Proceed},
+		{"If-Match mismatch", "GET", []string{`If-Match: "v1"`}, PreconditionFailed},
+		{"If-Unmodified-Since passes", "POST", []string{"If-Unmodified-Since: " + at}, Proceed},
+		{"If-Unmodified-Since fails", "POST", []string{"If-Unmodified-Since: " + before}, PreconditionFailed},
+		{"If-Match wins over If-Unmodified-Since", "POST", []string{`If-Match: "v2"`, "If-Unmodified-Since: " + before}, Proceed},
+		{"If-None-Match weak match on GET", "GET", []string{`If-None-Match: W/"v2"`}, NotModified},
+		{"If-None-Match match on POST", "POST", []string{`If-None-Match: "v2"`}, PreconditionFailed},
+		{"If-None-Match mismatch", "GET", []string{`If-None-Match: "v1"`}, Proceed},
+		{"If-None-Match tag with comma", "HEAD", []string{`If-None-Match: "a,b", "v2"`}, NotModified},
+		{"If-Modified-Since not modified", "GET", []string{"If-Modified-Since: " + at}, NotModified},
+		{"If-Modified-Since modified", "GET", []string{"If-Modified-Since: " + before}, Proceed},
+		{"If-Modified-Since obsolete date", "GET", []string{"If-Modified-Since: " + modified.Format(time.ANSIC)}, NotModified},
+		{"If-Modified-Since ignored on POST", "POST", []string{"If-Modified-Since: " + at}, Proceed},
+		{"If-None-Match wins over If-Modified-Since", "GET", []string{`If-None-Match: "v1"`, "If-Modified-Since: " + at}, Proceed},
+		{"If-Match checked before If-None-Match", "GET", []string{`If-Match: "v1"`, `If-None-Match: "v2"`}, PreconditionFailed},
+		{"Invalid date ignored", "POST", []string{"If-Unmodified-Since: yesterday"}, Proceed},
+	} {
+		assert.Equal(t, tc.want, Evaluate(newRequest(t, tc.method, tc.fields...), v), tc.name)
+	}
+
+	// Test: A missing resource fails If-Match * and passes If-None-Match *
+	missing := Validators{Missing: true}
+	assert.Equal(t, PreconditionFailed, Evaluate(newRequest(t, "POST", "If-Match: *"), missing))
+	assert.Equal(t, Proceed, Evaluate(newRequest(t, "POST", "If-None-Match: *"), missing))
+	assert.Equal(t, PreconditionFailed, Evaluate(newRequest(t, "POST", "If-None-Match: *"), v))
+}
+
+func TestIfRange(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := Validators{ETag: `"v2"`, LastModified: modified}
+
+	// Test: Entity tags are compared strongly and dates exactly
+	assert.True(t, IfRange(newRequest(t, "GET"), v))
+	assert.True(t, IfRange(newRequest(t, "GET", `If-Range: "v2"`), v))
+	assert.False(t, IfRange(newRequest(t, "GET", `If-Range: W/"v2"`), v))
+	assert.False(t, IfRange(newRequest(t, "GET", `If-Range: "v1"`), v))
+	assert.True(t, IfRange(newRequest(t, "GET", "If-Range: "+modified.Format(response.TimeFormat)), v))
+	assert.False(t, IfRange(newRequest(t, "GET", "If-Range: "+modified.Add(-time.Second).Format(response.TimeFormat)), v))
+}
+
+// page answers with a fixed body and the given header lines.
+func page(body string, extra ...string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		for _, line := range extra {
+			name, value, _ := strings.Cut(line, ": ")
+			h.Set(name, value)
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func do(t *testing.T, handler server.Handler, req *request.Request) (*response.Response, string) {
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.NewReader(out).ReadResponse(req.RequestLine.Method)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := server.Chain(page("hello world", "Set-Cookie: a=1", "Set-Cookie: b=2"), Middleware(Options{}))
+
+	// Test: A 200 gets an ETag computed from its body
+	resp, body := do(t, handler, newRequest(t, "GET"))
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "hello world", body)
+	etag, ok := resp.Headers.Get("ETag")
+	require.True(t, ok)
+	assert.Equal(t, ETag([]byte("hello world"), false), etag)
+	assert.Len(t, resp.Headers.Values("Set-Cookie"), 2)
+
+	// Test: HEAD gets the same ETag and no body
+	resp, body = do(t, handler, newRequest(t, "HEAD"))
+	headETag, _ := resp.Headers.Get("ETag")
+	assert.Equal(t, etag, headETag)
+	length, _ := resp.Headers.Get("Content-Length")
+	assert.Equal(t, "11", length)
+	assert.Equal(t, "", body)
+
+	// Test: A matching GET becomes a 304 without a body
+	resp, body = do(t, handler, newRequest(t, "GET", "If-None-Match: "+etag))
+	assert.Equal(t, response.StatusNotModified, resp.StatusLine.StatusCode)
+	assert.Equal(t, "", body)
+	_, ok = resp.Headers.Get("Content-Length")
+	assert.False(t, ok)
+	got, _ := resp.Headers.Get("ETag")
+	assert.Equal(t, etag, got)
+
+	// Test: A stale If-Match fails
+	resp, _ = do(t, handler, newRequest(t, "GET", `If-Match: "stale"`))
+	assert.Equal(t, response.StatusPreconditionFailed, resp.StatusLine.StatusCode)
+
+	// Test: An ETag set by the handler is kept and weak ETags are marked
+	handler = server.Chain(page("x", `ETag: "mine"`), Middleware(Options{}))
+	resp, _ = do(t, handler, newRequest(t, "GET"))
+	got, _ = resp.Headers.Get("ETag")
+	assert.Equal(t, `"mine"`, got)
+	handler = server.Chain(page("x"), Middleware(Options{Weak: true}))
+	resp, _ = do(t, handler, newRequest(t, "GET"))
+	got, _ = resp.Headers.Get("ETag")
+	assert.True(t, strings.HasPrefix(got, `W/"`))
+
+	// Test: Bodies over the limit are sent without an ETag
+	handler = server.Chain(page("too long"), Middleware(Options{MaxBodySize: 4}))
+	resp, body = do(t, handler, newRequest(t, "GET"))
+	_, ok = resp.Headers.Get("ETag")
+	assert.False(t, ok)
+	assert.Equal(t, "too long", body)
+
+	// Test: Other methods pass through untouched
+	handler = server.Chain(page("posted"), Middleware(Options{}))
+	resp, body = do(t, handler, newRequest(t, "POST", "Content-Length: 0"))
+	_, ok = resp.Headers.Get("ETag")
+	assert.False(t, ok)
+	assert.Equal(t, "posted", body)
+
+	// Test: The handler reads the body the server loads into the request
+	rr := request.NewReader(strings.NewReader("GET /doc HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nping"))
+	req, err := rr.ReadRequestHead()
+	require.NoError(t, err)
+	req.SetBodyLoader(func() error { return rr.ReadBody(req) })
+	handler = Middleware(Options{})(func(w *response.Writer, req *request.Request) {
+		body, _ := req.ReadBody()
+		page(body)(w, req)
+	})
+	_, body = do(t, handler, req)
+	assert.Equal(t, "ping", body)
+}
@@ -0,0 +1,123 @@
+package conditional
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strconv"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// DefaultMaxBodySize is the largest body Middleware computes an ETag for
+// when Options leaves it unset.
+const DefaultMaxBodySize = 1 << 20
+
+type Options struct {
+	// MaxBodySize is the largest body an ETag is computed for; larger ones
+	// are still buffered and sent as they are. Zero uses
+	// DefaultMaxBodySize.
+	MaxBodySize int
+	// Weak marks generated ETags as weak, for handlers whose output may
+	// differ in ways that do not matter, such as formatting.
+	Weak bool
+}
+
+// ETag returns the entity tag for a body: a hash of its bytes.
+func ETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// Middleware buffers the response to each GET and HEAD, gives 200
+// responses without an ETag one computed from the body, and evaluates the
+// request's preconditions against the validators of any 2xx response, so
+// a matching GET gets a 304 without a body. Requests that upgrade the
+// connection are passed through. The whole body is held in memory, so keep
+// streams, such as event streams, out of its way. List it before
+// compression so each coding of a body gets its own ETag.
+func Middleware(options Options) server.Middleware {
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = DefaultMaxBodySize
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			method := req.RequestLine.Method
+			_, upgrade := req.Headers.Get("Upgrade")
+			if method != "GET" && method != "HEAD" || upgrade {
+				next(w, req)
+				return
+			}
+			serve(w, req, next, options)
+		}
+	}
+}
+
+func internalError(w *response.Writer) {
+	(&server.HandlerError{StatusCode: response.StatusInternalError, Message: "Internal Server Error"}).Write(w)
+}
+
+func serve(w *response.Writer, req *request.Request, next server.Handler, options Options) {
+	// A HEAD is answered from the body a GET would get, so both share the
+	// same ETag. The method is switched on req itself rather than on a
+	// copy, since the server loads a pending body into req.
+	method := req.RequestLine.Method
+	req.RequestLine.Method = "GET"
+	buf := &bytes.Buffer{}
+	inner := response.NewWriterSize(buf, 0)
+	next(inner, req)
+	req.RequestLine.Method = method
+	if err := inner.Finish(); err != nil {
+		internalError(w)
+		return
+	}
+
+	reader := response.NewReader(buf)
+	resp, err := reader.ReadResponse("GET")
+	for err == nil && resp.Interim() {
+		w.WriteInterim(resp.StatusLine.StatusCode, *resp.Headers)
+		resp, err = reader.ReadResponse("GET")
+	}
+	if err != nil {
+		internalError(w)
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		internalError(w)
+		return
+	}
+
+	status := resp.StatusLine.StatusCode
+	h := headers.NewHeaders()
+	resp.Headers.ForEach(func(n, v string) {
+		h.Add(n, v)
+	})
+	h.Delete("Transfer-Encoding")
+	h.Delete("Trailer")
+	if status == response.StatusNoContent || status == response.StatusNotModified {
+		h.Delete("Content-Length")
+	} else {
+		h.Replace("Content-Length", strconv.Itoa(len(body)))
+	}
+	if _, ok := h.Get("ETag"); !ok && status == response.StatusOK && len(body) <= options.MaxBodySize {
+		h.Replace("ETag", ETag(body, options.Weak))
+	}
+	if status >= 200 && status < 300 && Check(w, req, FromHeaders(h), h) {
+		return
+	}
+
+	w.WriteStatusLineReason(status, resp.StatusLine.ReasonPhrase)
+	w.WriteHeaders(*h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
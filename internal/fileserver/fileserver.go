@@ -0,0 +1,313 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"tcp_http/internal/conditional"
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+type Options struct {
+	// StripPrefix is removed from the request path before it is resolved
+	// against the root, e.g. "/assets" to serve /assets/a.png as root/a.png.
+	// Paths that do not start with it as whole segments get 404.
+	StripPrefix string
+	// IndexFiles are tried in order when a directory is requested. When
+	// nil, "index.html" is used.
+	IndexFiles []string
+	// ListDirectories renders an HTML listing for directories without an
+	// index file. When false such directories are answered with 403.
+	ListDirectories bool
+}
+
+type fileServer struct {
+	root    string
+	options Options
+}
+
+// New returns a handler serving the files below root.
+func New(root string, options Options) server.Handler {
+	if options.IndexFiles == nil {
+		options.IndexFiles = []string{"index.html"}
+	}
+	s := &fileServer{root: root, options: options}
+	return s.serve
+}
+
+func writeError(w *response.Writer, status response.StatusCode, extra *headers.Headers) {
+	body := []byte(fmt.Sprintf("%d %s\n", status, response.StatusText(status)))
+	h := response.GetDefaultHeaders(len(body))
+	if extra != nil {
+		extra.ForEach(func(n, v string) {
+			h.Delete(n)
+		})
+		extra.ForEach(func(n, v string) {
+			h.Add(n, v)
+		})
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+func allowMethod(w *response.Writer, req *request.Request) bool {
+	method := req.RequestLine.Method
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+	extra := headers.NewHeaders()
+	extra.Set("Allow", "GET, HEAD")
+	writeError(w, response.StatusMethodNotAllowed, extra)
+	return false
+}
+
+func statusForError(err error) response.StatusCode {
+	if errors.Is(err, fs.ErrPermission) {
+		return response.StatusForbidden
+	}
+	return response.StatusNotFound
+}
+
+// resolve maps a request path onto a file below the root. Paths are cleaned
+// before joining so ".." cannot climb out, and symlinks are followed only as
+// long as they stay inside the root.
+func (s *fileServer) resolve(urlPath string) (string, error) {
+	if strings.ContainsAny(urlPath, "\\\x00") {
+		return "", os.ErrNotExist
+	}
+	name := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+urlPath)))
+
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", os.ErrNotExist
+	}
+	return name, nil
+}
+
+func (s *fileServer) serve(w *response.Writer, req *request.Request) {
+	if !allowMethod(w, req) {
+		return
+	}
+
+	target, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	// The prefix only matches whole path segments, so "/assets" does not
+	// serve "/assetsX" as "X".
+	rawPath, ok := strings.CutPrefix(target, strings.TrimSuffix(s.options.StripPrefix, "/"))
+	if !ok || rawPath != "" && rawPath[0] != '/' {
+		writeError(w, response.StatusNotFound, nil)
+		return
+	}
+	urlPath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		writeError(w, response.StatusBadRequest, nil)
+		return
+	}
+
+	name, err := s.resolve(urlPath)
+	if err != nil {
+		writeError(w, statusForError(err), nil)
+		return
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		writeError(w, statusForError(err), nil)
+		return
+	}
+
+	if info.IsDir() {
+		// Relative links in an index page only work below a trailing slash.
+		if !strings.HasSuffix(target, "/") {
+			location := target + "/"
+			if query != "" {
+				location += "?" + query
+			}
+			extra := headers.NewHeaders()
+			extra.Set("Location", location)
+			writeError(w, response.StatusMovedPermanently, extra)
+			return
+		}
+		for _, index := range s.options.IndexFiles {
+			indexName := filepath.Join(name, index)
+			if indexInfo, err := os.Stat(indexName); err == nil && indexInfo.Mode().IsRegular() {
+				serveFile(w, req, indexName)
+				return
+			}
+		}
+		if !s.options.ListDirectories {
+			writeError(w, response.StatusForbidden, nil)
+			return
+		}
+		serveListing(w, req, name, path.Clean("/"+urlPath))
+		return
+	}
+
+	serveFile(w, req, name)
+}
+
+// ServeFile answers req with the contents of the named file, honouring
+// Range and conditional request headers.
+func ServeFile(w *response.Writer, req *request.Request, name string) {
+	if !allowMethod(w, req) {
+		return
+	}
+	serveFile(w, req, name)
+}
+
+func serveFile(w *response.Writer, req *request.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		writeError(w, statusForError(err), nil)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeError(w, response.StatusNotFound, nil)
+		return
+	}
+
+	ctype := contentTypeByName(name)
+	if ctype == "" {
+		sniff := make([]byte, 512)
+		n, _ := io.ReadFull(f, sniff)
+		ctype = detectContentType(sniff[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			writeError(w, response.StatusInternalError, nil)
+			return
+		}
+	}
+
+	serveContent(w, req, f, info, ctype)
+}
+
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func serveContent(w *response.Writer, req *request.Request, f *os.File, info os.FileInfo, ctype string) {
+	etag := fileETag(info)
+	modTime := info.ModTime()
+	size := info.Size()
+
+	h := response.GetDefaultHeaders(0)
+	h.Replace("Content-Type", ctype)
+	h.Replace("ETag", etag)
+	h.Replace("Last-Modified", modTime.UTC().Format(response.TimeFormat))
+	h.Replace("Accept-Ranges", "bytes")
+
+	validators := conditional.Validators{ETag: etag, LastModified: modTime}
+	if conditional.Check(w, req, validators, h) {
+		return
+	}
+
+	status := response.StatusOK
+	ranges := []byteRange{{start: 0, length: size}}
+	if rangeHeader, ok := req.Headers.Get("Range"); ok && conditional.IfRange(req, validators) {
+		parsed, err := parseRange(rangeHeader, size)
+		switch {
+		case errors.Is(err, errUnsatisfiableRange):
+			extra := headers.NewHeaders()
+			extra.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeError(w, response.StatusRangeNotSatisfiable, extra)
+			return
+		case err == nil:
+			status = response.StatusPartialContent
+			ranges = parsed
+		}
+	}
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		h.Replace("Content-Length", fmt.Sprintf("%d", r.length))
+		if status == response.StatusPartialContent {
+			h.Replace("Content-Range", r.contentRange(size))
+		}
+		w.WriteStatusLine(status)
+		w.WriteHeaders(*h)
+		if req.RequestLine.Method == "HEAD" {
+			return
+		}
+		if _, err := f.Seek(r.start, io.SeekStart); err != nil {
+			return
+		}
+		w.ReadFrom(io.LimitReader(f, r.length))
+		return
+	}
+
+	boundary := randomBoundary()
+	parts, closing, total := multipartRanges(ranges, ctype, size, boundary)
+	h.Replace("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Replace("Content-Length", fmt.Sprintf("%d", total))
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+	for _, part := range parts {
+		if _, err := w.WriteBody([]byte(part.header)); err != nil {
+			return
+		}
+		if _, err := f.Seek(part.r.start, io.SeekStart); err != nil {
+			return
+		}
+		if _, err := w.ReadFrom(io.LimitReader(f, part.r.length)); err != nil {
+			return
+		}
+	}
+	w.WriteBody([]byte(closing))
+}
+
+func serveListing(w *response.Writer, req *request.Request, dir, urlPath string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		writeError(w, statusForError(err), nil)
+		return
+	}
+
+	title := html.EscapeString("Index of " + urlPath)
+	b := []byte{}
+	b = fmt.Appendf(b, "<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	if urlPath != "/" {
+		b = fmt.Appendf(b, "<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := url.PathEscape(entry.Name())
+		if entry.IsDir() {
+			href += "/"
+		}
+		b = fmt.Appendf(b, "<li><a href=\"%s\">%s</a></li>\n", href, html.EscapeString(name))
+	}
+	b = fmt.Appendf(b, "</ul>\n</body>\n</html>\n")
+
+	h := response.GetDefaultHeaders(len(b))
+	h.Replace("Content-Type", "text/html; charset=utf-8")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(b)
+	}
+}
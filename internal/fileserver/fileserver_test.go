@@ -0,0 +1,244 @@
+package fileserver
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// serve runs handler for a raw request and returns the raw response.
+func serve(t *testing.T, handler server.Handler, rawRequest string) string {
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	handler(w, req)
+	require.NoError(t, w.Flush())
+	return out.String()
+}
+
+func get(target string, extraHeaders string) string {
+	return "GET " + target + " HTTP/1.1\r\nHost: localhost:42069\r\n" + extraHeaders + "\r\n"
+}
+
+func splitResponse(raw string) (string, string) {
+	head, body, _ := strings.Cut(raw, "\r\n\r\n")
+	return head, body
+}
+
+func headerValue(head, name string) string {
+	for _, line := range strings.Split(head, "\r\n") {
+		n, v, ok := strings.Cut(line, ": ")
+		if ok && strings.EqualFold(n, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+func setupRoot(t *testing.T) string {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello, world!"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("<html>docs</html>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "empty dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "noext"), []byte("%PDF-1.4 fake"), 0o644))
+	return root
+}
+
+func TestServeFile(t *testing.T) {
+	root := setupRoot(t)
+	handler := New(root, Options{ListDirectories: true})
+
+	// Test: Full file with validators
+	head, body := splitResponse(serve(t, handler, get("/hello.txt", "")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"))
+	assert.Equal(t, "hello, world!", body)
+	assert.Equal(t, "13", headerValue(head, "Content-Length"))
+	assert.Equal(t, "text/plain; charset=utf-8", headerValue(head, "Content-Type"))
+	assert.Equal(t, "bytes", headerValue(head, "Accept-Ranges"))
+	etag := headerValue(head, "ETag")
+	lastModified := headerValue(head, "Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, lastModified)
+
+	// Test: HEAD has no body
+	head, body = splitResponse(serve(t, handler, "HEAD /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, "13", headerValue(head, "Content-Length"))
+	assert.Equal(t, "", body)
+
+	// Test: Sniffed content type
+	head, _ = splitResponse(serve(t, handler, get("/noext", "")))
+	assert.Equal(t, "application/pdf", headerValue(head, "Content-Type"))
+
+	// Test: If-None-Match
+	head, body = splitResponse(serve(t, handler, get("/hello.txt", "If-None-Match: "+etag+"\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 304 Not Modified"))
+	assert.Equal(t, "", body)
+
+	// Test: If-Modified-Since
+	head, _ = splitResponse(serve(t, handler, get("/hello.txt", "If-Modified-Since: "+lastModified+"\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 304 Not Modified"))
+	earlier := time.Now().Add(-48 * time.Hour).UTC().Format(response.TimeFormat)
+	head, _ = splitResponse(serve(t, handler, get("/hello.txt", "If-Modified-Since: "+earlier+"\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"))
+
+	// Test: If-Match with a stale validator
+	head, _ = splitResponse(serve(t, handler, get("/hello.txt", "If-Match: \"stale\"\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 412 Precondition Failed"))
+	head, _ = splitResponse(serve(t, handler, get("/hello.txt", "If-Match: "+etag+"\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"))
+
+	// Test: Method not allowed
+	head, _ = splitResponse(serve(t, handler, "POST /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 405 Method Not Allowed"))
+	assert.Equal(t, "GET, HEAD", headerValue(head, "Allow"))
+}
+
+func TestRanges(t *testing.T) {
+	root := setupRoot(t)
+	handler := New(root, Options{})
+
+	// Test: Single range
+	head, body := splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=0-4\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content"))
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "bytes 0-4/13", headerValue(head, "Content-Range"))
+	assert.Equal(t, "5", headerValue(head, "Content-Length"))
+
+	// Test: Suffix range
+	_, body = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=-6\r\n")))
+	assert.Equal(t, "world!", body)
+
+	// Test: Multiple ranges
+	head, body = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=0-4, 7-\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content"))
+	ctype := headerValue(head, "Content-Type")
+	boundary, ok := strings.CutPrefix(ctype, "multipart/byteranges; boundary=")
+	require.True(t, ok)
+	assert.Equal(t, "--"+boundary+"\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 0-4/13\r\n\r\nhello"+
+		"\r\n--"+boundary+"\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 7-12/13\r\n\r\nworld!"+
+		"\r\n--"+boundary+"--\r\n", body)
+	assert.Equal(t, headerValue(head, "Content-Length"), strconv.Itoa(len(body)))
+
+	// Test: Unsatisfiable range
+	head, _ = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=100-\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 416 Range Not Satisfiable"))
+	assert.Equal(t, "bytes */13", headerValue(head, "Content-Range"))
+
+	// Test: Repeated ranges are sent once rather than once per repeat
+	head, body = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes="+strings.Repeat("0-,", 31)+"0-\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content"))
+	assert.Equal(t, "bytes 0-12/13", headerValue(head, "Content-Range"))
+	assert.Equal(t, "hello, world!", body)
+
+	// Test: Malformed range is ignored
+	head, body = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=5-1\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"))
+	assert.Equal(t, "hello, world!", body)
+
+	// Test: If-Range with a stale validator serves the whole file
+	head, body = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=0-4\r\nIf-Range: \"stale\"\r\n")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"))
+	assert.Equal(t, "hello, world!", body)
+
+	// Test: If-Range with the current validator serves the range
+	fullHead, _ := splitResponse(serve(t, handler, get("/hello.txt", "")))
+	etag := headerValue(fullHead, "ETag")
+	_, body = splitResponse(serve(t, handler, get("/hello.txt", "Range: bytes=0-4\r\nIf-Range: "+etag+"\r\n")))
+	assert.Equal(t, "hello", body)
+}
+
+func TestDirectories(t *testing.T) {
+	root := setupRoot(t)
+
+	// Test: Redirect to the trailing slash
+	handler := New(root, Options{ListDirectories: true})
+	head, _ := splitResponse(serve(t, handler, get("/docs?x=1", "")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 301 Moved Permanently"))
+	assert.Equal(t, "/docs/?x=1", headerValue(head, "Location"))
+
+	// Test: Index file
+	_, body := splitResponse(serve(t, handler, get("/docs/", "")))
+	assert.Equal(t, "<html>docs</html>", body)
+
+	// Test: Listing
+	head, body = splitResponse(serve(t, handler, get("/", "")))
+	assert.Equal(t, "text/html; charset=utf-8", headerValue(head, "Content-Type"))
+	assert.Contains(t, body, `<a href="hello.txt">hello.txt</a>`)
+	assert.Contains(t, body, `<a href="empty%20dir/">empty dir/</a>`)
+
+	// Test: Listing disabled
+	handler = New(root, Options{})
+	head, _ = splitResponse(serve(t, handler, get("/empty%20dir/", "")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden"))
+
+	// Test: Strip prefix
+	handler = New(root, Options{StripPrefix: "/static"})
+	_, body = splitResponse(serve(t, handler, get("/static/hello.txt", "")))
+	assert.Equal(t, "hello, world!", body)
+
+	// Test: The prefix must end at a segment boundary
+	head, _ = splitResponse(serve(t, handler, get("/statichello.txt", "")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 404 Not Found"))
+	handler = New(root, Options{StripPrefix: "/static/"})
+	_, body = splitResponse(serve(t, handler, get("/static/hello.txt", "")))
+	assert.Equal(t, "hello, world!", body)
+}
+
+func TestTraversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	require.NoError(t, os.Mkdir(root, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(parent, "secret.txt"), filepath.Join(root, "link.txt")))
+	handler := New(root, Options{})
+
+	for _, target := range []string{"/../secret.txt", "/%2e%2e/secret.txt", "/..%2fsecret.txt", "/link.txt", "/..\\secret.txt"} {
+		raw := serve(t, handler, get(target, ""))
+		assert.True(t, strings.HasPrefix(raw, "HTTP/1.1 404 Not Found"), target)
+		assert.NotContains(t, raw, "secret\n")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	ranges, err := parseRange("bytes=0-0,-1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 1}, {9, 1}}, ranges)
+
+	ranges, err = parseRange("bytes=5-100", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{5, 5}}, ranges)
+
+	_, err = parseRange("items=0-1", 10)
+	require.ErrorIs(t, err, errInvalidRange)
+	_, err = parseRange("bytes=-0", 10)
+	require.ErrorIs(t, err, errUnsatisfiableRange)
+
+	// Test: Overlapping and adjacent ranges are merged
+	ranges, err = parseRange("bytes="+strings.Repeat("0-,", 31)+"0-", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 10}}, ranges)
+	ranges, err = parseRange("bytes=0-4,5-9", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 10}}, ranges)
+	ranges, err = parseRange("bytes=30-35,3-8,0-5,-2", 40)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 9}, {30, 6}, {38, 2}}, ranges)
+
+	// Test: Disjoint ranges keep the requested order
+	ranges, err = parseRange("bytes=5-9,0-1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{5, 5}, {0, 2}}, ranges)
+}
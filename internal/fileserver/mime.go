@@ -0,0 +1,91 @@
+package fileserver
+
+import (
+	"bytes"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// mediaTypes covers common media files missing from mime's builtin table
+// on systems without a mime.types file.
+var mediaTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".wav":  "audio/wav",
+	".ico":  "image/x-icon",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+}
+
+type signature struct {
+	offset int
+	prefix []byte
+	ctype  string
+}
+
+var signatures = []signature{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{8, []byte("WEBP"), "image/webp"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/webm"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("OggS"), "application/ogg"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{0, []byte("\x1f\x8b\x08"), "application/gzip"},
+}
+
+var markupPrefixes = []struct {
+	prefix string
+	ctype  string
+}{
+	{"<!doctype html", "text/html; charset=utf-8"},
+	{"<html", "text/html; charset=utf-8"},
+	{"<?xml", "text/xml; charset=utf-8"},
+}
+
+// contentTypeByName looks a type up by file extension.
+func contentTypeByName(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		return ctype
+	}
+	return mediaTypes[ext]
+}
+
+// detectContentType guesses a type from the first bytes of a file.
+func detectContentType(b []byte) string {
+	for _, sig := range signatures {
+		if len(b) >= sig.offset+len(sig.prefix) && bytes.Equal(b[sig.offset:sig.offset+len(sig.prefix)], sig.prefix) {
+			return sig.ctype
+		}
+	}
+
+	trimmed := strings.ToLower(string(bytes.TrimLeft(b, " \t\r\n")))
+	for _, m := range markupPrefixes {
+		if strings.HasPrefix(trimmed, m.prefix) {
+			return m.ctype
+		}
+	}
+
+	if utf8.Valid(b) && !bytes.ContainsFunc(b, isBinaryRune) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+func isBinaryRune(r rune) bool {
+	return r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f'
+}
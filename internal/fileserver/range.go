@@ -0,0 +1,150 @@
+package fileserver
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var errInvalidRange = errors.New("invalid range")
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// maxRanges caps how many ranges one request may ask for, so a client
+// cannot make us write thousands of tiny multipart parts.
+const maxRanges = 32
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header such as "bytes=0-99,200-,-500" against a
+// file of size bytes. Ranges that start past the end are dropped; if none
+// is left errUnsatisfiableRange is returned. A malformed header returns
+// errInvalidRange and should be ignored by the caller. Overlapping or
+// adjacent ranges are coalesced, so a request cannot ask for more than the
+// file (RFC 9110 section 14.2).
+func parseRange(header string, size int64) ([]byteRange, error) {
+	unit, spec, ok := strings.Cut(header, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errInvalidRange
+	}
+
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, errInvalidRange
+	}
+
+	ranges := []byteRange{}
+	for _, s := range specs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			// Suffix range: the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, errInvalidRange
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, errInvalidRange
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return coalesce(ranges), nil
+}
+
+// coalesce merges ranges that overlap or touch, in ascending order. Ranges
+// that are already disjoint are returned as given, keeping the order the
+// client asked for them in.
+func coalesce(ranges []byteRange) []byteRange {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.start > last.start+last.length {
+			merged = append(merged, r)
+			continue
+		}
+		last.length = max(last.length, r.start+r.length-last.start)
+	}
+	if len(merged) == len(ranges) {
+		return ranges
+	}
+	return merged
+}
+
+// multipartPart is one part of a multipart/byteranges body: its header block
+// followed by the bytes of r.
+type multipartPart struct {
+	header string
+	r      byteRange
+}
+
+// multipartRanges lays out a multipart/byteranges body and returns its parts,
+// the closing delimiter and the total body length.
+func multipartRanges(ranges []byteRange, ctype string, size int64, boundary string) ([]multipartPart, string, int64) {
+	parts := make([]multipartPart, 0, len(ranges))
+	total := int64(0)
+	for i, r := range ranges {
+		header := ""
+		if i > 0 {
+			header = "\r\n"
+		}
+		header += fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, ctype, r.contentRange(size))
+		parts = append(parts, multipartPart{header: header, r: r})
+		total += int64(len(header)) + r.length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	total += int64(len(closing))
+	return parts, closing, total
+}
+
+func randomBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
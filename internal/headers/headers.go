@@ -8,12 +8,15 @@ import (
 	"unicode"
 )
 
+// Headers holds fields by lowercased name. Repeated fields are combined
+// into one comma separated line, except those added with Add and
+// Set-Cookie, which keep a line each.
 type Headers struct {
-	headers map[string]string
+	headers map[string][]string
 }
 
 func NewHeaders() *Headers {
-	return &Headers{map[string]string{}}
+	return &Headers{map[string][]string{}}
 }
 
 var rn = []byte("\r\n")
@@ -57,14 +60,21 @@ func isValidKey(a string) bool {
 	return true
 }
 
+// Get returns the field's value, with the values of separate lines joined
+// by commas.
 func (h *Headers) Get(name string) (string, bool) {
-	str, ok := h.headers[strings.ToLower(name)]
-	return str, ok
+	values, ok := h.headers[strings.ToLower(name)]
+	return strings.Join(values, ", "), ok
+}
+
+// Values returns the value of every line of the field.
+func (h *Headers) Values(name string) []string {
+	return h.headers[strings.ToLower(name)]
 }
 
 func (h *Headers) Replace(name, value string) {
 	name = strings.ToLower(name)
-	h.headers[name] = value
+	h.headers[name] = []string{value}
 }
 
 func (h *Headers) Delete(name string) {
@@ -72,23 +82,42 @@ func (h *Headers) Delete(name string) {
 	delete(h.headers, name)
 }
 
+// Set adds value to the field, combining it with an existing value. A
+// Set-Cookie value cannot be combined (RFC 9110 section 5.3), so it is
+// added as a line of its own, and Cookie values are joined with "; " as
+// RFC 6265 section 5.4 requires.
 func (h *Headers) Set(name, value string) {
-	existingValue, exists := h.KeyExists(strings.ToLower(name))
-	if exists {
-		h.headers[strings.ToLower(name)] = existingValue + ", " + value
-	} else {
-		h.headers[strings.ToLower(name)] = value
+	name = strings.ToLower(name)
+	values, exists := h.headers[name]
+	switch {
+	case !exists:
+		h.headers[name] = []string{value}
+	case name == "set-cookie":
+		h.headers[name] = append(values, value)
+	case name == "cookie":
+		values[len(values)-1] += "; " + value
+	default:
+		values[len(values)-1] += ", " + value
 	}
 }
 
+// Add adds value to the field as a line of its own.
+func (h *Headers) Add(name, value string) {
+	name = strings.ToLower(name)
+	h.headers[name] = append(h.headers[name], value)
+}
+
 func (h *Headers) KeyExists(name string) (string, bool) {
-	value, exists := h.headers[name]
-	return value, exists
+	values, exists := h.headers[name]
+	return strings.Join(values, ", "), exists
 }
 
+// ForEach calls cb once per line.
 func (h *Headers) ForEach(cb func(n, v string)) {
-	for n, v := range h.headers {
-		cb(n, v)
+	for n, values := range h.headers {
+		for _, v := range values {
+			cb(n, v)
+		}
 	}
 }
 
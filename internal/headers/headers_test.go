@@ -69,3 +69,32 @@ func TestHeaders(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestMultipleLines(t *testing.T) {
+	// Test: Repeated fields are combined, Set-Cookie keeps a line each
+	headers := NewHeaders()
+	data := []byte("Accept: text/html\r\nAccept: text/plain\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2; Path=/\r\nCookie: c=3\r\nCookie: d=4\r\n\r\n")
+	_, done, err := headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"text/html, text/plain"}, headers.Values("accept"))
+	assert.Equal(t, []string{"a=1", "b=2; Path=/"}, headers.Values("Set-Cookie"))
+	cookie, _ := headers.Get("Cookie")
+	assert.Equal(t, "c=3; d=4", cookie)
+
+	// Test: ForEach visits every line
+	lines := 0
+	headers.ForEach(func(n, v string) {
+		lines++
+	})
+	assert.Equal(t, 4, lines)
+
+	// Test: Add keeps separate lines and Replace collapses them
+	headers.Add("Link", "</a.css>; rel=preload")
+	headers.Add("Link", "</b.js>; rel=preload")
+	assert.Len(t, headers.Values("link"), 2)
+	link, _ := headers.Get("link")
+	assert.Equal(t, "</a.css>; rel=preload, </b.js>; rel=preload", link)
+	headers.Replace("Set-Cookie", "z=9")
+	assert.Equal(t, []string{"z=9"}, headers.Values("set-cookie"))
+}
@@ -0,0 +1,135 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"tcp_http/internal/headers"
+)
+
+// Form is a parsed multipart/form-data body.
+type Form struct {
+	Values map[string][]string
+	Files  map[string][]*File
+}
+
+// File is an uploaded file part, kept in memory or in a temporary file.
+type File struct {
+	Filename string
+	Headers  *headers.Headers
+	Size     int64
+
+	content []byte
+	path    string
+}
+
+// Open returns the file's content.
+func (f *File) Open() (io.ReadCloser, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+// Value returns the first value of the named field, or "".
+func (f *Form) Value(name string) string {
+	if values := f.Values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// File returns the first file uploaded in the named field, or nil.
+func (f *Form) File(name string) *File {
+	if files := f.Files[name]; len(files) > 0 {
+		return files[0]
+	}
+	return nil
+}
+
+// RemoveAll deletes the temporary files of the form.
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, files := range f.Files {
+		for _, file := range files {
+			if file.path != "" {
+				if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadForm reads every remaining part. Fields without a filename become
+// Values; files are stored in memory up to MaxMemory in total and in
+// temporary files past that, or handed to OnFile when it is set. Callers
+// should call RemoveAll once they are done with the files.
+func (r *Reader) ReadForm() (*Form, error) {
+	form := &Form{Values: map[string][]string{}, Files: map[string][]*File{}}
+	if err := r.readForm(form); err != nil {
+		form.RemoveAll()
+		return nil, err
+	}
+	return form, nil
+}
+
+func (r *Reader) readForm(form *Form) error {
+	memory := r.options.maxMemory()
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		if part.fileName == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			form.Values[name] = append(form.Values[name], string(value))
+			continue
+		}
+		if r.options.OnFile != nil {
+			if err := r.options.OnFile(part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file := &File{Filename: part.FileName(), Headers: part.Headers}
+		form.Files[name] = append(form.Files[name], file)
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, part, memory+1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n <= memory {
+			memory -= n
+			file.content = buf.Bytes()
+			file.Size = n
+			continue
+		}
+		tmp, err := os.CreateTemp(r.options.TempDir, "multipart-")
+		if err != nil {
+			return err
+		}
+		file.path = tmp.Name()
+		file.Size, err = io.Copy(tmp, io.MultiReader(&buf, part))
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package multipart
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+)
+
+const (
+	DefaultMaxPartSize  = 10 << 20
+	DefaultMaxTotalSize = 32 << 20
+	DefaultMaxParts     = 1000
+	DefaultMaxMemory    = 1 << 20
+)
+
+// maxHeaderBytes caps the header block of a single part.
+const maxHeaderBytes = 16 << 10
+
+// readChunk is how much is read from the source at a time.
+const readChunk = 32 << 10
+
+var ErrNotMultipart = errors.New("not a multipart content type")
+var ErrNoBoundary = errors.New("missing or invalid multipart boundary")
+var ErrMalformed = errors.New("malformed multipart body")
+var ErrPartTooLarge = errors.New("multipart part too large")
+var ErrBodyTooLarge = errors.New("multipart body too large")
+var ErrTooManyParts = errors.New("too many multipart parts")
+
+type Options struct {
+	// MaxPartSize caps the body of any one part. Zero uses
+	// DefaultMaxPartSize.
+	MaxPartSize int64
+	// MaxTotalSize caps the whole multipart body. Zero uses
+	// DefaultMaxTotalSize.
+	MaxTotalSize int64
+	// MaxParts caps the number of parts. Zero uses DefaultMaxParts.
+	MaxParts int
+	// MaxMemory is how many bytes of file parts ReadForm keeps in memory;
+	// files that do not fit are written to temporary files in TempDir.
+	// Zero uses DefaultMaxMemory.
+	MaxMemory int64
+	// TempDir is where ReadForm puts large files. Empty uses the system
+	// default.
+	TempDir string
+	// OnFile, when set, is handed each file part by ReadForm instead of the
+	// part being stored, e.g. to stream it elsewhere. The part can only be
+	// read until OnFile returns.
+	OnFile func(part *Part) error
+}
+
+func (o Options) maxPartSize() int64 {
+	if o.MaxPartSize == 0 {
+		return DefaultMaxPartSize
+	}
+	return o.MaxPartSize
+}
+
+func (o Options) maxTotalSize() int64 {
+	if o.MaxTotalSize == 0 {
+		return DefaultMaxTotalSize
+	}
+	return o.MaxTotalSize
+}
+
+func (o Options) maxParts() int {
+	if o.MaxParts == 0 {
+		return DefaultMaxParts
+	}
+	return o.MaxParts
+}
+
+func (o Options) maxMemory() int64 {
+	if o.MaxMemory == 0 {
+		return DefaultMaxMemory
+	}
+	return o.MaxMemory
+}
+
+// Boundary returns the boundary parameter of a multipart Content-Type.
+func Boundary(contentType string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return "", ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" || len(boundary) > 70 {
+		return "", ErrNoBoundary
+	}
+	return boundary, nil
+}
+
+// Reader iterates over the parts of a multipart body (RFC 2046 section
+// 5.1). Parts are streamed: only a small window of the body is held in
+// memory at a time.
+type Reader struct {
+	src     io.Reader
+	options Options
+	// delim ends every part. The body is read as if it started with CRLF
+	// so the first boundary needs no special case.
+	delim  []byte
+	buf    []byte
+	chunk  []byte
+	srcErr error
+	total  int64
+
+	parts   int
+	current *Part
+	done    bool
+	err     error
+}
+
+func NewReader(r io.Reader, boundary string, options Options) *Reader {
+	return &Reader{
+		src:     r,
+		options: options,
+		delim:   []byte("\r\n--" + boundary),
+		buf:     []byte("\r\n"),
+		chunk:   make([]byte, readChunk),
+	}
+}
+
+// NewRequestReader returns a Reader for the body of a multipart request.
+// The body is streamed from the connection only when the server left it
+// there, as it does with server.Options.StreamRequestBodies; otherwise it
+// has been read into memory already and the limits only bound the parsing.
+func NewRequestReader(req *request.Request, options Options) (*Reader, error) {
+	contentType, _ := req.Headers.Get("Content-Type")
+	boundary, err := Boundary(contentType)
+	if err != nil {
+		return nil, err
+	}
+	body, err := req.BodyReader()
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(body, boundary, options), nil
+}
+
+// fill reads the next chunk of the source into buf.
+func (r *Reader) fill() {
+	n, err := r.src.Read(r.chunk)
+	r.total += int64(n)
+	if r.total > r.options.maxTotalSize() {
+		r.srcErr = ErrBodyTooLarge
+		return
+	}
+	r.buf = append(r.buf, r.chunk[:n]...)
+	if err != nil {
+		r.srcErr = err
+	}
+}
+
+// need fills buf until it holds at least n bytes.
+func (r *Reader) need(n int) error {
+	for len(r.buf) < n {
+		if r.srcErr != nil {
+			return r.sourceError()
+		}
+		r.fill()
+	}
+	return nil
+}
+
+// sourceError is the error to report once the source has run out: an end
+// before the closing boundary means the body was cut short.
+func (r *Reader) sourceError() error {
+	if r.srcErr == io.EOF {
+		return ErrMalformed
+	}
+	return r.srcErr
+}
+
+// readData reads the data of the current part, up to the next delimiter.
+// Bytes that could be the start of a delimiter stay buffered until more of
+// the body arrives.
+func (r *Reader) readData(p []byte) (int, error) {
+	for {
+		if i := bytes.Index(r.buf, r.delim); i >= 0 {
+			if i == 0 {
+				return 0, io.EOF
+			}
+			n := copy(p, r.buf[:i])
+			r.buf = r.buf[n:]
+			return n, nil
+		}
+		if safe := len(r.buf) - len(r.delim) + 1; safe > 0 {
+			n := copy(p, r.buf[:safe])
+			r.buf = r.buf[n:]
+			return n, nil
+		}
+		if r.srcErr != nil {
+			return 0, r.sourceError()
+		}
+		r.fill()
+	}
+}
+
+// NextPart skips what is left of the current part and returns the next
+// one, or io.EOF after the closing boundary.
+func (r *Reader) NextPart() (*Part, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	part, err := r.nextPart()
+	if err != nil {
+		r.err = err
+	}
+	return part, err
+}
+
+func (r *Reader) nextPart() (*Part, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	// Skip the rest of the current part, or the preamble before the first
+	// boundary.
+	r.current = nil
+	scratch := make([]byte, 4096)
+	for {
+		_, err := r.readData(scratch)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.need(len(r.delim) + 2); err != nil {
+		return nil, err
+	}
+	r.buf = r.buf[len(r.delim):]
+	if bytes.HasPrefix(r.buf, []byte("--")) {
+		r.done = true
+		return nil, io.EOF
+	}
+	// The boundary line may end in linear whitespace.
+	for {
+		if err := r.need(1); err != nil {
+			return nil, err
+		}
+		if r.buf[0] != ' ' && r.buf[0] != '\t' {
+			break
+		}
+		r.buf = r.buf[1:]
+	}
+	if err := r.need(2); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(r.buf, []byte("\r\n")) {
+		return nil, ErrMalformed
+	}
+	r.buf = r.buf[2:]
+
+	h := headers.NewHeaders()
+	headerBytes := 0
+	for {
+		n, done, err := h.Parse(r.buf)
+		if err != nil {
+			return nil, errors.Join(ErrMalformed, err)
+		}
+		r.buf = r.buf[n:]
+		headerBytes += n
+		if done {
+			break
+		}
+		if headerBytes+len(r.buf) > maxHeaderBytes {
+			return nil, ErrMalformed
+		}
+		if r.srcErr != nil {
+			return nil, r.sourceError()
+		}
+		r.fill()
+	}
+
+	r.parts++
+	if r.parts > r.options.maxParts() {
+		return nil, ErrTooManyParts
+	}
+	part := &Part{Headers: h, reader: r}
+	if disposition, ok := h.Get("Content-Disposition"); ok {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			part.formName = params["name"]
+			part.fileName = params["filename"]
+		}
+	}
+	r.current = part
+	return part, nil
+}
+
+// Part is one part of a multipart body. Its data is read with Read and is
+// only available until the next call to NextPart.
+type Part struct {
+	Headers *headers.Headers
+
+	reader   *Reader
+	formName string
+	fileName string
+	size     int64
+}
+
+// FormName is the name parameter of a form-data Content-Disposition.
+func (p *Part) FormName() string {
+	return p.formName
+}
+
+// FileName is the filename parameter of the Content-Disposition, without
+// any directories a client may have put in it.
+func (p *Part) FileName() string {
+	if p.fileName == "" {
+		return ""
+	}
+	name := filepath.Base(strings.ReplaceAll(p.fileName, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+func (p *Part) Read(b []byte) (int, error) {
+	r := p.reader
+	if r.current != p {
+		return 0, io.EOF
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.readData(b)
+	p.size += int64(n)
+	if p.size > r.options.maxPartSize() {
+		r.err = ErrPartTooLarge
+		return 0, r.err
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,278 @@
+package multipart
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+func sampleBody(t *testing.T) (string, string) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.SetBoundary("xyz-boundary"))
+	require.NoError(t, w.WriteField("title", "Hello"))
+	require.NoError(t, w.WriteField("tag", "a"))
+	require.NoError(t, w.WriteField("tag", "b"))
+	f, err := w.CreateFormFile("upload", `C:\Users\me\notes.txt`)
+	require.NoError(t, err)
+	io.WriteString(f, "line one\r\n--xyz-boundar\r\nline two")
+	require.NoError(t, w.Close())
+	return buf.String(), w.FormDataContentType()
+}
+
+func TestReader(t *testing.T) {
+	// Test: Parts written by Writer are read back with their headers
+	body, contentType := sampleBody(t)
+	assert.Equal(t, "multipart/form-data; boundary=xyz-boundary", contentType)
+	boundary, err := Boundary(contentType)
+	require.NoError(t, err)
+	r := NewReader(strings.NewReader(body), boundary, Options{})
+	var names, values []string
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(part)
+		require.NoError(t, err)
+		names = append(names, part.FormName())
+		values = append(values, string(data))
+	}
+	assert.Equal(t, []string{"title", "tag", "tag", "upload"}, names)
+	assert.Equal(t, "line one\r\n--xyz-boundar\r\nline two", values[3])
+
+	// Test: A source that returns one byte at a time gives the same parts
+	r = NewReader(iotest.OneByteReader(strings.NewReader(body)), boundary, Options{})
+	form, err := r.ReadForm()
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", form.Value("title"))
+	assert.Equal(t, []string{"a", "b"}, form.Values["tag"])
+	file := form.File("upload")
+	require.NotNil(t, file)
+	assert.Equal(t, "notes.txt", file.Filename)
+	contentTypeHeader, _ := file.Headers.Get("Content-Type")
+	assert.Equal(t, "application/octet-stream", contentTypeHeader)
+
+	// Test: Preamble, epilogue and whitespace after a boundary are ignored
+	body = "this is a preamble\r\n--b \t\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1\r\n--b\r\n\r\nno name\r\n--b--\r\nepilogue"
+	r = NewReader(strings.NewReader(body), "b", Options{})
+	form, err = r.ReadForm()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"a": {"1"}}, form.Values)
+
+	// Test: Unread parts are skipped
+	r = NewReader(strings.NewReader(body), "b", Options{})
+	_, err = r.NextPart()
+	require.NoError(t, err)
+	part, err := r.NextPart()
+	require.NoError(t, err)
+	data, _ := io.ReadAll(part)
+	assert.Equal(t, "no name", string(data))
+	_, err = r.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: A body cut off before the closing boundary is malformed
+	r = NewReader(strings.NewReader("--b\r\n\r\ndata"), "b", Options{})
+	_, err = r.ReadForm()
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Garbage after a boundary is malformed
+	r = NewReader(strings.NewReader("--bx\r\n\r\ndata\r\n--b--"), "b", Options{})
+	_, err = r.NextPart()
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	// Test: Content types without a usable boundary are rejected
+	_, err = Boundary("application/json")
+	assert.ErrorIs(t, err, ErrNotMultipart)
+	_, err = Boundary("multipart/form-data")
+	assert.ErrorIs(t, err, ErrNoBoundary)
+}
+
+func TestLimits(t *testing.T) {
+	body, _ := sampleBody(t)
+
+	// Test: A part larger than MaxPartSize fails
+	r := NewReader(strings.NewReader(body), "xyz-boundary", Options{MaxPartSize: 10})
+	_, err := r.ReadForm()
+	assert.ErrorIs(t, err, ErrPartTooLarge)
+
+	// Test: A body larger than MaxTotalSize fails
+	r = NewReader(strings.NewReader(body), "xyz-boundary", Options{MaxTotalSize: 100})
+	_, err = r.ReadForm()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: More parts than MaxParts fails
+	r = NewReader(strings.NewReader(body), "xyz-boundary", Options{MaxParts: 3})
+	_, err = r.ReadForm()
+	assert.ErrorIs(t, err, ErrTooManyParts)
+
+	// Test: Errors are sticky
+	_, err = r.NextPart()
+	assert.ErrorIs(t, err, ErrTooManyParts)
+}
+
+func TestReadFormFiles(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	small, _ := w.CreateFormFile("files", "small.bin")
+	small.Write(bytes.Repeat([]byte("s"), 10))
+	large, _ := w.CreateFormFile("files", "large.bin")
+	large.Write(bytes.Repeat([]byte("l"), 100))
+	w.Close()
+
+	// Test: Files beyond MaxMemory spill to temporary files
+	dir := t.TempDir()
+	r := NewReader(bytes.NewReader(buf.Bytes()), w.Boundary(), Options{MaxMemory: 50, TempDir: dir})
+	form, err := r.ReadForm()
+	require.NoError(t, err)
+	files := form.Files["files"]
+	require.Len(t, files, 2)
+	assert.Equal(t, int64(10), files[0].Size)
+	assert.Empty(t, files[0].path)
+	assert.Equal(t, int64(100), files[1].Size)
+	require.NotEmpty(t, files[1].path)
+	for _, f := range files {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, int(f.Size), len(data))
+	}
+
+	// Test: RemoveAll deletes the temporary files
+	require.NoError(t, form.RemoveAll())
+	_, err = os.Stat(files[1].path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: OnFile streams each file instead of storing it
+	var got []string
+	r = NewReader(bytes.NewReader(buf.Bytes()), w.Boundary(), Options{OnFile: func(p *Part) error {
+		n, err := io.Copy(io.Discard, p)
+		got = append(got, fmt.Sprintf("%s:%d", p.FileName(), n))
+		return err
+	}})
+	form, err = r.ReadForm()
+	require.NoError(t, err)
+	assert.Empty(t, form.Files)
+	assert.Equal(t, []string{"small.bin:10", "large.bin:100"}, got)
+}
+
+func TestRequestReader(t *testing.T) {
+	body, contentType := sampleBody(t)
+	raw := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", contentType, len(body), body)
+
+	// Test: The boundary is taken from the request's Content-Type
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	r, err := NewRequestReader(req, Options{})
+	require.NoError(t, err)
+	form, err := r.ReadForm()
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", form.Value("title"))
+
+	// Test: A request that is not multipart is rejected
+	raw = "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nhi"
+	req, err = request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	_, err = NewRequestReader(req, Options{})
+	assert.ErrorIs(t, err, ErrNotMultipart)
+
+	// Test: A body left on the connection is streamed, so MaxTotalSize
+	// stops the upload long before all of it has been read
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	f, err := w.CreateFormFile("upload", "big.bin")
+	require.NoError(t, err)
+	f.Write(bytes.Repeat([]byte("x"), 1<<20))
+	require.NoError(t, w.Close())
+	raw = fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", w.FormDataContentType(), buf.Len(), buf.String())
+	src := &io.LimitedReader{R: strings.NewReader(raw), N: int64(len(raw))}
+	rr := request.NewReader(src)
+	req, err = rr.ReadRequestHead()
+	require.NoError(t, err)
+	req.SetBodyStream(func() (io.Reader, error) {
+		return rr.BodyReader(req), nil
+	})
+	r, err = NewRequestReader(req, Options{MaxTotalSize: 64 << 10})
+	require.NoError(t, err)
+	_, err = r.ReadForm()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Greater(t, src.N, int64(len(raw)/2))
+	_, err = req.ReadBody()
+	assert.ErrorIs(t, err, request.ErrBodyStreamed)
+}
+
+func TestWriter(t *testing.T) {
+	// Test: Invalid boundaries are refused
+	w := NewWriter(io.Discard)
+	assert.Len(t, w.Boundary(), 32)
+	assert.ErrorIs(t, w.SetBoundary(""), ErrNoBoundary)
+	assert.ErrorIs(t, w.SetBoundary("bad\"quote"), ErrNoBoundary)
+	assert.ErrorIs(t, w.SetBoundary(strings.Repeat("a", 71)), ErrNoBoundary)
+
+	// Test: The boundary cannot change after the first part
+	require.NoError(t, w.WriteField("a", "b"))
+	assert.ErrorIs(t, w.SetBoundary("other"), ErrBoundaryInUse)
+
+	// Test: Repeated fields are written line by line in order
+	var buf bytes.Buffer
+	pw := NewWriter(&buf)
+	require.NoError(t, pw.SetBoundary("b"))
+	h := headers.NewHeaders()
+	h.Add("X-Tag", "one")
+	h.Add("X-Tag", "two")
+	h.Set("Content-Type", "text/plain")
+	_, err := pw.CreatePart(h)
+	require.NoError(t, err)
+	assert.Equal(t, "--b\r\ncontent-type: text/plain\r\nx-tag: one\r\nx-tag: two\r\n\r\n", buf.String())
+
+	// Test: A value with CR or LF is refused before anything is written
+	buf.Reset()
+	h = headers.NewHeaders()
+	h.Set("X-Note", "a\r\nContent-Type: text/html")
+	_, err = pw.CreatePart(h)
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	_, err = pw.CreateFormFile("upload", "evil\n.txt")
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+	assert.Empty(t, buf.String())
+
+	// Test: Parts cannot be created after Close
+	require.NoError(t, w.Close())
+	_, err = w.CreateFormField("c")
+	assert.ErrorIs(t, err, ErrWriterClosed)
+
+	// Test: A multipart response is written through the response body
+	var out bytes.Buffer
+	rw := response.NewWriter(&out)
+	mw := NewResponseWriter(rw)
+	require.NoError(t, mw.SetBoundary("resp"))
+	h = response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Replace("Content-Type", mw.ContentType("mixed"))
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, rw.WriteStatusLine(response.StatusOK))
+	require.NoError(t, rw.WriteHeaders(*h))
+	require.NoError(t, mw.WriteField("greeting", "hi"))
+	require.NoError(t, mw.Close())
+	require.NoError(t, rw.Finish())
+	assert.Contains(t, out.String(), "content-type: multipart/mixed; boundary=resp\r\n")
+
+	resp, err := response.ResponseFromReader(&out)
+	require.NoError(t, err)
+	r := NewReader(resp.Body, "resp", Options{})
+	form, err := r.ReadForm()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", form.Value("greeting"))
+}
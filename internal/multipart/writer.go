@@ -0,0 +1,190 @@
+package multipart
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/response"
+)
+
+var ErrWriterClosed = errors.New("multipart writer closed")
+var ErrBoundaryInUse = errors.New("boundary cannot change once a part is written")
+var ErrInvalidHeader = errors.New("multipart header contains CR or LF")
+
+// Writer produces a multipart body. Each part's data is written to the
+// io.Writer returned by CreatePart, which is only valid until the next part
+// is created or the Writer is closed.
+type Writer struct {
+	w        io.Writer
+	boundary string
+	started  bool
+	closed   bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, boundary: randomBoundary()}
+}
+
+// bodyWriter writes through a response's body framing and encoders.
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.WriteBody(p)
+}
+
+// NewResponseWriter writes a multipart body as a response body. The
+// handler writes the status line and headers first, with the Content-Type
+// from ContentType.
+func NewResponseWriter(w *response.Writer) *Writer {
+	return NewWriter(bodyWriter{w})
+}
+
+func randomBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (w *Writer) Boundary() string {
+	return w.boundary
+}
+
+// SetBoundary replaces the random boundary. It must be 1 to 70 characters
+// from the set RFC 2046 allows and be set before the first part.
+func (w *Writer) SetBoundary(boundary string) error {
+	if w.started {
+		return ErrBoundaryInUse
+	}
+	if len(boundary) < 1 || len(boundary) > 70 || strings.HasSuffix(boundary, " ") {
+		return ErrNoBoundary
+	}
+	for _, c := range boundary {
+		if !strings.ContainsRune("'()+_,-./:=? ", c) &&
+			!('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return ErrNoBoundary
+		}
+	}
+	w.boundary = boundary
+	return nil
+}
+
+// ContentType returns the Content-Type of the body for a multipart
+// subtype such as "mixed" or "form-data".
+func (w *Writer) ContentType(subtype string) string {
+	return mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.boundary})
+}
+
+func (w *Writer) FormDataContentType() string {
+	return w.ContentType("form-data")
+}
+
+// CreatePart starts a new part with the given header fields, written in
+// name order with every line of a repeated field kept. Names and values
+// must not contain CR or LF.
+func (w *Writer) CreatePart(h *headers.Headers) (io.Writer, error) {
+	if w.closed {
+		return nil, ErrWriterClosed
+	}
+	names := []string{}
+	if h != nil {
+		seen := map[string]bool{}
+		invalid := false
+		h.ForEach(func(n, v string) {
+			if strings.ContainsAny(n, "\r\n") || strings.ContainsAny(v, "\r\n") {
+				invalid = true
+			}
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		})
+		if invalid {
+			return nil, ErrInvalidHeader
+		}
+		sort.Strings(names)
+	}
+	var b strings.Builder
+	if w.started {
+		b.WriteString("\r\n")
+	}
+	w.started = true
+	fmt.Fprintf(&b, "--%s\r\n", w.boundary)
+	for _, n := range names {
+		for _, v := range h.Values(n) {
+			fmt.Fprintf(&b, "%s: %s\r\n", n, v)
+		}
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(w.w, b.String()); err != nil {
+		return nil, err
+	}
+	return &partWriter{writer: w}, nil
+}
+
+type partWriter struct {
+	writer *Writer
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	if p.writer.closed {
+		return 0, ErrWriterClosed
+	}
+	return p.writer.w.Write(b)
+}
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func disposition(field, filename string) string {
+	value := `form-data; name="` + quoteEscaper.Replace(field) + `"`
+	if filename != "" {
+		value += `; filename="` + quoteEscaper.Replace(filename) + `"`
+	}
+	return value
+}
+
+// CreateFormField starts a form-data part for a plain field.
+func (w *Writer) CreateFormField(name string) (io.Writer, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Disposition", disposition(name, ""))
+	return w.CreatePart(h)
+}
+
+// CreateFormFile starts a form-data part for an uploaded file.
+func (w *Writer) CreateFormFile(field, filename string) (io.Writer, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Disposition", disposition(field, filename))
+	h.Set("Content-Type", "application/octet-stream")
+	return w.CreatePart(h)
+}
+
+func (w *Writer) WriteField(name, value string) error {
+	p, err := w.CreateFormField(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(p, value)
+	return err
+}
+
+// Close writes the closing boundary.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	prefix := ""
+	if w.started {
+		prefix = "\r\n"
+	}
+	_, err := fmt.Fprintf(w.w, "%s--%s--\r\n", prefix, w.boundary)
+	return err
+}
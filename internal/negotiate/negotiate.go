@@ -0,0 +1,223 @@
+package negotiate
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+var ErrNotAcceptable = errors.New("no acceptable representation")
+
+// Range is one entry of an Accept, Accept-Language or Accept-Charset
+// header: a media range, language range or charset with its q-value. Value
+// is lowercased; Params holds the media type parameters that came before q.
+type Range struct {
+	Value  string
+	Params map[string]string
+	Q      float64
+}
+
+// splitList splits a header value at sep, leaving quoted strings whole.
+func splitList(value string, sep byte) []string {
+	items := []string{}
+	start, quoted := 0, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			items = append(items, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, value[start:])
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		if s, err := strconv.Unquote(value); err == nil {
+			return s
+		}
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Parse parses an Accept* header value. Entries with a malformed q-value
+// are dropped; parameters after q are extensions and ignored.
+func Parse(value string) []Range {
+	ranges := []Range{}
+	for _, item := range splitList(value, ',') {
+		parts := splitList(item, ';')
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		r := Range{Value: name, Params: map[string]string{}, Q: 1}
+		valid := true
+		for _, param := range parts[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			k = strings.ToLower(strings.TrimSpace(k))
+			v = strings.TrimSpace(v)
+			if k != "q" {
+				r.Params[k] = unquote(v)
+				continue
+			}
+			q, err := strconv.ParseFloat(v, 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
+			}
+			r.Q = q
+			break
+		}
+		if valid {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// best returns the offer with the highest q-value, where an offer's
+// q-value is that of the most specific range matching it. match returns
+// how specific a range is for an offer, or -1 when it does not match.
+// Ties go to the earlier offer.
+func best(ranges []Range, offers []string, match func(r Range, offer string) int) (string, bool) {
+	chosen, chosenQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if s := match(r, offer); s > specificity {
+				q, specificity = r.Q, s
+			}
+		}
+		if q > chosenQ {
+			chosen, chosenQ = offer, q
+		}
+	}
+	return chosen, chosenQ > 0
+}
+
+// BestMediaType picks the offer, such as "application/json", that an
+// Accept value prefers. Offers may carry parameters, which a media range
+// with parameters must all match.
+func BestMediaType(accept string, offers []string) (string, bool) {
+	return best(Parse(accept), offers, func(r Range, offer string) int {
+		offerType, offerParams := parseOffer(offer)
+		rType, rSub, _ := strings.Cut(r.Value, "/")
+		oType, oSub, _ := strings.Cut(offerType, "/")
+		specificity := 0
+		switch {
+		case r.Value == "*/*":
+		case rSub == "*" && rType == oType:
+			specificity = 1
+		case rType == oType && rSub == oSub:
+			specificity = 2
+		default:
+			return -1
+		}
+		for k, v := range r.Params {
+			if !strings.EqualFold(offerParams[k], v) {
+				return -1
+			}
+		}
+		return specificity*100 + len(r.Params)
+	})
+}
+
+func parseOffer(offer string) (string, map[string]string) {
+	parts := splitList(offer, ';')
+	params := map[string]string{}
+	for _, param := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		params[strings.ToLower(strings.TrimSpace(k))] = unquote(strings.TrimSpace(v))
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])), params
+}
+
+// BestLanguage picks the offered language tag, such as "en-GB", that an
+// Accept-Language value prefers. A range matches a tag equal to it or
+// starting with it followed by "-" (RFC 4647 basic filtering).
+func BestLanguage(acceptLanguage string, offers []string) (string, bool) {
+	return best(Parse(acceptLanguage), offers, func(r Range, offer string) int {
+		offer = strings.ToLower(offer)
+		switch {
+		case r.Value == "*":
+			return 0
+		case offer == r.Value || strings.HasPrefix(offer, r.Value+"-"):
+			return len(r.Value)
+		}
+		return -1
+	})
+}
+
+// BestCharset picks the offered charset an Accept-Charset value prefers.
+func BestCharset(acceptCharset string, offers []string) (string, bool) {
+	return best(Parse(acceptCharset), offers, func(r Range, offer string) int {
+		switch {
+		case r.Value == "*":
+			return 0
+		case strings.EqualFold(offer, r.Value):
+			return 1
+		}
+		return -1
+	})
+}
+
+// negotiate picks an offer for the request's field. Without the field
+// anything is acceptable and the first offer is used. The response varies
+// on the field either way, so it is added to Vary in h.
+func negotiate(req *request.Request, h *headers.Headers, field string, offers []string, pick func(string, []string) (string, bool)) (string, error) {
+	if h != nil {
+		response.AddVary(h, field)
+	}
+	if len(offers) == 0 {
+		return "", ErrNotAcceptable
+	}
+	value, ok := req.Headers.Get(field)
+	if !ok || strings.TrimSpace(value) == "" {
+		return offers[0], nil
+	}
+	if chosen, ok := pick(value, offers); ok {
+		return chosen, nil
+	}
+	return "", ErrNotAcceptable
+}
+
+// ContentType picks the media type to send from offers, in order of the
+// server's preference, and adds Accept to Vary in h. It returns
+// ErrNotAcceptable when the client accepts none of them.
+func ContentType(req *request.Request, h *headers.Headers, offers ...string) (string, error) {
+	return negotiate(req, h, "Accept", offers, BestMediaType)
+}
+
+// Language picks the language to send from offers and adds
+// Accept-Language to Vary in h.
+func Language(req *request.Request, h *headers.Headers, offers ...string) (string, error) {
+	return negotiate(req, h, "Accept-Language", offers, BestLanguage)
+}
+
+// Charset picks the charset to send from offers and adds Accept-Charset to
+// Vary in h.
+func Charset(req *request.Request, h *headers.Headers, offers ...string) (string, error) {
+	return negotiate(req, h, "Accept-Charset", offers, BestCharset)
+}
+
+// NotAcceptable is the 406 response for a request whose field, such as
+// Accept, none of the offers satisfy. It lists the offers so the client
+// can retry with one of them.
+func NotAcceptable(field string, offers ...string) *server.HandlerError {
+	message := "Not Acceptable"
+	if len(offers) > 0 {
+		message += "; available: " + strings.Join(offers, ", ")
+	}
+	h := headers.NewHeaders()
+	h.Set("Vary", field)
+	return &server.HandlerError{StatusCode: response.StatusNotAcceptable, Message: message, Headers: h}
+}
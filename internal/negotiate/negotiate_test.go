@@ -0,0 +1,111 @@
+package negotiate
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+func TestParse(t *testing.T) {
+	// Test: q-values, parameters and quoted commas
+	ranges := Parse(`text/html;level=1, text/*;q=0.5, application/x;name="a,b";q=0.2;ext=1, bad;q=2, */*;q=0`)
+	require.Len(t, ranges, 4)
+	assert.Equal(t, Range{Value: "text/html", Params: map[string]string{"level": "1"}, Q: 1}, ranges[0])
+	assert.Equal(t, 0.5, ranges[1].Q)
+	assert.Equal(t, map[string]string{"name": "a,b"}, ranges[2].Params)
+	assert.Equal(t, 0.2, ranges[2].Q)
+	assert.Equal(t, Range{Value: "*/*", Params: map[string]string{}, Q: 0}, ranges[3])
+}
+
+func TestBestMediaType(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain"}
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		// Test: Highest q-value wins
+		{"application/json, text/html;q=0.9", "application/json"},
+		// Test: Ties go to the server's order
+		{"text/plain, application/json", "application/json"},
+		// Test: The most specific range sets the q-value
+		{"text/*;q=0.8, text/html;q=0.1, */*;q=0.5", "text/plain"},
+		// Test: Wildcards
+		{"*/*", "text/html"},
+		{"application/*", "application/json"},
+		// Test: q=0 excludes
+		{"text/html;q=0, */*;q=0.1", "application/json"},
+		// Test: Nothing acceptable
+		{"image/png", ""},
+	} {
+		got, ok := BestMediaType(tc.accept, offers)
+		assert.Equal(t, tc.want, got, tc.accept)
+		assert.Equal(t, tc.want != "", ok, tc.accept)
+	}
+
+	// Test: Range parameters must match the offer's
+	offers = []string{"text/html;level=1", "text/html;level=2"}
+	got, _ := BestMediaType("text/html;level=2, text/html;q=0.1", offers)
+	assert.Equal(t, "text/html;level=2", got)
+}
+
+func TestBestLanguageAndCharset(t *testing.T) {
+	// Test: Prefix ranges, specificity and wildcards for languages
+	offers := []string{"en-US", "de", "fr-CA"}
+	got, _ := BestLanguage("fr, de;q=0.9", offers)
+	assert.Equal(t, "fr-CA", got)
+	got, _ = BestLanguage("en;q=0.2, en-us;q=0.1, *;q=0.5", offers)
+	assert.Equal(t, "de", got)
+	_, ok := BestLanguage("ja", offers)
+	assert.False(t, ok)
+	_, ok = BestLanguage("en-GB", offers)
+	assert.False(t, ok)
+
+	// Test: Charsets are matched without regard to case
+	got, _ = BestCharset("ISO-8859-1;q=0.5, UTF-8", []string{"iso-8859-1", "utf-8"})
+	assert.Equal(t, "utf-8", got)
+	_, ok = BestCharset("*;q=0", []string{"utf-8"})
+	assert.False(t, ok)
+}
+
+func TestNegotiate(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\nAccept-Language: de\r\n\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	// Test: Each negotiated field is added to Vary once
+	h := headers.NewHeaders()
+	h.Set("Vary", "Accept-Encoding")
+	got, err := ContentType(req, h, "text/html", "application/json")
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", got)
+	got, err = Language(req, h, "en", "de")
+	require.NoError(t, err)
+	assert.Equal(t, "de", got)
+	_, err = ContentType(req, h, "text/html", "application/json")
+	require.NoError(t, err)
+	vary, _ := h.Get("Vary")
+	assert.Equal(t, "Accept-Encoding, Accept, Accept-Language", vary)
+
+	// Test: Without the field the first offer is used
+	got, err = Charset(req, h, "utf-8", "iso-8859-1")
+	require.NoError(t, err)
+	assert.Equal(t, "utf-8", got)
+
+	// Test: Nothing acceptable is a 406 that lists the offers
+	_, err = ContentType(req, nil, "text/html", "text/plain")
+	assert.ErrorIs(t, err, ErrNotAcceptable)
+	var out bytes.Buffer
+	w := response.NewWriter(&out)
+	require.NoError(t, NotAcceptable("Accept", "text/html", "text/plain").Write(w))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 406 Not Acceptable\r\n"))
+	assert.Contains(t, out.String(), "vary: Accept\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "available: text/html, text/plain\n"))
+}
@@ -0,0 +1,448 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tcp_http/internal/client"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// Strategy picks which upstream serves a request.
+type Strategy int
+
+const (
+	// RoundRobin cycles through the upstreams in order.
+	RoundRobin Strategy = iota
+	// LeastConnections picks the upstream with the fewest requests in
+	// flight.
+	LeastConnections
+	// ConsistentHash maps a request key to the same upstream for as long
+	// as that upstream is available, moving few keys when the set changes.
+	ConsistentHash
+)
+
+const (
+	DefaultRetries        = 2
+	DefaultMaxFails       = 3
+	DefaultEjectDuration  = 30 * time.Second
+	DefaultHealthTimeout  = 5 * time.Second
+	DefaultHealthInterval = 10 * time.Second
+	// DefaultMaxRetryBodySize caps the bodies held in memory for retries
+	// when BalancerOptions leaves it unset.
+	DefaultMaxRetryBodySize = 1 << 20
+)
+
+// virtualNodes is how many points each upstream gets on the hash ring.
+const virtualNodes = 100
+
+var ErrNoUpstreams = errors.New("no upstreams configured")
+
+type HealthCheck struct {
+	// Path is requested on every upstream; a 2xx or 3xx answer marks it
+	// healthy. Empty disables active checks.
+	Path string
+	// Interval between checks. Zero uses DefaultHealthInterval.
+	Interval time.Duration
+	// Timeout bounds one check. Zero uses DefaultHealthTimeout.
+	Timeout time.Duration
+}
+
+type BalancerOptions struct {
+	Strategy Strategy
+	// HashHeader and HashCookie name the request header or cookie whose
+	// value is the ConsistentHash key. The header wins when both are set;
+	// requests without either are keyed by client IP.
+	HashHeader  string
+	HashCookie  string
+	HealthCheck HealthCheck
+	// MaxFails is how many consecutive failed requests eject an upstream
+	// for EjectDuration. Zero uses DefaultMaxFails, a negative value
+	// disables passive ejection.
+	MaxFails      int
+	EjectDuration time.Duration
+	// Retries is how many other upstreams an idempotent request is tried
+	// on when an upstream cannot be reached. Zero uses DefaultRetries, a
+	// negative value disables retries.
+	Retries int
+	// MaxRetryBodySize caps the body of an idempotent request that is held
+	// in memory so it can be retried. A larger body, like that of a request
+	// that is not retried, is streamed to a single upstream. Zero uses
+	// DefaultMaxRetryBodySize.
+	MaxRetryBodySize int64
+	// Proxy configures the proxying to each upstream.
+	Proxy Options
+}
+
+type upstream struct {
+	proxy    *reverseProxy
+	active   atomic.Int64
+	requests atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+	lastCheck    time.Time
+	lastError    string
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+// Balancer spreads requests over several upstreams, keeping track of which
+// ones are healthy. Close stops its health checks.
+type Balancer struct {
+	upstreams []*upstream
+	options   BalancerOptions
+	ring      []ringNode
+	next      atomic.Uint64
+	checker   *client.Client
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type ringNode struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// NewBalancer returns a balancer over the upstream base URLs and starts
+// its health checks, if any.
+func NewBalancer(upstreams []string, options BalancerOptions) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+	b := &Balancer{options: options, done: make(chan struct{})}
+	for _, raw := range upstreams {
+		p, err := newReverseProxy(raw, options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", raw, err)
+		}
+		u := &upstream{proxy: p, healthy: true}
+		b.upstreams = append(b.upstreams, u)
+		for i := 0; i < virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(raw + "#" + strconv.Itoa(i)))
+			b.ring = append(b.ring, ringNode{hash: hash, upstream: u})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+
+	if options.HealthCheck.Path != "" {
+		timeout := options.HealthCheck.Timeout
+		if timeout == 0 {
+			timeout = DefaultHealthTimeout
+		}
+		b.checker = &client.Client{Timeout: timeout, MaxRedirects: -1}
+		go b.checkLoop()
+	}
+	return b, nil
+}
+
+func (b *Balancer) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
+
+func (b *Balancer) maxFails() int {
+	if b.options.MaxFails == 0 {
+		return DefaultMaxFails
+	}
+	return b.options.MaxFails
+}
+
+func (b *Balancer) retries() int {
+	if b.options.Retries == 0 {
+		return DefaultRetries
+	}
+	return max(b.options.Retries, 0)
+}
+
+// retryable reports whether req may be tried on more than one upstream,
+// which needs its body in memory.
+func (b *Balancer) retryable(req *request.Request) bool {
+	if !idempotent(req.RequestLine.Method) || b.retries() == 0 {
+		return false
+	}
+	if !req.BodyPending() {
+		return true
+	}
+	limit := b.options.MaxRetryBodySize
+	if limit == 0 {
+		limit = DefaultMaxRetryBodySize
+	}
+	length, _ := req.Headers.Get("Content-Length")
+	n, err := strconv.ParseInt(length, 10, 64)
+	return err == nil && n <= limit
+}
+
+// fail records a failed request, ejecting the upstream once it has failed
+// MaxFails times in a row.
+func (b *Balancer) fail(u *upstream, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	u.lastError = reason
+	if b.maxFails() > 0 && u.failures >= b.maxFails() {
+		duration := b.options.EjectDuration
+		if duration == 0 {
+			duration = DefaultEjectDuration
+		}
+		u.ejectedUntil = time.Now().Add(duration)
+		u.failures = 0
+	}
+}
+
+func (b *Balancer) succeed(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+}
+
+// pick chooses an available upstream that has not been tried yet, or nil.
+func (b *Balancer) pick(req *request.Request, tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	usable := func(u *upstream) bool {
+		return !tried[u] && u.available(now)
+	}
+	n := len(b.upstreams)
+
+	switch b.options.Strategy {
+	case ConsistentHash:
+		hash := crc32.ChecksumIEEE([]byte(b.hashKey(req)))
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+		for i := 0; i < len(b.ring); i++ {
+			if u := b.ring[(start+i)%len(b.ring)].upstream; usable(u) {
+				return u
+			}
+		}
+		return nil
+	case LeastConnections:
+		// Ties are broken round-robin so idle upstreams share the load.
+		offset := int(b.next.Add(1) - 1)
+		var best *upstream
+		for i := 0; i < n; i++ {
+			u := b.upstreams[(offset+i)%n]
+			if usable(u) && (best == nil || u.active.Load() < best.active.Load()) {
+				best = u
+			}
+		}
+		return best
+	default:
+		offset := int(b.next.Add(1) - 1)
+		for i := 0; i < n; i++ {
+			if u := b.upstreams[(offset+i)%n]; usable(u) {
+				return u
+			}
+		}
+		return nil
+	}
+}
+
+func (b *Balancer) hashKey(req *request.Request) string {
+	if b.options.HashHeader != "" {
+		if v, ok := req.Headers.Get(b.options.HashHeader); ok {
+			return v
+		}
+	}
+	if b.options.HashCookie != "" {
+		if v, ok := req.Cookie(b.options.HashCookie); ok {
+			return v
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// idempotent reports whether a request may be sent again (RFC 9110
+// section 9.2.2).
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// Handler proxies each request to an upstream chosen by the strategy.
+// Requests that find no available upstream get 503.
+func (b *Balancer) Handler() server.Handler {
+	return b.serve
+}
+
+func (b *Balancer) serve(w *response.Writer, req *request.Request) {
+	// Every upstream shares the proxy options.
+	if !b.upstreams[0].proxy.matches(req) {
+		notFound().Write(w)
+		return
+	}
+	// Only a request that may be retried has its body read up front; any
+	// other body is streamed upstream as the client sends it.
+	attempts := 1
+	if b.retryable(req) {
+		if _, err := req.ReadBody(); err != nil {
+			server.BodyError(err).Write(w)
+			return
+		}
+		attempts += b.retries()
+	}
+	tried := map[*upstream]bool{}
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		u := b.pick(req, tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+		u.requests.Add(1)
+		u.active.Add(1)
+		resp, err := u.proxy.forward(req)
+		var bodyErr *bodyError
+		if errors.As(err, &bodyErr) {
+			// The client, not the upstream, failed.
+			u.active.Add(-1)
+			server.BodyError(bodyErr.err).Write(w)
+			return
+		}
+		if err != nil {
+			u.active.Add(-1)
+			b.fail(u, err.Error())
+			lastErr = err
+			continue
+		}
+		switch resp.StatusLine.StatusCode {
+		case response.StatusBadGateway, response.StatusServiceUnavailable, response.StatusGatewayTimeout:
+			b.fail(u, fmt.Sprintf("status %d", resp.StatusLine.StatusCode))
+		default:
+			b.succeed(u)
+		}
+		relay(w, req, resp)
+		u.active.Add(-1)
+		return
+	}
+	if lastErr != nil {
+		upstreamError(lastErr).Write(w)
+		return
+	}
+	(&server.HandlerError{StatusCode: response.StatusServiceUnavailable, Message: "No upstream available"}).Write(w)
+}
+
+func (b *Balancer) checkLoop() {
+	interval := b.options.HealthCheck.Interval
+	if interval == 0 {
+		interval = DefaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.checkAll()
+		select {
+		case <-b.done:
+			b.checker.CloseIdleConnections()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Balancer) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range b.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.check(u)
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *Balancer) check(u *upstream) {
+	target := *u.proxy.upstream
+	target.Path = joinPath(target.Path, b.options.HealthCheck.Path)
+	target.RawPath = ""
+
+	reason := ""
+	resp, err := b.checker.Get(target.String())
+	if err != nil {
+		reason = err.Error()
+	} else {
+		resp.Body.Close()
+		if code := resp.StatusLine.StatusCode; code < 200 || code >= 400 {
+			reason = fmt.Sprintf("health check status %d", code)
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastCheck = time.Now()
+	u.healthy = reason == ""
+	if reason != "" {
+		u.lastError = reason
+	}
+}
+
+// UpstreamStatus is a snapshot of one upstream as the balancer sees it.
+type UpstreamStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Ejected   bool      `json:"ejected"`
+	Active    int64     `json:"active"`
+	Requests  int64     `json:"requests"`
+	Failures  int       `json:"consecutive_failures"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (b *Balancer) Status() []UpstreamStatus {
+	now := time.Now()
+	out := make([]UpstreamStatus, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		u.mu.Lock()
+		out = append(out, UpstreamStatus{
+			URL:       u.proxy.upstream.String(),
+			Healthy:   u.healthy,
+			Ejected:   now.Before(u.ejectedUntil),
+			Active:    u.active.Load(),
+			Requests:  u.requests.Load(),
+			Failures:  u.failures,
+			LastCheck: u.lastCheck,
+			LastError: u.lastError,
+		})
+		u.mu.Unlock()
+	}
+	return out
+}
+
+// AdminHandler serves Status as JSON.
+func (b *Balancer) AdminHandler() server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body, err := json.MarshalIndent(b.Status(), "", "  ")
+		if err != nil {
+			(&server.HandlerError{StatusCode: response.StatusInternalError, Message: err.Error()}).Write(w)
+			return
+		}
+		body = append(body, '\n')
+		h := response.GetDefaultHeaders(len(body))
+		h.Replace("Content-Type", "application/json")
+		h.Set("Cache-Control", "no-store")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/client"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// named answers every request with name, and /health with healthStatus.
+func named(name string, healthStatus *response.StatusCode) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		status := response.StatusOK
+		if req.RequestLine.RequestTarget == "/health" && healthStatus != nil {
+			status = *healthStatus
+		}
+		h := response.GetDefaultHeaders(len(name))
+		w.WriteStatusLine(status)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(name))
+	}
+}
+
+func deadUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func startBalancer(t *testing.T, upstreams []string, options BalancerOptions) (*Balancer, string) {
+	b, err := NewBalancer(upstreams, options)
+	require.NoError(t, err)
+	t.Cleanup(b.Close)
+	return b, startServer(t, b.Handler())
+}
+
+func fetch(t *testing.T, c *client.Client, url string, header ...string) (response.StatusCode, string) {
+	req, err := client.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Headers.Set(header[i], header[i+1])
+	}
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusLine.StatusCode, string(body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	upstreams := []string{
+		startServer(t, named("a", nil)),
+		startServer(t, named("b", nil)),
+		startServer(t, named("c", nil)),
+	}
+	_, front := startBalancer(t, upstreams, BalancerOptions{})
+	c := &client.Client{}
+
+	// Test: Requests cycle through the upstreams
+	seen := []string{}
+	for i := 0; i < 6; i++ {
+		_, body := fetch(t, c, front+"/")
+		seen = append(seen, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, seen)
+}
+
+func TestLeastConnections(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	slow := startServer(t, func(w *response.Writer, req *request.Request) {
+		close(entered)
+		<-release
+		named("slow", nil)(w, req)
+	})
+	upstreams := []string{slow, startServer(t, named("b", nil)), startServer(t, named("c", nil))}
+	_, front := startBalancer(t, upstreams, BalancerOptions{Strategy: LeastConnections})
+	c := &client.Client{}
+
+	done := make(chan string)
+	go func() {
+		_, body := fetch(t, c, front+"/")
+		done <- body
+	}()
+	<-entered
+
+	// Test: Busy upstream is skipped while others are idle
+	for i := 0; i < 4; i++ {
+		_, body := fetch(t, c, front+"/")
+		assert.NotEqual(t, "slow", body)
+	}
+	close(release)
+	assert.Equal(t, "slow", <-done)
+}
+
+func TestConsistentHash(t *testing.T) {
+	upstreams := []string{
+		startServer(t, named("a", nil)),
+		startServer(t, named("b", nil)),
+		startServer(t, named("c", nil)),
+	}
+	_, front := startBalancer(t, upstreams, BalancerOptions{
+		Strategy:   ConsistentHash,
+		HashHeader: "X-User",
+		HashCookie: "session",
+	})
+	c := &client.Client{}
+
+	// Test: The same key always lands on the same upstream
+	owners := map[string]bool{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"} {
+		_, first := fetch(t, c, front+"/", "X-User", user)
+		for i := 0; i < 3; i++ {
+			_, body := fetch(t, c, front+"/", "X-User", user)
+			assert.Equal(t, first, body, user)
+		}
+		owners[first] = true
+	}
+	assert.Greater(t, len(owners), 1)
+
+	// Test: Cookie key
+	_, first := fetch(t, c, front+"/", "Cookie", "theme=dark; session=abc123")
+	_, again := fetch(t, c, front+"/", "Cookie", "session=abc123")
+	assert.Equal(t, first, again)
+}
+
+func TestPassiveEjectionAndRetry(t *testing.T) {
+	dead := deadUpstream(t)
+	b, front := startBalancer(t, []string{dead, startServer(t, named("b", nil))}, BalancerOptions{MaxFails: 1})
+	c := &client.Client{}
+
+	// Test: Idempotent requests are retried on another upstream
+	for i := 0; i < 4; i++ {
+		status, body := fetch(t, c, front+"/")
+		assert.Equal(t, response.StatusOK, status)
+		assert.Equal(t, "b", body)
+	}
+
+	// Test: The failing upstream is ejected and shown as such
+	status := b.Status()
+	assert.True(t, status[0].Ejected)
+	assert.NotEmpty(t, status[0].LastError)
+	assert.Equal(t, int64(1), status[0].Requests)
+	assert.False(t, status[1].Ejected)
+	assert.Equal(t, int64(4), status[1].Requests)
+
+	// Test: POST is not retried
+	_, front = startBalancer(t, []string{dead, startServer(t, named("b", nil))}, BalancerOptions{})
+	resp, err := c.Post(front+"/", "text/plain", strings.NewReader("once"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: PUT is idempotent and retried with its body
+	_, front = startBalancer(t, []string{dead, startServer(t, named("b", nil))}, BalancerOptions{})
+	req, err := client.NewRequest("PUT", front+"/", strings.NewReader("twice"))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+
+	// Test: No upstream left
+	_, front = startBalancer(t, []string{dead}, BalancerOptions{MaxFails: 1})
+	status2, _ := fetch(t, c, front+"/")
+	assert.Equal(t, response.StatusBadGateway, status2)
+	status2, _ = fetch(t, c, front+"/")
+	assert.Equal(t, response.StatusServiceUnavailable, status2)
+}
+
+func TestBalancerStreamsBodies(t *testing.T) {
+	started := make(chan string, 1)
+	upstream := startStreamingServer(t, uploadEcho(started))
+
+	// Test: A POST is streamed to the upstream as the client sends it
+	b, err := NewBalancer([]string{upstream}, BalancerOptions{})
+	require.NoError(t, err)
+	t.Cleanup(b.Close)
+	front := startStreamingServer(t, b.Handler())
+	assert.Equal(t, "hello world 11", sendInTwo(t, front, "POST", "/upload", started))
+
+	// Test: So is an idempotent request whose body is too large to retry
+	b, err = NewBalancer([]string{upstream}, BalancerOptions{MaxRetryBodySize: 8})
+	require.NoError(t, err)
+	t.Cleanup(b.Close)
+	front = startStreamingServer(t, b.Handler())
+	assert.Equal(t, "hello world 11", sendInTwo(t, front, "PUT", "/upload", started))
+}
+
+func TestHealthChecks(t *testing.T) {
+	failing := response.StatusInternalError
+	upstreams := []string{
+		startServer(t, named("sick", &failing)),
+		startServer(t, named("well", nil)),
+	}
+	b, front := startBalancer(t, upstreams, BalancerOptions{
+		HealthCheck: HealthCheck{Path: "/health", Interval: 10 * time.Millisecond},
+	})
+	c := &client.Client{}
+
+	// Test: Upstream failing its health check stops getting traffic
+	require.Eventually(t, func() bool {
+		return !b.Status()[0].Healthy
+	}, time.Second, 5*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		_, body := fetch(t, c, front+"/")
+		assert.Equal(t, "well", body)
+	}
+
+	// Test: Admin view
+	admin := startServer(t, b.AdminHandler())
+	_, body := fetch(t, c, admin+"/")
+	var status []UpstreamStatus
+	require.NoError(t, json.Unmarshal([]byte(body), &status))
+	require.Len(t, status, 2)
+	assert.False(t, status[0].Healthy)
+	assert.Equal(t, "health check status 500", status[0].LastError)
+	assert.True(t, status[1].Healthy)
+	assert.False(t, status[1].LastCheck.IsZero())
+}
@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tcp_http/internal/client"
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+type ForwardOptions struct {
+	// AllowHosts limits the destinations clients may reach. An entry is a
+	// host name ("example.com"), a domain with its subdomains
+	// ("*.example.com") or an IP network in CIDR notation, which only
+	// matches destinations given as IP addresses. Empty allows every host.
+	AllowHosts []string
+	// AllowPorts limits the destination ports. Empty allows every port.
+	AllowPorts []int
+	// AllowPrivate lets clients reach loopback, private, link-local and
+	// other non-public addresses. They are refused by default, whatever
+	// the allow lists say, and the check is made on the address actually
+	// dialed, so a host name cannot point the proxy at them.
+	AllowPrivate bool
+	// Users maps user names to passwords for Basic Proxy-Authorization.
+	// Empty disables authentication.
+	Users map[string]string
+	// Realm is named in the Proxy-Authenticate challenge.
+	Realm string
+	// Timeout bounds each relayed exchange until the response head has
+	// arrived; the body is streamed for as long as it lasts. Zero uses
+	// DefaultTimeout. Tunnels are not bounded.
+	Timeout time.Duration
+	// DialTimeout bounds connecting to the destination. Zero uses
+	// client.DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Client sends relayed requests. Nil builds one from the options
+	// above; a custom client should not follow redirects and makes its own
+	// checks on the addresses it dials.
+	Client *client.Client
+}
+
+type forwardProxy struct {
+	options  ForwardOptions
+	client   *client.Client
+	networks []*net.IPNet
+}
+
+// NewForward returns a forward proxy handler. Requests with an
+// absolute-form target such as "GET http://example.com/ HTTP/1.1" are
+// relayed to their origin; CONNECT requests open a TCP tunnel to the
+// authority they name, which is how clients reach https origins through
+// the proxy. Destinations outside the allow lists get 403 and clients
+// without valid credentials 407.
+func NewForward(options ForwardOptions) server.Handler {
+	p := &forwardProxy{options: options, client: options.Client}
+	if p.client == nil {
+		timeout := options.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		p.client = &client.Client{
+			ResponseHeaderTimeout: timeout,
+			DialTimeout:           options.DialTimeout,
+			Control:               p.control(),
+			MaxRedirects:          -1,
+		}
+	}
+	for _, pattern := range options.AllowHosts {
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			p.networks = append(p.networks, network)
+		}
+	}
+	return p.serve
+}
+
+var errPrivateDestination = errors.New("destination address is not public")
+
+// control returns the dial check that keeps connections off non-public
+// addresses, or nil when they are allowed.
+func (p *forwardProxy) control() func(network, address string, c syscall.RawConn) error {
+	if p.options.AllowPrivate {
+		return nil
+	}
+	return func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip, err := netip.ParseAddr(host); err != nil || !publicIP(ip) {
+			return errPrivateDestination
+		}
+		return nil
+	}
+}
+
+// specialPurpose lists the address blocks that are not globally reachable,
+// after the IANA special-purpose registries (RFC 6890).
+var specialPurpose = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/127"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+var (
+	// nat64 and sixToFour carry an IPv4 address inside an IPv6 one
+	// (RFC 6052, RFC 3056).
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// publicIP reports whether ip can be a destination on the internet, as
+// opposed to this host, its local networks, a multicast group or a block
+// reserved for some other use. IPv6 forms that embed an IPv4 address are
+// judged by that address.
+func publicIP(ip netip.Addr) bool {
+	ip = ip.WithZone("").Unmap()
+	b := ip.As16()
+	switch {
+	case nat64.Contains(ip):
+		return publicIP(netip.AddrFrom4([4]byte(b[12:16])))
+	case sixToFour.Contains(ip):
+		return publicIP(netip.AddrFrom4([4]byte(b[2:6])))
+	}
+	for _, prefix := range specialPurpose {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsForwardRequest reports whether req is meant for a forward proxy rather
+// than for this server's own resources.
+func IsForwardRequest(req *request.Request) bool {
+	return req.RequestLine.Method == "CONNECT" || req.RequestLine.IsAbsoluteForm()
+}
+
+// allowed checks a destination against the allow lists.
+func (p *forwardProxy) allowed(host string, port int) bool {
+	if len(p.options.AllowPorts) > 0 {
+		found := false
+		for _, allowed := range p.options.AllowPorts {
+			found = found || allowed == port
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(p.options.AllowHosts) == 0 {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range p.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range p.options.AllowHosts {
+		pattern = strings.ToLower(pattern)
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *forwardProxy) authorized(req *request.Request) bool {
+	if len(p.options.Users) == 0 {
+		return true
+	}
+	value, _ := req.Headers.Get("Proxy-Authorization")
+	scheme, credentials, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, password, _ := strings.Cut(string(decoded), ":")
+	want, ok := p.options.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+func (p *forwardProxy) serve(w *response.Writer, req *request.Request) {
+	if !p.authorized(req) {
+		realm := p.options.Realm
+		if realm == "" {
+			realm = "proxy"
+		}
+		h := headers.NewHeaders()
+		h.Set("Proxy-Authenticate", "Basic realm="+strconv.Quote(realm))
+		(&server.HandlerError{StatusCode: response.StatusProxyAuthRequired, Message: "Proxy authentication required", Headers: h}).Write(w)
+		return
+	}
+	if req.RequestLine.Method == "CONNECT" {
+		p.tunnel(w, req)
+		return
+	}
+	p.relayRequest(w, req)
+}
+
+// relayRequest forwards an absolute-form request to its origin.
+func (p *forwardProxy) relayRequest(w *response.Writer, req *request.Request) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if !req.RequestLine.IsAbsoluteForm() || err != nil || u.Host == "" {
+		(&server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Absolute request target required"}).Write(w)
+		return
+	}
+	if u.Scheme != "http" {
+		(&server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Unsupported scheme, use CONNECT"}).Write(w)
+		return
+	}
+	port := 80
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil {
+			(&server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid port"}).Write(w)
+			return
+		}
+	}
+	if !p.allowed(u.Hostname(), port) {
+		(&server.HandlerError{StatusCode: response.StatusForbidden, Message: "Destination not allowed"}).Write(w)
+		return
+	}
+
+	out, body, err := newOutgoing(req, u.String())
+	var bodyErr *bodyError
+	if errors.As(err, &bodyErr) {
+		server.BodyError(bodyErr.err).Write(w)
+		return
+	}
+	if err != nil {
+		(&server.HandlerError{StatusCode: response.StatusBadRequest, Message: err.Error()}).Write(w)
+		return
+	}
+	out.Headers.Set("Via", via)
+	out.Headers.Replace("Host", u.Host)
+
+	resp, err := p.client.Do(out)
+	if err != nil && body != nil && body.err != nil {
+		server.BodyError(body.err).Write(w)
+		return
+	}
+	if errors.Is(err, errPrivateDestination) {
+		(&server.HandlerError{StatusCode: response.StatusForbidden, Message: "Destination not allowed"}).Write(w)
+		return
+	}
+	if err != nil {
+		upstreamError(err).Write(w)
+		return
+	}
+	relay(w, req, resp)
+}
+
+// tunnel connects to the CONNECT target and then copies bytes both ways
+// until either side is done.
+func (p *forwardProxy) tunnel(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+	host, portText, _ := net.SplitHostPort(target)
+	port, err := strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 65535 {
+		(&server.HandlerError{StatusCode: response.StatusBadRequest, Message: "Invalid port"}).Write(w)
+		return
+	}
+	if !p.allowed(host, port) {
+		(&server.HandlerError{StatusCode: response.StatusForbidden, Message: "Destination not allowed"}).Write(w)
+		return
+	}
+	dialTimeout := p.options.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = client.DefaultDialTimeout
+	}
+	dialer := net.Dialer{Timeout: dialTimeout, Control: p.control()}
+	upstream, err := dialer.Dial("tcp", target)
+	if errors.Is(err, errPrivateDestination) {
+		(&server.HandlerError{StatusCode: response.StatusForbidden, Message: "Destination not allowed"}).Write(w)
+		return
+	}
+	if err != nil {
+		upstreamError(err).Write(w)
+		return
+	}
+
+	// A 2xx answer to CONNECT has no body and must not carry framing
+	// headers (RFC 9110 section 9.3.6).
+	h := headers.NewHeaders()
+	h.Set("Via", via)
+	w.WriteStatusLineReason(response.StatusOK, "Connection Established")
+	if err := w.WriteHeaders(*h); err != nil {
+		upstream.Close()
+		return
+	}
+	conn, reader, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	pipe(conn, reader, upstream)
+}
+
+// pipe copies between the client and upstream connections. When one
+// direction ends its write side is shut so the peer sees EOF while the
+// other direction drains; connections that cannot half-close are closed
+// outright.
+func pipe(conn io.ReadWriteCloser, reader io.Reader, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+	copyAndShut := func(dst io.WriteCloser, src io.Reader) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+			upstream.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyAndShut(upstream, reader)
+	go copyAndShut(conn, upstream)
+	<-done
+	<-done
+	conn.Close()
+	upstream.Close()
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/response"
+)
+
+// rawRequest sends raw to addr and returns the response to method.
+func rawRequest(t *testing.T, addr, method, raw string) (*response.Response, string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	resp, err := response.NewReader(conn).ReadResponse(method)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+// startEcho listens for TCP connections and writes back whatever it reads.
+func startEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestForwardRelay(t *testing.T) {
+	origin := strings.TrimPrefix(startServer(t, echoRequest), "http://")
+	front := strings.TrimPrefix(startServer(t, NewForward(ForwardOptions{AllowPrivate: true})), "http://")
+
+	// Test: Absolute-form request is relayed in origin-form
+	resp, body := rawRequest(t, front, "GET", "GET http://"+origin+"/a?b=1 HTTP/1.1\r\nHost: "+origin+"\r\nProxy-Connection: keep-alive\r\nX-Test: yes\r\n\r\n")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	lines := strings.Split(body, "\n")
+	assert.Equal(t, "GET /a?b=1 ", lines[0])
+	assert.Contains(t, lines, "host: "+origin)
+	assert.Contains(t, lines, "via: 1.1 tcp_http")
+	assert.Contains(t, lines, "x-test: yes")
+	assert.NotContains(t, body, "proxy-connection")
+	assert.Equal(t, "1.1 tcp_http", headerValue(resp.Headers, "Via"))
+
+	// Test: Origin-form requests are not proxied
+	resp, _ = rawRequest(t, front, "GET", "GET /a HTTP/1.1\r\nHost: "+front+"\r\n\r\n")
+	assert.Equal(t, response.StatusBadRequest, resp.StatusLine.StatusCode)
+
+	// Test: Unreachable origin
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+	resp, _ = rawRequest(t, front, "GET", "GET http://"+closed+"/ HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+}
+
+func TestForwardStreamsBodies(t *testing.T) {
+	// Test: The origin gets the start of an upload before the client has
+	// sent the rest, with the client's Content-Length
+	started := make(chan string, 1)
+	origin := strings.TrimPrefix(startStreamingServer(t, uploadEcho(started)), "http://")
+	front := startStreamingServer(t, NewForward(ForwardOptions{AllowPrivate: true}))
+	assert.Equal(t, "hello world 11", sendInTwo(t, front, "POST", "http://"+origin+"/upload", started))
+}
+
+func TestConnectTunnel(t *testing.T) {
+	echo := startEcho(t)
+	front := strings.TrimPrefix(startServer(t, NewForward(ForwardOptions{AllowPrivate: true})), "http://")
+
+	// Test: Bytes flow both ways once the tunnel is established
+	conn, err := net.Dial("tcp", front)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\nhello"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.NotContains(t, strings.ToLower(line), "content-length")
+		if line == "\r\n" {
+			break
+		}
+	}
+	_, err = conn.Write([]byte(", tunnel"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	echoed, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, tunnel", string(echoed))
+
+	// Test: Unreachable target
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+	resp, _ := rawRequest(t, front, "CONNECT", "CONNECT "+closed+" HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+}
+
+func TestForwardAccessControl(t *testing.T) {
+	echo := startEcho(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(echoPort)
+
+	// Test: Destinations outside the allow lists are refused
+	front := strings.TrimPrefix(startServer(t, NewForward(ForwardOptions{
+		AllowHosts:   []string{"*.example.com", "127.0.0.0/8"},
+		AllowPorts:   []int{80, 443},
+		AllowPrivate: true,
+	})), "http://")
+	resp, _ := rawRequest(t, front, "CONNECT", "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+	resp, _ = rawRequest(t, front, "GET", "GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode)
+
+	p := &forwardProxy{options: ForwardOptions{AllowHosts: []string{"*.example.com", "Exact.org", "10.0.0.0/8"}}}
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	p.networks = append(p.networks, network)
+	assert.True(t, p.allowed("example.com", 443))
+	assert.True(t, p.allowed("api.EXAMPLE.com.", 443))
+	assert.False(t, p.allowed("badexample.com", 443))
+	assert.True(t, p.allowed("exact.org", 80))
+	assert.False(t, p.allowed("sub.exact.org", 80))
+	assert.True(t, p.allowed("10.1.2.3", 22))
+	assert.False(t, p.allowed("11.1.2.3", 22))
+
+	// Test: Non-public addresses are refused by default, also by name
+	front = strings.TrimPrefix(startServer(t, NewForward(ForwardOptions{})), "http://")
+	localhost := "localhost:" + echoPort
+	for _, target := range []string{echo, localhost} {
+		resp, _ = rawRequest(t, front, "CONNECT", "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode, target)
+		resp, _ = rawRequest(t, front, "GET", "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		assert.Equal(t, response.StatusForbidden, resp.StatusLine.StatusCode, target)
+	}
+	for _, ip := range []string{
+		"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "0.0.0.0", "0.1.2.3",
+		"100.64.0.1", "100.127.255.254", "198.18.0.1", "224.0.0.1", "255.255.255.255",
+		"::", "::1", "fe80::1", "fe80::1%eth0", "fd00::1", "ff02::1", "2001:db8::1",
+		"::ffff:127.0.0.1", "::ffff:169.254.169.254", "64:ff9b::7f00:1", "64:ff9b::a9fe:a9fe",
+		"2002:7f00:1::1",
+	} {
+		assert.False(t, publicIP(netip.MustParseAddr(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "100.128.0.1", "::ffff:93.184.216.34", "64:ff9b::5db8:d822", "2606:2800:220:1::1"} {
+		assert.True(t, publicIP(netip.MustParseAddr(ip)), ip)
+	}
+
+	// Test: Allowed destination goes through
+	front = strings.TrimPrefix(startServer(t, NewForward(ForwardOptions{
+		AllowHosts:   []string{"127.0.0.0/8"},
+		AllowPorts:   []int{port},
+		AllowPrivate: true,
+	})), "http://")
+	conn, err := net.Dial("tcp", front)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\n"))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+}
+
+func TestForwardAuthentication(t *testing.T) {
+	origin := strings.TrimPrefix(startServer(t, echoRequest), "http://")
+	front := strings.TrimPrefix(startServer(t, NewForward(ForwardOptions{
+		Users:        map[string]string{"alice": "secret"},
+		Realm:        "office",
+		AllowPrivate: true,
+	})), "http://")
+	send := func(credentials string) (*response.Response, string) {
+		raw := "GET http://" + origin + "/ HTTP/1.1\r\nHost: " + origin + "\r\n"
+		if credentials != "" {
+			raw += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+		}
+		return rawRequest(t, front, "GET", raw+"\r\n")
+	}
+
+	// Test: Missing or wrong credentials are challenged
+	resp, _ := send("")
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+	assert.Equal(t, `Basic realm="office"`, headerValue(resp.Headers, "Proxy-Authenticate"))
+	resp, _ = send("alice:wrong")
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+	resp, _ = send("bob:secret")
+	assert.Equal(t, response.StatusProxyAuthRequired, resp.StatusLine.StatusCode)
+
+	// Test: Valid credentials are accepted and not passed on
+	resp, body := send("alice:secret")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.NotContains(t, body, "proxy-authorization")
+}
@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp_http/internal/client"
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+// DefaultTimeout bounds the wait for an upstream response head when
+// Options.Timeout is zero.
+const DefaultTimeout = 30 * time.Second
+
+// via is the pseudonym added to the Via header of proxied messages.
+const via = "1.1 tcp_http"
+
+// hopByHop are the fields that describe a single connection and must not be
+// forwarded (RFC 9110 section 7.6.1). Fields named in Connection are
+// dropped as well.
+var hopByHop = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type Options struct {
+	// StripPrefix is removed from the request path before it is forwarded.
+	// Paths that do not start with it as whole segments get 404.
+	StripPrefix string
+	// Rewrite maps the request target, after StripPrefix, to the path and
+	// query sent upstream. It is appended to the upstream URL's path.
+	Rewrite func(target string) string
+	// PreserveHost forwards the client's Host header instead of the
+	// upstream's host.
+	PreserveHost bool
+	// Timeout bounds each upstream exchange until the response head has
+	// arrived, sending the request included. The response body is streamed
+	// for as long as it lasts, so event streams and long downloads are not
+	// cut off. Zero uses DefaultTimeout.
+	Timeout time.Duration
+	// DialTimeout bounds connecting to the upstream. Zero uses
+	// client.DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Client sends the upstream requests. Nil builds one from the timeouts
+	// above; a custom client should not follow redirects.
+	Client *client.Client
+}
+
+type reverseProxy struct {
+	upstream *url.URL
+	options  Options
+	client   *client.Client
+}
+
+// New returns a handler that forwards requests to upstream, an http or
+// https base URL such as "https://httpbin.org/api". The upstream status
+// and end-to-end headers are relayed as they are and the body is streamed
+// back to the client as it arrives. Connection failures are answered with
+// 502 and timeouts with 504.
+func New(upstream string, options Options) (server.Handler, error) {
+	p, err := newReverseProxy(upstream, options)
+	if err != nil {
+		return nil, err
+	}
+	return p.serve, nil
+}
+
+func newReverseProxy(upstream string, options Options) (*reverseProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, client.ErrUnsupportedScheme
+	}
+	p := &reverseProxy{upstream: u, options: options, client: options.Client}
+	if p.client == nil {
+		timeout := options.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		p.client = &client.Client{
+			ResponseHeaderTimeout: timeout,
+			DialTimeout:           options.DialTimeout,
+			MaxRedirects:          -1,
+		}
+	}
+	return p, nil
+}
+
+// removeHopByHop deletes the hop-by-hop fields of h, including any that
+// its Connection header lists.
+func removeHopByHop(h *headers.Headers) {
+	if connection, ok := h.Get("Connection"); ok {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Delete(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Delete(name)
+	}
+}
+
+func cloneHeaders(h *headers.Headers) *headers.Headers {
+	out := headers.NewHeaders()
+	h.ForEach(func(n, v string) {
+		out.Set(n, v)
+	})
+	return out
+}
+
+func joinPath(base, target string) string {
+	if target == "" || target[0] != '/' {
+		target = "/" + target
+	}
+	return strings.TrimSuffix(base, "/") + target
+}
+
+// stripPrefix removes StripPrefix from target. The prefix only matches
+// whole path segments, so "/api" does not forward "/apix" as "x".
+func (p *reverseProxy) stripPrefix(target string) (string, bool) {
+	rest, ok := strings.CutPrefix(target, strings.TrimSuffix(p.options.StripPrefix, "/"))
+	if !ok || rest != "" && rest[0] != '/' && rest[0] != '?' {
+		return "", false
+	}
+	return rest, true
+}
+
+// matches reports whether req is under StripPrefix.
+func (p *reverseProxy) matches(req *request.Request) bool {
+	_, ok := p.stripPrefix(req.RequestLine.RequestTarget)
+	return ok
+}
+
+// target returns the upstream URL for req, which must match.
+func (p *reverseProxy) target(req *request.Request) string {
+	target, _ := p.stripPrefix(req.RequestLine.RequestTarget)
+	if p.options.Rewrite != nil {
+		target = p.options.Rewrite(target)
+	}
+	u := *p.upstream
+	path, query, hasQuery := strings.Cut(target, "?")
+	u.Path = joinPath(p.upstream.Path, path)
+	u.RawPath = ""
+	u.RawQuery = p.upstream.RawQuery
+	if hasQuery {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += query
+	}
+	return u.String()
+}
+
+// clientBody records why reading the client's body failed while it was
+// streamed upstream, so that is not blamed on the upstream.
+type clientBody struct {
+	reader io.Reader
+	err    error
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// bodyError is a failure to read the client's request body.
+type bodyError struct {
+	err error
+}
+
+func (e *bodyError) Error() string {
+	return "reading request body: " + e.err.Error()
+}
+
+func (e *bodyError) Unwrap() error {
+	return e.err
+}
+
+// outgoing builds the upstream request, stamping the forwarding headers.
+func (p *reverseProxy) outgoing(req *request.Request) (*client.Request, *clientBody, error) {
+	out, body, err := newOutgoing(req, p.target(req))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		out.Headers.Set("X-Forwarded-For", host)
+	}
+	originalHost, _ := req.Headers.Get("Host")
+	out.Headers.Replace("X-Forwarded-Host", originalHost)
+	out.Headers.Replace("X-Forwarded-Proto", "http")
+	out.Headers.Set("Via", via)
+	if !p.options.PreserveHost {
+		out.Headers.Replace("Host", out.URL.Host)
+	}
+	return out, body, nil
+}
+
+func (p *reverseProxy) serve(w *response.Writer, req *request.Request) {
+	if !p.matches(req) {
+		notFound().Write(w)
+		return
+	}
+	resp, err := p.forward(req)
+	var bodyErr *bodyError
+	if errors.As(err, &bodyErr) {
+		server.BodyError(bodyErr.err).Write(w)
+		return
+	}
+	if err != nil {
+		upstreamError(err).Write(w)
+		return
+	}
+	relay(w, req, resp)
+}
+
+// forward sends req upstream and returns the response once its head has
+// arrived. A failure to read the client's body is returned as a
+// *bodyError. Nothing has been written to the client yet, so a failed
+// request whose body was read into memory can be retried elsewhere.
+func (p *reverseProxy) forward(req *request.Request) (*response.Response, error) {
+	out, body, err := p.outgoing(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(out)
+	if err != nil && body != nil && body.err != nil {
+		return nil, &bodyError{body.err}
+	}
+	return resp, err
+}
+
+// newOutgoing copies req for sending to target, without its hop-by-hop
+// fields. A body still pending on the client connection is streamed
+// upstream as the client sends it; one already read is replayed from
+// memory.
+func newOutgoing(req *request.Request, target string) (*client.Request, *clientBody, error) {
+	var body *clientBody
+	var outBody io.Reader
+	switch {
+	case req.BodyPending():
+		reader, err := req.BodyReader()
+		if err != nil {
+			return nil, nil, &bodyError{err}
+		}
+		body = &clientBody{reader: reader}
+		outBody = body
+	case len(req.Body) > 0:
+		// NewRequest sees the length of an in-memory body and can replay it.
+		outBody = strings.NewReader(req.Body)
+	}
+	out, err := client.NewRequest(req.RequestLine.Method, target, outBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A streamed body keeps its length unless it is being decoded.
+	if length, ok := req.Headers.Get("Content-Length"); ok && out.ContentLength < 0 {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil && n >= 0 {
+			out.ContentLength = n
+		}
+	}
+	out.Headers = cloneHeaders(req.Headers)
+	removeHopByHop(out.Headers)
+	return out, body, nil
+}
+
+// relay writes resp to the client, streaming its body.
+func relay(w *response.Writer, req *request.Request, resp *response.Response) {
+	defer resp.Body.Close()
+
+	h := cloneHeaders(resp.Headers)
+	removeHopByHop(h)
+	h.Set("Via", via)
+	// The body is framed by its length when the upstream gave one and
+	// chunked otherwise, so the client connection can be reused.
+	_, hasLength := h.Get("Content-Length")
+	chunked := !hasLength && hasBody(req, resp.StatusLine.StatusCode)
+	if chunked {
+		h.Replace("Transfer-Encoding", "chunked")
+	}
+
+	w.WriteStatusLineReason(resp.StatusLine.StatusCode, resp.StatusLine.ReasonPhrase)
+	if err := w.WriteHeaders(*h); err != nil {
+		return
+	}
+	// A body cut short must not look complete: the last chunk is left out
+	// and the connection is closed.
+	if err := stream(w, resp.Body); err != nil {
+		w.Abort()
+		return
+	}
+	if chunked {
+		w.WriteTrailers(*resp.Trailers)
+	}
+}
+
+func hasBody(req *request.Request, status response.StatusCode) bool {
+	if req.RequestLine.Method == "HEAD" {
+		return false
+	}
+	return status >= 200 && status != 204 && status != 304
+}
+
+// stream copies body to the client, flushing after every read so slow or
+// endless upstream bodies reach the client as they are produced.
+func stream(w *response.Writer, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteBody(buf[:n]); werr != nil {
+				return werr
+			}
+			if werr := w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func notFound() *server.HandlerError {
+	return &server.HandlerError{StatusCode: response.StatusNotFound, Message: "Not Found"}
+}
+
+func upstreamError(err error) *server.HandlerError {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &server.HandlerError{StatusCode: response.StatusGatewayTimeout, Message: "Upstream timed out"}
+	}
+	return &server.HandlerError{StatusCode: response.StatusBadGateway, Message: "Upstream unavailable"}
+}
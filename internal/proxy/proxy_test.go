@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/client"
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return "http://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+}
+
+// startStreamingServer is startServer with request bodies left on the
+// connection for the handler to stream.
+func startStreamingServer(t *testing.T, handler server.Handler) string {
+	s, err := server.ServeWithOptions(0, handler, server.Options{StreamRequestBodies: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return "http://127.0.0.1:" + strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+}
+
+// startProxy puts a reverse proxy for upstream in front of a new server.
+func startProxy(t *testing.T, upstream string, options Options) string {
+	handler, err := New(upstream, options)
+	require.NoError(t, err)
+	return startServer(t, handler)
+}
+
+// echoRequest answers with the request line and headers, one per line.
+func echoRequest(w *response.Writer, req *request.Request) {
+	lines := []string{req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.Body}
+	req.Headers.ForEach(func(n, v string) {
+		lines = append(lines, n+": "+v)
+	})
+	sort.Strings(lines[1:])
+	body := strings.Join(lines, "\n")
+	h := response.GetDefaultHeaders(len(body))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+func get(t *testing.T, url string) (*response.Response, string) {
+	resp, err := (&client.Client{MaxRedirects: -1}).Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func headerValue(h *headers.Headers, name string) string {
+	v, _ := h.Get(name)
+	return v
+}
+
+func TestForwardedRequest(t *testing.T) {
+	upstream := startServer(t, echoRequest)
+	front := startProxy(t, upstream+"/v1", Options{StripPrefix: "/api"})
+
+	// Test: Path is rewritten and forwarding headers are added
+	resp, body := get(t, front+"/api/users?id=1")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	lines := strings.Split(body, "\n")
+	assert.Equal(t, "GET /v1/users?id=1 ", lines[0])
+	assert.Contains(t, lines, "host: "+strings.TrimPrefix(upstream, "http://"))
+	assert.Contains(t, lines, "x-forwarded-for: 127.0.0.1")
+	assert.Contains(t, lines, "x-forwarded-host: "+strings.TrimPrefix(front, "http://"))
+	assert.Contains(t, lines, "x-forwarded-proto: http")
+	assert.Contains(t, lines, "via: 1.1 tcp_http")
+
+	// Test: The prefix must end at a segment boundary
+	resp, _ = get(t, front+"/apiusers")
+	assert.Equal(t, response.StatusNotFound, resp.StatusLine.StatusCode)
+	_, body = get(t, front+"/api?id=2")
+	assert.Equal(t, "GET /v1/?id=2 ", strings.Split(body, "\n")[0])
+
+	// Test: Methods other than GET and POST are relayed
+	for _, method := range []string{"PUT", "DELETE", "PATCH", "OPTIONS"} {
+		out, err := client.NewRequest(method, front+"/api/users/1", strings.NewReader("x"))
+		require.NoError(t, err)
+		resp, err = (&client.Client{}).Do(out)
+		require.NoError(t, err)
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, method+" /v1/users/1 x", strings.Split(string(raw), "\n")[0])
+	}
+
+	// Test: Hop-by-hop headers, including those named in Connection, are dropped
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("POST /api/form HTTP/1.1\r\nHost: example.com\r\nConnection: X-Secret\r\nX-Secret: 1\r\n" +
+		"Keep-Alive: timeout=5\r\nX-Forwarded-For: 10.0.0.1\r\nContent-Length: 4\r\n\r\ndata"))
+	r, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	raw, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	lines = strings.Split(string(raw), "\n")
+	assert.Equal(t, "POST /v1/form data", lines[0])
+	assert.Contains(t, lines, "x-forwarded-for: 10.0.0.1, 127.0.0.1")
+	assert.Contains(t, lines, "x-forwarded-host: example.com")
+	assert.NotContains(t, string(raw), "x-secret")
+	assert.NotContains(t, string(raw), "keep-alive")
+
+	// Test: Custom rewrite and preserved Host
+	front = startProxy(t, upstream, Options{
+		PreserveHost: true,
+		Rewrite:      func(target string) string { return strings.Replace(target, "/old/", "/new/", 1) },
+	})
+	_, body = get(t, front+"/old/page")
+	lines = strings.Split(body, "\n")
+	assert.Equal(t, "GET /new/page ", lines[0])
+	assert.Contains(t, lines, "host: "+strings.TrimPrefix(front, "http://"))
+}
+
+func TestRelayedResponse(t *testing.T) {
+	release := make(chan struct{})
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/teapot":
+			h := response.GetDefaultHeaders(5)
+			h.Set("X-Custom", "kept")
+			h.Set("Keep-Alive", "timeout=5")
+			w.WriteStatusLineReason(418, "I'm a teapot")
+			w.WriteHeaders(*h)
+			w.WriteBody([]byte("short"))
+		case "/stream":
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Total")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(*h)
+			w.WriteChunkedBody([]byte("first"))
+			w.Flush()
+			<-release
+			w.WriteChunkedBody([]byte(" second"))
+			trailer := headers.NewHeaders()
+			trailer.Set("X-Total", "2")
+			w.WriteTrailers(*trailer)
+		}
+	})
+	front := startProxy(t, upstream, Options{})
+
+	// Test: Upstream status, reason and end-to-end headers are kept
+	resp, body := get(t, front+"/teapot")
+	assert.Equal(t, response.StatusCode(418), resp.StatusLine.StatusCode)
+	assert.Equal(t, "I'm a teapot", resp.StatusLine.ReasonPhrase)
+	assert.Equal(t, "kept", headerValue(resp.Headers, "X-Custom"))
+	assert.Equal(t, "", headerValue(resp.Headers, "Keep-Alive"))
+	assert.Equal(t, "1.1 tcp_http", headerValue(resp.Headers, "Via"))
+	assert.Equal(t, "short", body)
+
+	// Test: Body is streamed before the upstream finishes, trailers follow
+	resp, err := (&client.Client{}).Get(front + "/stream")
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(buf))
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, " second", string(rest))
+	assert.Equal(t, "2", headerValue(resp.Trailers, "X-Total"))
+}
+
+// uploadEcho reads the first five bytes of the body, reports them on
+// started, and then answers with the whole body and its Content-Length.
+func uploadEcho(started chan<- string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body, err := req.BodyReader()
+		if err != nil {
+			return
+		}
+		first := make([]byte, 5)
+		if _, err := io.ReadFull(body, first); err != nil {
+			return
+		}
+		started <- string(first)
+		rest, err := io.ReadAll(body)
+		if err != nil {
+			return
+		}
+		length, _ := req.Headers.Get("Content-Length")
+		out := string(first) + string(rest) + " " + length
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(out)))
+		w.WriteBody([]byte(out))
+	}
+}
+
+// sendInTwo sends a request for target with an 11 byte body to front,
+// waits for the upstream to see its first five bytes before sending the
+// rest, and returns the response body.
+func sendInTwo(t *testing.T, front, method, target string, started <-chan string) string {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello"))
+	require.NoError(t, err)
+	select {
+	case first := <-started:
+		assert.Equal(t, "hello", first)
+	case <-time.After(time.Second):
+		t.Fatal("upstream did not see the start of the body")
+	}
+	_, err = conn.Write([]byte(" world"))
+	require.NoError(t, err)
+	resp, err := response.NewReader(conn).ReadResponse(method)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestStreamedRequestBody(t *testing.T) {
+	// Test: The upstream gets the start of an upload before the client has
+	// sent the rest
+	started := make(chan string, 1)
+	upstream := startStreamingServer(t, uploadEcho(started))
+	handler, err := New(upstream, Options{})
+	require.NoError(t, err)
+	front := startStreamingServer(t, handler)
+
+	assert.Equal(t, "hello world 11", sendInTwo(t, front, "POST", "/upload", started))
+
+	// Test: A client that stops sending gets 400, not 502
+	conn2, err := net.Dial("tcp", strings.TrimPrefix(front, "http://"))
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = conn2.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello"))
+	require.NoError(t, err)
+	<-started
+	require.NoError(t, conn2.(*net.TCPConn).CloseWrite())
+	resp, err := response.NewReader(conn2).ReadResponse("POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusBadRequest, resp.StatusLine.StatusCode)
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	// Test: Slow upstream is answered with 504
+	upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(300 * time.Millisecond)
+		echoRequest(w, req)
+	})
+	front := startProxy(t, upstream, Options{Timeout: 50 * time.Millisecond})
+	resp, _ := get(t, front+"/")
+	assert.Equal(t, response.StatusGatewayTimeout, resp.StatusLine.StatusCode)
+
+	// Test: The timeout ends with the head, so a slow body streams through
+	upstream = startServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		for i := 0; i < 3; i++ {
+			w.WriteBody([]byte("tick"))
+			w.Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	})
+	front = startProxy(t, upstream, Options{Timeout: 50 * time.Millisecond})
+	_, body := get(t, front+"/")
+	assert.Equal(t, strings.Repeat("tick", 3), body)
+
+	// Test: Unreachable upstream is answered with 502
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	front = startProxy(t, "http://"+addr, Options{})
+	resp, _ = get(t, front+"/")
+	assert.Equal(t, response.StatusBadGateway, resp.StatusLine.StatusCode)
+
+	// Test: A body cut short upstream is cut short for the client too
+	for _, head := range []string{"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n", "Content-Length: 10\r\n\r\nhello"} {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			conn, err := l.Accept()
+			l.Close()
+			if err != nil {
+				return
+			}
+			request.RequestFromReader(conn)
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+head)
+			conn.Close()
+		}()
+		front = startProxy(t, "http://"+l.Addr().String(), Options{})
+		resp, err = (&client.Client{}).Get(front + "/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.Error(t, err)
+		assert.Equal(t, "hello", string(body))
+	}
+
+	// Test: Bad upstream URL
+	_, err = New("ftp://example.com", Options{})
+	require.ErrorIs(t, err, client.ErrUnsupportedScheme)
+}
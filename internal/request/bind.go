@@ -0,0 +1,147 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultMaxFormSize = 10 << 20
+	DefaultMaxJSONSize = 1 << 20
+)
+
+var ErrUnsupportedMediaType = fmt.Errorf("unsupported content type")
+var ErrContentTooLarge = fmt.Errorf("request body exceeds the size limit")
+var ErrBadForm = fmt.Errorf("malformed form body")
+var ErrBadJSON = fmt.Errorf("malformed JSON body")
+
+// BindOptions tunes how a body is decoded by Form and BindJSON.
+type BindOptions struct {
+	// MaxSize caps the body. Zero uses DefaultMaxFormSize for forms and
+	// DefaultMaxJSONSize for JSON; a negative value means no limit.
+	MaxSize int64
+	// Strict rejects JSON objects with fields the target does not have and
+	// data after the JSON value.
+	Strict bool
+}
+
+func (o BindOptions) maxSize(fallback int64) int64 {
+	if o.MaxSize == 0 {
+		return fallback
+	}
+	return o.MaxSize
+}
+
+// MediaType returns the lowercased media type of the Content-Type header
+// without its parameters, or "" when there is none or it cannot be parsed.
+func (r *Request) MediaType() string {
+	value, ok := r.Headers.Get("Content-Type")
+	if !ok {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// boundedBody reads the body and checks it against the size cap. A body
+// declared too large is refused without being read, and a pending one is
+// streamed and given up on at the cap, so an oversized body is never held
+// in memory. A streamed body that fits is kept in Body.
+func (r *Request) boundedBody(limit int64) (string, error) {
+	if limit <= 0 {
+		return r.ReadBody()
+	}
+	// Content-Length gives the size of the body as sent, which is only the
+	// size of what is read when nothing decodes it.
+	if _, coded := r.Headers.Get("Content-Encoding"); !coded {
+		if value, ok := r.Headers.Get("Content-Length"); ok {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > limit {
+				return "", ErrContentTooLarge
+			}
+		}
+	}
+	if !r.BodyPending() {
+		body, err := r.ReadBody()
+		if err != nil {
+			return "", err
+		}
+		if int64(len(body)) > limit {
+			return "", ErrContentTooLarge
+		}
+		return body, nil
+	}
+	reader, err := r.BodyReader()
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > limit {
+		return "", ErrContentTooLarge
+	}
+	r.Body = string(data)
+	r.bodyError = nil
+	return r.Body, nil
+}
+
+// Form decodes an application/x-www-form-urlencoded body. A name that
+// appears more than once keeps every value in order.
+func (r *Request) Form(options BindOptions) (map[string][]string, error) {
+	if r.MediaType() != "application/x-www-form-urlencoded" {
+		return nil, ErrUnsupportedMediaType
+	}
+	body, err := r.boundedBody(options.maxSize(DefaultMaxFormSize))
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return nil, errors.Join(ErrBadForm, err)
+	}
+	return values, nil
+}
+
+// isJSON accepts application/json and structured types like
+// application/problem+json.
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" ||
+		strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+// BindJSON decodes a JSON body into v.
+func (r *Request) BindJSON(v any, options BindOptions) error {
+	if !isJSON(r.MediaType()) {
+		return ErrUnsupportedMediaType
+	}
+	body, err := r.boundedBody(options.maxSize(DefaultMaxJSONSize))
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(body))
+	if options.Strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Join(ErrBadJSON, err)
+	}
+	if options.Strict {
+		if _, err := dec.Token(); err != io.EOF {
+			return errors.Join(ErrBadJSON, errors.New("unexpected data after JSON value"))
+		}
+	}
+	return nil
+}
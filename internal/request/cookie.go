@@ -0,0 +1,41 @@
+package request
+
+import "strings"
+
+// Cookie is a name/value pair sent by the client in a Cookie header.
+type Cookie struct {
+	Name  string
+	Value string
+}
+
+// Cookies parses the Cookie header (RFC 6265 section 5.4). Pairs are
+// returned in the order sent, duplicates included; malformed ones are
+// skipped.
+func (r *Request) Cookies() []Cookie {
+	cookies := []Cookie{}
+	for _, line := range r.Headers.Values("Cookie") {
+		for _, pair := range strings.Split(line, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" || strings.ContainsAny(name, " \t\",") {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			cookies = append(cookies, Cookie{Name: name, Value: value})
+		}
+	}
+	return cookies
+}
+
+// Cookie returns the value of the first cookie with the given name.
+func (r *Request) Cookie(name string) (string, bool) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
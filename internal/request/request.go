@@ -1,9 +1,16 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 	"tcp_http/internal/headers"
@@ -14,6 +21,7 @@ type parserState string
 const (
 	stateInit           parserState = "init"
 	stateParsingHeaders parserState = "parsingHeaders"
+	stateBodyPending    parserState = "bodyPending"
 	stateParsingBody    parserState = "parsingBody"
 	stateDone           parserState = "done"
 	stateError          parserState = "errorState"
@@ -22,31 +30,121 @@ const (
 type Request struct {
 	RequestLine RequestLine
 	Headers     *headers.Headers
-	Body        string
+	// Body is empty until ReadBody is called when the request was parsed
+	// by ReadRequestHead and its body left on the connection.
+	Body string
+	// RemoteAddr is the client's address when the request came in over a
+	// network connection.
+	RemoteAddr string
 
-	state parserState
+	state      parserState
+	headOnly   bool
+	loadBody   func() error
+	streamBody func() (io.Reader, error)
+	bodyError  error
+	ctx        context.Context
+	// contentLength is the body length the headers declared.
+	contentLength int
 }
 
-func getIntHeader(headers *headers.Headers, name string, defaultValue int) int {
-	valueStr, exists := headers.Get(name)
-	if !exists {
-		return defaultValue
+// Context returns the request's context, which middleware uses to hand
+// values to the handlers it wraps.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
 	}
-	value, err := strconv.Atoi(valueStr)
-	if err != nil {
-		return defaultValue
+	return r.ctx
+}
+
+// SetContext replaces the request's context.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// parseContentLength returns the body length Content-Length declares, or 0
+// without one. A value that is not a non-negative number, or a list of
+// differing values from repeated fields, is an error (RFC 9112 section
+// 6.3): guessing at it would let the body be read as the next request.
+func parseContentLength(h *headers.Headers) (int, error) {
+	value, ok := h.Get("Content-Length")
+	if !ok {
+		return 0, nil
+	}
+	length := -1
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.TrimLeft(item, "0123456789") != "" {
+			return 0, ErrBadContentLength
+		}
+		n, err := strconv.Atoi(item)
+		if err != nil || length >= 0 && n != length {
+			return 0, ErrBadContentLength
+		}
+		length = n
 	}
-	return value
+	return length, nil
 }
 
 func (r *Request) hasBody() bool {
 	//TODO : Change for chunked encoding
-	length := getIntHeader(r.Headers, "content-length", 0)
-	return length > 0
+	return r.contentLength > 0
 }
 
 func (r *Request) done() bool {
-	return r.state == stateDone || r.state == stateError
+	return r.state == stateDone || r.state == stateError || r.state == stateBodyPending
+}
+
+// BodyPending reports whether the body is still on the connection.
+func (r *Request) BodyPending() bool {
+	return r.state == stateBodyPending
+}
+
+// SetBodyLoader makes the first ReadBody call run load, which is expected
+// to fill in Body. The server uses it to read a pending body only once the
+// handler asks for it.
+func (r *Request) SetBodyLoader(load func() error) {
+	r.loadBody = load
+}
+
+// ReadBody returns the request body, loading it first if it is still
+// pending. Handlers that may see "Expect: 100-continue" requests should
+// read the body through it rather than through the Body field.
+func (r *Request) ReadBody() (string, error) {
+	if r.loadBody != nil {
+		load := r.loadBody
+		r.loadBody = nil
+		r.bodyError = load()
+	}
+	if r.bodyError != nil {
+		return "", r.bodyError
+	}
+	return r.Body, nil
+}
+
+// SetBodyStream makes BodyReader call open while the body is still
+// pending, for a reader that streams it off the connection. The server
+// sets it alongside the loader of SetBodyLoader.
+func (r *Request) SetBodyStream(open func() (io.Reader, error)) {
+	r.streamBody = open
+}
+
+// BodyReader returns a reader for the request body. A body still on the
+// connection is streamed from it, without being held in memory; it can be
+// read only once, and ReadBody fails with ErrBodyStreamed afterwards. A
+// body already read is served from Body.
+func (r *Request) BodyReader() (io.Reader, error) {
+	if r.streamBody != nil && r.BodyPending() && r.bodyError == nil {
+		open := r.streamBody
+		r.streamBody = nil
+		r.loadBody = nil
+		r.bodyError = ErrBodyStreamed
+		return open()
+	}
+	body, err := r.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(body), nil
 }
 
 func newRequest() *Request {
@@ -65,41 +163,194 @@ type RequestLine struct {
 }
 
 func (r *RequestLine) validHTTP() bool {
-	return r.HttpVersion == "1.1"
+	return r.HttpVersion == "1.1" || r.HttpVersion == "1.0"
+}
+
+// validTarget checks the request target has the form the method calls for
+// (RFC 9112 section 3.2): authority-form "host:port" for CONNECT, otherwise
+// origin-form "/path?query" or absolute-form "http://host/path" as sent to
+// a proxy.
+func (r *RequestLine) validTarget() bool {
+	if r.Method == "CONNECT" {
+		host, port, err := net.SplitHostPort(r.RequestTarget)
+		return err == nil && host != "" && port != ""
+	}
+	return strings.HasPrefix(r.RequestTarget, "/") || r.IsAbsoluteForm()
+}
+
+// IsAbsoluteForm reports whether the target is a full URL, which is how
+// requests meant for a forward proxy name their destination.
+func (r *RequestLine) IsAbsoluteForm() bool {
+	scheme, rest, ok := strings.Cut(r.RequestTarget, "://")
+	return ok && scheme != "" && rest != "" && !strings.ContainsAny(scheme, "/?#")
 }
 
 var ErrBadReqLine = fmt.Errorf("invalid requestLine")
+var ErrUnsupportedEncoding = fmt.Errorf("unsupported content encoding")
+var ErrBodyTooLarge = fmt.Errorf("decoded body too large")
+var ErrBadEncoding = fmt.Errorf("malformed encoded body")
+var ErrBadContentLength = fmt.Errorf("invalid Content-Length")
 var ErrUnsupportedVersion = fmt.Errorf("upsupported http version")
 var ErrRequestInErrState = fmt.Errorf("request in error state")
+var ErrBodyStreamed = fmt.Errorf("request body already streamed")
 
 var SEPARATOR = []byte("\r\n")
 
+// validMethod reports whether method is a token (RFC 9110 section 9.1).
+// Any token is accepted; handlers answer methods they do not implement with
+// 405 or 501.
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for i := 0; i < len(method); i++ {
+		c := method[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+var ErrLineTooLong = fmt.Errorf("request line or header too long")
+
+const (
+	initialBufferSize = 1024
+	maxBufferSize     = 64 * 1024
+)
+
+// Reader parses requests from a connection. Bytes read past the end of a
+// request stay buffered and are returned by Read, so nothing is lost when the
+// connection is handed to another protocol.
+type Reader struct {
+	reader io.Reader
+	buf    []byte
+	bufLen int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, initialBufferSize),
+	}
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+func (rr *Reader) ReadRequest() (*Request, error) {
 	request := newRequest()
-	//Note : Buffer could get overrun ... a header that exceeds 1k could do that
-	//or the body
-	buf := make([]byte, 1024)
-	bufLen := 0
-	for !request.done() {
-		n, err := reader.Read(buf[bufLen:])
-		//TODO : what to do with the errors
+	if err := rr.read(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadRequestHead parses a request up to the end of its headers and leaves
+// any body on the connection, to be read later with ReadBody.
+func (rr *Reader) ReadRequestHead() (*Request, error) {
+	request := newRequest()
+	request.headOnly = true
+	if err := rr.read(request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadBody reads the pending body of a request returned by
+// ReadRequestHead. It does nothing if the body has been read already.
+func (rr *Reader) ReadBody(request *Request) error {
+	if request.state != stateBodyPending {
+		return nil
+	}
+	request.state = stateParsingBody
+	return rr.read(request)
+}
+
+func (rr *Reader) read(request *Request) error {
+	for {
+		readN, err := request.parse(rr.buf[:rr.bufLen])
 		if err != nil {
-			return nil, err
+			return err
+		}
+		copy(rr.buf, rr.buf[readN:rr.bufLen])
+		rr.bufLen -= readN
+
+		if request.done() {
+			return nil
 		}
 
-		bufLen += n
-		readN, err := request.parse(buf[:bufLen])
+		// A single line that does not fit grows the buffer, up to a limit.
+		if rr.bufLen == len(rr.buf) {
+			if len(rr.buf) >= maxBufferSize {
+				return ErrLineTooLong
+			}
+			rr.buf = append(rr.buf, make([]byte, len(rr.buf))...)
+		}
 
+		n, err := rr.reader.Read(rr.buf[rr.bufLen:])
+		//TODO : what to do with the errors
 		if err != nil {
-			return nil, err
+			return err
 		}
+		rr.bufLen += n
+	}
+}
 
-		copy(buf, buf[readN:bufLen])
-		bufLen -= readN
+// BodyReader returns a reader that streams the pending body of a request
+// returned by ReadRequestHead straight off the connection, up to its
+// Content-Length. The request stays pending until the reader has returned
+// io.EOF. A request whose body is not pending gets a reader over Body.
+func (rr *Reader) BodyReader(request *Request) io.Reader {
+	if request.state != stateBodyPending {
+		return strings.NewReader(request.Body)
+	}
+	return &bodyStream{reader: rr, request: request, remaining: int64(request.contentLength)}
+}
 
+// bodyStream reads a pending request body through the Reader, so bytes
+// already buffered come first.
+type bodyStream struct {
+	reader    *Reader
+	request   *Request
+	remaining int64
+}
+
+func (b *bodyStream) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		b.request.state = stateDone
+		return 0, io.EOF
 	}
-	return request, nil
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.reader.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF && b.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && b.remaining == 0 {
+		b.request.state = stateDone
+	}
+	return n, err
+}
 
+// Buffered returns the number of bytes read from the connection that have
+// not been consumed by a request yet.
+func (rr *Reader) Buffered() int {
+	return rr.bufLen
+}
+
+// Read drains the buffered bytes first and then reads from the connection.
+func (rr *Reader) Read(p []byte) (int, error) {
+	if rr.bufLen == 0 {
+		return rr.reader.Read(p)
+	}
+	n := copy(p, rr.buf[:rr.bufLen])
+	copy(rr.buf, rr.buf[n:rr.bufLen])
+	rr.bufLen -= n
+	return n, nil
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -131,7 +382,15 @@ outer:
 				return 0, err
 			}
 			if done {
-				if r.hasBody() {
+				length, err := parseContentLength(r.Headers)
+				if err != nil {
+					r.state = stateError
+					return 0, err
+				}
+				r.contentLength = length
+				if r.hasBody() && r.headOnly {
+					r.state = stateBodyPending
+				} else if r.hasBody() {
 					r.state = stateParsingBody
 
 				} else {
@@ -143,7 +402,7 @@ outer:
 			}
 			read += n
 		case stateParsingBody:
-			length := getIntHeader(r.Headers, "Content-Length", 0)
+			length := r.contentLength
 			if length == 0 {
 				r.state = stateDone
 			}
@@ -153,7 +412,7 @@ outer:
 			if len(r.Body) == length {
 				r.state = stateDone
 			}
-		case stateDone:
+		case stateDone, stateBodyPending:
 			break outer
 		default:
 			panic("No state found")
@@ -178,7 +437,7 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	if len(parts) != 3 {
 		return nil, 0, ErrBadReqLine
 	}
-	if string(parts[0]) != "GET" && string(parts[0]) != "POST" {
+	if !validMethod(string(parts[0])) {
 		return nil, 0, ErrBadReqLine
 	}
 
@@ -196,6 +455,133 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	if !reqLine.validHTTP() {
 		return nil, 0, ErrUnsupportedVersion
 	}
+	if !reqLine.validTarget() {
+		return nil, 0, ErrBadReqLine
+	}
 
 	return reqLine, read, nil
 }
+
+// decoders undo the content-codings a client may apply to a request body.
+var decoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": newDeflateReader,
+}
+
+// newDeflateReader reads "deflate" bodies. The name means zlib framing, but
+// some clients send raw deflate data, so that is accepted as well.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// contentCodings returns the codings of the Content-Encoding header other
+// than identity, or ErrUnsupportedEncoding when one has no decoder.
+func (r *Request) contentCodings() ([]string, error) {
+	value, _ := r.Headers.Get("Content-Encoding")
+	codings := []string{}
+	for _, c := range strings.Split(value, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == "" || c == "identity" {
+			continue
+		}
+		if _, ok := decoders[c]; !ok {
+			return nil, ErrUnsupportedEncoding
+		}
+		codings = append(codings, c)
+	}
+	return codings, nil
+}
+
+// DecodeBody replaces a body sent with a Content-Encoding by its decoded
+// form and updates the headers to match. Codings are undone in reverse order
+// of application. limit caps the decoded size so a small compressed upload
+// cannot expand without bound; a limit <= 0 means no limit.
+func (r *Request) DecodeBody(limit int64) error {
+	if _, ok := r.Headers.Get("Content-Encoding"); !ok {
+		return nil
+	}
+	codings, err := r.contentCodings()
+	if err != nil {
+		return err
+	}
+
+	body := []byte(r.Body)
+	for i := len(codings) - 1; i >= 0; i-- {
+		dec, err := decoders[codings[i]](bytes.NewReader(body))
+		if err != nil {
+			return errors.Join(ErrBadEncoding, err)
+		}
+		var src io.Reader = dec
+		if limit > 0 {
+			src = io.LimitReader(dec, limit+1)
+		}
+		decoded, err := io.ReadAll(src)
+		dec.Close()
+		if err != nil {
+			return errors.Join(ErrBadEncoding, err)
+		}
+		if limit > 0 && int64(len(decoded)) > limit {
+			return ErrBodyTooLarge
+		}
+		body = decoded
+	}
+
+	r.Body = string(body)
+	r.Headers.Delete("Content-Encoding")
+	r.Headers.Replace("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// DecodeReader is DecodeBody for a body that is streamed: it wraps body in
+// decoders for the Content-Encoding instead of decoding it up front. The
+// decoded length is not known, so Content-Length is dropped. Decoding
+// errors, and a decoded body growing past limit, surface from Read.
+func (r *Request) DecodeReader(body io.Reader, limit int64) (io.Reader, error) {
+	if _, ok := r.Headers.Get("Content-Encoding"); !ok {
+		return body, nil
+	}
+	codings, err := r.contentCodings()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		dec, err := decoders[codings[i]](body)
+		if err != nil {
+			return nil, errors.Join(ErrBadEncoding, err)
+		}
+		body = dec
+	}
+	r.Headers.Delete("Content-Encoding")
+	r.Headers.Delete("Content-Length")
+	return &decodedReader{reader: body, limit: limit}, nil
+}
+
+// decodedReader enforces the decoded size limit on a streamed body and marks
+// decoding errors.
+type decodedReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (d *decodedReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	d.read += int64(n)
+	if d.limit > 0 && d.read > d.limit {
+		return 0, ErrBodyTooLarge
+	}
+	if err != nil && err != io.EOF {
+		err = errors.Join(ErrBadEncoding, err)
+	}
+	return n, err
+}
@@ -1,7 +1,13 @@
 package request
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"io"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,6 +60,43 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
+
+	// Test: Absolute-form target for a proxy
+	r, err = RequestFromReader(strings.NewReader("GET http://example.com/a?b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/a?b", r.RequestLine.RequestTarget)
+	assert.True(t, r.RequestLine.IsAbsoluteForm())
+
+	// Test: CONNECT with an authority-form target
+	r, err = RequestFromReader(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "CONNECT", r.RequestLine.Method)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+	assert.False(t, r.RequestLine.IsAbsoluteForm())
+
+	// Test: HTTP/1.0 is accepted, later versions are not
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/2.0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// Test: Any token is a method
+	for _, method := range []string{"PUT", "DELETE", "PATCH", "OPTIONS", "PROPFIND"} {
+		r, err = RequestFromReader(strings.NewReader(method + " /item HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		require.NoError(t, err, method)
+		assert.Equal(t, method, r.RequestLine.Method)
+	}
+	for _, line := range []string{" / HTTP/1.1", "GE(T / HTTP/1.1", "G\x80T / HTTP/1.1"} {
+		_, err = RequestFromReader(strings.NewReader(line + "\r\nHost: example.com\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrBadReqLine, line)
+	}
+
+	// Test: Target that does not fit the method
+	for _, line := range []string{"CONNECT / HTTP/1.1", "CONNECT example.com HTTP/1.1", "GET example.com:443 HTTP/1.1", "GET coffee HTTP/1.1"} {
+		_, err = RequestFromReader(strings.NewReader(line + "\r\nHost: example.com\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrBadReqLine, line)
+	}
 }
 
 func TestRequest(t *testing.T) {
@@ -107,4 +150,355 @@ func TestBody(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+
+	// Test: Content-Length must be one non-negative number
+	for _, length := range []string{"abc", "-1", "+5", "5, 10", "5,", "0x10"} {
+		_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + length + "\r\n\r\nhello"))
+		assert.ErrorIs(t, err, ErrBadContentLength, length)
+	}
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", r.Body)
+}
+
+func TestReader(t *testing.T) {
+	// Test: Bytes after the request stay buffered
+	reader := &chunkReader{
+		data:            "GET /chat HTTP/1.1\r\nHost: localhost:42069\r\n\r\nraw protocol bytes",
+		numBytesPerRead: 100,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/chat", r.RequestLine.RequestTarget)
+	assert.Equal(t, len("raw protocol bytes"), rr.Buffered())
+	rest, err := io.ReadAll(rr)
+	require.NoError(t, err)
+	assert.Equal(t, "raw protocol bytes", string(rest))
+
+	// Test: Header longer than the initial buffer
+	long := strings.Repeat("a", 3000)
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: " + long + "\r\n\r\n",
+		numBytesPerRead: 512,
+	}
+	r, err = NewReader(reader).ReadRequest()
+	require.NoError(t, err)
+	value, _ := r.Headers.Get("x-long")
+	assert.Equal(t, long, value)
+
+	// Test: Header longer than the maximum buffer
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 70*1024) + "\r\n\r\n",
+		numBytesPerRead: 4096,
+	}
+	_, err = NewReader(reader).ReadRequest()
+	require.ErrorIs(t, err, ErrLineTooLong)
+}
+
+func TestBodyReader(t *testing.T) {
+	// Test: A pending body is streamed off the connection and the next
+	// request follows it
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 11\r\n\r\n" +
+			"hello worldGET /next HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	rr := NewReader(reader)
+	r, err := rr.ReadRequestHead()
+	require.NoError(t, err)
+	require.True(t, r.BodyPending())
+	body := rr.BodyReader(r)
+	first := make([]byte, 5)
+	_, err = io.ReadFull(body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(first))
+	assert.True(t, r.BodyPending())
+	rest, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, " world", string(rest))
+	assert.False(t, r.BodyPending())
+	assert.Equal(t, "", r.Body)
+	next, err := rr.ReadRequestHead()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", next.RequestLine.RequestTarget)
+
+	// Test: Request.BodyReader uses the stream once, then ReadBody fails
+	rr = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi"))
+	r, err = rr.ReadRequestHead()
+	require.NoError(t, err)
+	r.SetBodyStream(func() (io.Reader, error) {
+		return rr.BodyReader(r), nil
+	})
+	body, err = r.BodyReader()
+	require.NoError(t, err)
+	all, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(all))
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrBodyStreamed)
+
+	// Test: A body already read is served from memory
+	r = postWithType(t, "text/plain", "in memory")
+	body, err = r.BodyReader()
+	require.NoError(t, err)
+	all, err = io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "in memory", string(all))
+
+	// Test: Truncated body
+	rr = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nshort"))
+	r, err = rr.ReadRequestHead()
+	require.NoError(t, err)
+	_, err = io.ReadAll(rr.BodyReader(r))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func gzipString(t *testing.T, s string) string {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.String()
+}
+
+func postWithEncoding(t *testing.T, encoding, body string) *Request {
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Encoding: " + encoding + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	return r
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := `{"message": "` + strings.Repeat("hello ", 200) + `"}`
+
+	// Test: gzip
+	r := postWithEncoding(t, "gzip", gzipString(t, payload))
+	require.NoError(t, r.DecodeBody(0))
+	assert.Equal(t, payload, r.Body)
+	_, ok := r.Headers.Get("content-encoding")
+	assert.False(t, ok)
+	length, _ := r.Headers.Get("content-length")
+	assert.Equal(t, strconv.Itoa(len(payload)), length)
+
+	// Test: deflate with zlib framing and raw
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	zw.Write([]byte(payload))
+	zw.Close()
+	r = postWithEncoding(t, "deflate", buf.String())
+	require.NoError(t, r.DecodeBody(0))
+	assert.Equal(t, payload, r.Body)
+
+	buf.Reset()
+	fw, _ := flate.NewWriter(buf, flate.DefaultCompression)
+	fw.Write([]byte(payload))
+	fw.Close()
+	r = postWithEncoding(t, "deflate", buf.String())
+	require.NoError(t, r.DecodeBody(0))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: Stacked codings are undone in reverse order
+	r = postWithEncoding(t, "gzip, identity, gzip", gzipString(t, gzipString(t, payload)))
+	require.NoError(t, r.DecodeBody(0))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: Unsupported coding
+	r = postWithEncoding(t, "br", "whatever")
+	require.ErrorIs(t, r.DecodeBody(0), ErrUnsupportedEncoding)
+
+	// Test: Zip bomb is cut off at the limit
+	r = postWithEncoding(t, "gzip", gzipString(t, strings.Repeat("0", 1<<20)))
+	require.ErrorIs(t, r.DecodeBody(64*1024), ErrBodyTooLarge)
+
+	// Test: Corrupt data
+	r = postWithEncoding(t, "gzip", "not gzip at all")
+	require.ErrorIs(t, r.DecodeBody(0), ErrBadEncoding)
+}
+
+func TestDecodeReader(t *testing.T) {
+	payload := strings.Repeat("streamed ", 500)
+
+	// Test: A streamed gzip body is decoded as it is read
+	r := postWithEncoding(t, "gzip", gzipString(t, payload))
+	body, err := r.DecodeReader(strings.NewReader(r.Body), 0)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(decoded))
+	_, ok := r.Headers.Get("content-encoding")
+	assert.False(t, ok)
+	_, ok = r.Headers.Get("content-length")
+	assert.False(t, ok)
+
+	// Test: Limit and corrupt data surface from Read
+	r = postWithEncoding(t, "gzip", gzipString(t, payload))
+	body, err = r.DecodeReader(strings.NewReader(r.Body), 100)
+	require.NoError(t, err)
+	_, err = io.ReadAll(body)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	r = postWithEncoding(t, "gzip", "not gzip at all")
+	_, err = r.DecodeReader(strings.NewReader(r.Body), 0)
+	require.ErrorIs(t, err, ErrBadEncoding)
+
+	r = postWithEncoding(t, "br", "whatever")
+	_, err = r.DecodeReader(strings.NewReader(r.Body), 0)
+	require.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func postWithType(t *testing.T, contentType, body string) *Request {
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: " + contentType + "\r\n" +
+			"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+			"\r\n" + body,
+		numBytesPerRead: 7,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	return r
+}
+
+func TestForm(t *testing.T) {
+	// Test: Repeated names keep every value
+	r := postWithType(t, "application/x-www-form-urlencoded; charset=utf-8", "name=Ada+Lovelace&tag=a&tag=b%26c&empty=")
+	values, err := r.Form(BindOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Ada Lovelace"}, values["name"])
+	assert.Equal(t, []string{"a", "b&c"}, values["tag"])
+	assert.Equal(t, []string{""}, values["empty"])
+
+	// Test: Wrong Content-Type
+	r = postWithType(t, "application/json", "name=x")
+	_, err = r.Form(BindOptions{})
+	assert.ErrorIs(t, err, ErrUnsupportedMediaType)
+
+	// Test: Bad escape
+	r = postWithType(t, "application/x-www-form-urlencoded", "name=%zz")
+	_, err = r.Form(BindOptions{})
+	assert.ErrorIs(t, err, ErrBadForm)
+
+	// Test: Size cap
+	r = postWithType(t, "application/x-www-form-urlencoded", "name=0123456789")
+	_, err = r.Form(BindOptions{MaxSize: 8})
+	assert.ErrorIs(t, err, ErrContentTooLarge)
+
+	// Test: A body declared too large is refused without being read
+	r, err = NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: 100000\r\n\r\n")).ReadRequestHead()
+	require.NoError(t, err)
+	r.SetBodyLoader(func() error {
+		t.Error("body was read")
+		return nil
+	})
+	_, err = r.Form(BindOptions{MaxSize: 16})
+	assert.ErrorIs(t, err, ErrContentTooLarge)
+
+	// Test: A pending body is streamed, stopping at the cap
+	for _, size := range []int{8, 1000} {
+		rr := NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\nContent-Encoding: gzip\r\nContent-Length: 2\r\n\r\nhi"))
+		r, err = rr.ReadRequestHead()
+		require.NoError(t, err)
+		decoded := &countingReader{reader: strings.NewReader("name=" + strings.Repeat("a", size))}
+		r.SetBodyStream(func() (io.Reader, error) {
+			return decoded, nil
+		})
+		values, err = r.Form(BindOptions{MaxSize: 16})
+		if size > 16 {
+			assert.ErrorIs(t, err, ErrContentTooLarge)
+			assert.LessOrEqual(t, decoded.read, 17)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, []string{"aaaaaaaa"}, values["name"])
+		body, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, "name=aaaaaaaa", body)
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestBindJSON(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	// Test: Decodes into a struct, ignoring unknown fields by default
+	r := postWithType(t, "application/json", `{"name": "widget", "count": 3, "extra": true}`)
+	var p payload
+	require.NoError(t, r.BindJSON(&p, BindOptions{}))
+	assert.Equal(t, payload{Name: "widget", Count: 3}, p)
+
+	// Test: +json media types are accepted
+	r = postWithType(t, "application/merge-patch+json", `{"count": 4}`)
+	require.NoError(t, r.BindJSON(&p, BindOptions{}))
+	assert.Equal(t, 4, p.Count)
+
+	// Test: Strict mode rejects unknown fields and trailing data
+	r = postWithType(t, "application/json", `{"name": "widget", "extra": true}`)
+	assert.ErrorIs(t, r.BindJSON(&p, BindOptions{Strict: true}), ErrBadJSON)
+	r = postWithType(t, "application/json", `{"name": "widget"} {"name": "again"}`)
+	assert.ErrorIs(t, r.BindJSON(&p, BindOptions{Strict: true}), ErrBadJSON)
+	r = postWithType(t, "application/json", "{\"name\": \"widget\"}\r\n")
+	assert.NoError(t, r.BindJSON(&p, BindOptions{Strict: true}))
+
+	// Test: Malformed JSON, wrong type and oversized bodies
+	r = postWithType(t, "application/json", `{"name": `)
+	assert.ErrorIs(t, r.BindJSON(&p, BindOptions{}), ErrBadJSON)
+	r = postWithType(t, "application/json", `{"count": "three"}`)
+	assert.ErrorIs(t, r.BindJSON(&p, BindOptions{}), ErrBadJSON)
+	r = postWithType(t, "text/plain", `{}`)
+	assert.ErrorIs(t, r.BindJSON(&p, BindOptions{}), ErrUnsupportedMediaType)
+	r = postWithType(t, "application/json", `{"name": "widget"}`)
+	assert.ErrorIs(t, r.BindJSON(&p, BindOptions{MaxSize: 4}), ErrContentTooLarge)
+}
+
+func TestCookies(t *testing.T) {
+	reader := &chunkReader{
+		data: "GET / HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Cookie: session=abc123; theme=\"dark\"; bad; =empty\r\n" +
+			"Cookie: session=second\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+
+	// Test: Pairs are returned in order, malformed ones skipped
+	assert.Equal(t, []Cookie{
+		{Name: "session", Value: "abc123"},
+		{Name: "theme", Value: "dark"},
+		{Name: "session", Value: "second"},
+	}, r.Cookies())
+
+	// Test: Lookup by name returns the first match
+	value, ok := r.Cookie("session")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", value)
+	_, ok = r.Cookie("missing")
+	assert.False(t, ok)
 }
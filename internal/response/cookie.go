@@ -0,0 +1,135 @@
+package response
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"tcp_http/internal/headers"
+	"time"
+)
+
+var ErrInvalidCookie = errors.New("invalid cookie")
+
+// SameSite is the SameSite attribute of a cookie.
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a cookie to set on the client (RFC 6265 section 4.1).
+type Cookie struct {
+	Name  string
+	Value string
+	// Expires is left out when zero.
+	Expires time.Time
+	// MaxAge is left out when zero; a negative value deletes the cookie by
+	// sending Max-Age=0.
+	MaxAge      int
+	Domain      string
+	Path        string
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validCookieValue checks for cookie-octets, optionally wrapped in double
+// quotes.
+func validCookieValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for _, c := range value {
+		if c <= ' ' || c >= 0x7f || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// validAttribute checks a Domain or Path value, which may not contain
+// control characters or end the attribute early.
+func validAttribute(value string) bool {
+	for _, c := range value {
+		if c < ' ' || c == 0x7f || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the cookie as a Set-Cookie value.
+func (c *Cookie) String() (string, error) {
+	if !validCookieName(c.Name) || !validCookieValue(c.Value) ||
+		!validAttribute(c.Domain) || !validAttribute(c.Path) {
+		return "", ErrInvalidCookie
+	}
+	// Browsers drop SameSite=None and partitioned cookies that are not
+	// Secure.
+	if (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure {
+		return "", ErrInvalidCookie
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + c.Value)
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(TimeFormat))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String(), nil
+}
+
+// SetCookie adds the cookie to h as a Set-Cookie line of its own.
+func SetCookie(h *headers.Headers, c *Cookie) error {
+	value, err := c.String()
+	if err != nil {
+		return err
+	}
+	h.Add("Set-Cookie", value)
+	return nil
+}
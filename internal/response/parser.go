@@ -0,0 +1,405 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"tcp_http/internal/headers"
+)
+
+type parserState string
+
+const (
+	stateInit             parserState = "init"
+	stateParsingHeaders   parserState = "parsingHeaders"
+	stateParsingBody      parserState = "parsingBody"
+	stateParsingChunkSize parserState = "parsingChunkSize"
+	stateParsingChunkData parserState = "parsingChunkData"
+	stateParsingChunkEnd  parserState = "parsingChunkEnd"
+	stateParsingTrailers  parserState = "parsingTrailers"
+	stateReadUntilClose   parserState = "readUntilClose"
+	stateDone             parserState = "done"
+	stateError            parserState = "errorState"
+)
+
+var ErrBadStatusLine = fmt.Errorf("invalid status line")
+var ErrBadChunk = fmt.Errorf("invalid chunk")
+var ErrBadContentLength = fmt.Errorf("invalid content length")
+var ErrResponseInErrState = fmt.Errorf("response in error state")
+var ErrLineTooLong = fmt.Errorf("status line or header too long")
+
+var SEPARATOR = []byte("\r\n")
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// Response is a parsed response. Body streams the decoded body straight off
+// the connection, so it must be read to EOF before the next response on the
+// same connection can be read. Trailers holds the trailer fields of a
+// chunked body once Body has returned io.EOF.
+type Response struct {
+	StatusLine StatusLine
+	Headers    *headers.Headers
+	Body       io.ReadCloser
+	Trailers   *headers.Headers
+
+	state     parserState
+	method    string
+	remaining int64
+	// untilClose is set when the body is delimited by the connection
+	// closing, which rules out reuse.
+	untilClose bool
+	// pending holds body bytes decoded by parse but not yet read.
+	pending []byte
+}
+
+func newResponse(method string) *Response {
+	return &Response{
+		state:    stateInit,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		method:   method,
+	}
+}
+
+func (r *Response) headDone() bool {
+	return r.state != stateInit && r.state != stateParsingHeaders
+}
+
+// KeepAlive reports whether the connection may carry another response once
+// this body has been read.
+func (r *Response) KeepAlive() bool {
+	if r.untilClose {
+		return false
+	}
+	for _, token := range strings.Split(headerValue(r.Headers, "Connection"), ",") {
+		switch strings.ToLower(strings.TrimSpace(token)) {
+		case "close":
+			return false
+		case "keep-alive":
+			return true
+		}
+	}
+	return r.StatusLine.HttpVersion == "1.1"
+}
+
+func headerValue(h *headers.Headers, name string) string {
+	v, _ := h.Get(name)
+	return v
+}
+
+func isChunked(h *headers.Headers) bool {
+	codings := strings.Split(headerValue(h, "Transfer-Encoding"), ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// Interim reports whether this is a 1xx response that will be followed by
+// the final one. 101 Switching Protocols is final: the connection stops
+// speaking HTTP after it.
+func (r *Response) Interim() bool {
+	code := r.StatusLine.StatusCode
+	return code >= 100 && code < 200 && code != StatusSwitchingProtocols
+}
+
+// bodyState picks how the body is delimited once the headers are known
+// (RFC 9112 section 6.3).
+func (r *Response) bodyState() (parserState, error) {
+	code := r.StatusLine.StatusCode
+	if r.method == "HEAD" || code < 200 || code == 204 || code == StatusNotModified {
+		return stateDone, nil
+	}
+	// A successful CONNECT turns the connection into a tunnel.
+	if r.method == "CONNECT" && code < 300 {
+		return stateDone, nil
+	}
+	if isChunked(r.Headers) {
+		return stateParsingChunkSize, nil
+	}
+	if value, ok := r.Headers.Get("Content-Length"); ok {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			return stateError, ErrBadContentLength
+		}
+		r.remaining = length
+		if length == 0 {
+			return stateDone, nil
+		}
+		return stateParsingBody, nil
+	}
+	r.untilClose = true
+	return stateReadUntilClose, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	read := 0
+outer:
+	for {
+		currentData := data[read:]
+		if len(currentData) == 0 && r.state != stateParsingHeaders {
+			break outer
+		}
+		switch r.state {
+		case stateError:
+			return 0, ErrResponseInErrState
+		case stateInit:
+			sl, n, err := parseStatusLine(currentData)
+			if err != nil {
+				r.state = stateError
+				return 0, err
+			}
+			if n == 0 {
+				break outer
+			}
+			r.StatusLine = *sl
+			read += n
+			r.state = stateParsingHeaders
+		case stateParsingHeaders:
+			n, done, err := r.Headers.Parse(currentData)
+			if err != nil {
+				r.state = stateError
+				return 0, err
+			}
+			read += n
+			if !done {
+				break outer
+			}
+			r.state, err = r.bodyState()
+			if err != nil {
+				return 0, err
+			}
+			// The head is complete; body bytes are parsed as they are read.
+			break outer
+		case stateParsingBody:
+			n := min(r.remaining, int64(len(currentData)))
+			r.pending = append(r.pending, currentData[:n]...)
+			r.remaining -= n
+			read += int(n)
+			if r.remaining == 0 {
+				r.state = stateDone
+			}
+		case stateParsingChunkSize:
+			idx := bytes.Index(currentData, SEPARATOR)
+			if idx == -1 {
+				break outer
+			}
+			size, err := parseChunkSize(currentData[:idx])
+			if err != nil {
+				r.state = stateError
+				return 0, err
+			}
+			read += idx + len(SEPARATOR)
+			r.remaining = size
+			r.state = stateParsingChunkData
+			if size == 0 {
+				r.state = stateParsingTrailers
+			}
+		case stateParsingChunkData:
+			n := min(r.remaining, int64(len(currentData)))
+			r.pending = append(r.pending, currentData[:n]...)
+			r.remaining -= n
+			read += int(n)
+			if r.remaining == 0 {
+				r.state = stateParsingChunkEnd
+			}
+		case stateParsingChunkEnd:
+			if len(currentData) < len(SEPARATOR) {
+				break outer
+			}
+			if !bytes.HasPrefix(currentData, SEPARATOR) {
+				r.state = stateError
+				return 0, ErrBadChunk
+			}
+			read += len(SEPARATOR)
+			r.state = stateParsingChunkSize
+		case stateParsingTrailers:
+			n, done, err := r.Trailers.Parse(currentData)
+			if err != nil {
+				r.state = stateError
+				return 0, err
+			}
+			read += n
+			if !done {
+				break outer
+			}
+			r.state = stateDone
+		case stateReadUntilClose:
+			r.pending = append(r.pending, currentData...)
+			read += len(currentData)
+		case stateDone:
+			break outer
+		default:
+			panic("No state found")
+		}
+	}
+
+	return read, nil
+}
+
+func parseChunkSize(line []byte) (int64, error) {
+	// Chunk extensions after ';' are ignored.
+	sizeStr, _, _ := strings.Cut(string(line), ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+	if err != nil || size < 0 {
+		return 0, ErrBadChunk
+	}
+	return size, nil
+}
+
+func parseStatusLine(b []byte) (*StatusLine, int, error) {
+	idx := bytes.Index(b, SEPARATOR)
+	if idx == -1 {
+		return nil, 0, nil
+	}
+
+	startLine := string(b[:idx])
+	read := idx + len(SEPARATOR)
+
+	version, rest, ok := strings.Cut(startLine, " ")
+	if !ok {
+		return nil, 0, ErrBadStatusLine
+	}
+	httpVersion, ok := strings.CutPrefix(version, "HTTP/")
+	if !ok || (httpVersion != "1.0" && httpVersion != "1.1") {
+		return nil, 0, ErrBadStatusLine
+	}
+	codeStr, reason, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || len(codeStr) != 3 || code < 100 {
+		return nil, 0, ErrBadStatusLine
+	}
+
+	return &StatusLine{
+		HttpVersion:  httpVersion,
+		StatusCode:   StatusCode(code),
+		ReasonPhrase: reason,
+	}, read, nil
+}
+
+const (
+	initialBufferSize = 1024
+	maxBufferSize     = 64 * 1024
+)
+
+// Reader parses responses from a connection. Bytes read past the end of one
+// response stay buffered for the next, so a connection can be reused.
+type Reader struct {
+	reader io.Reader
+	buf    []byte
+	bufLen int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, initialBufferSize),
+	}
+}
+
+// fill reads more from the connection, growing the buffer when a single
+// line does not fit.
+func (rr *Reader) fill() error {
+	if rr.bufLen == len(rr.buf) {
+		if len(rr.buf) >= maxBufferSize {
+			return ErrLineTooLong
+		}
+		rr.buf = append(rr.buf, make([]byte, len(rr.buf))...)
+	}
+	n, err := rr.reader.Read(rr.buf[rr.bufLen:])
+	rr.bufLen += n
+	if n > 0 {
+		return nil
+	}
+	return err
+}
+
+func (rr *Reader) consume(n int) {
+	copy(rr.buf, rr.buf[n:rr.bufLen])
+	rr.bufLen -= n
+}
+
+// ReadResponse parses the status line and headers of the next response.
+// method is the method of the request it answers; responses to HEAD never
+// have a body. An empty method is treated like GET. Interim 1xx responses
+// are returned like any other; callers waiting for the final response read
+// again while Interim reports true.
+func (rr *Reader) ReadResponse(method string) (*Response, error) {
+	response := newResponse(method)
+	for {
+		readN, err := response.parse(rr.buf[:rr.bufLen])
+		if err != nil {
+			return nil, err
+		}
+		rr.consume(readN)
+		if response.headDone() {
+			break
+		}
+		if err := rr.fill(); err != nil {
+			return nil, err
+		}
+	}
+	response.Body = &body{response: response, reader: rr}
+	return response, nil
+}
+
+// ResponseFromReader parses a single response to a GET from reader.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return NewReader(reader).ReadResponse("GET")
+}
+
+// body decodes the message body on demand, feeding buffered connection
+// bytes through the same state machine that parsed the head.
+type body struct {
+	response *Response
+	reader   *Reader
+	closed   bool
+}
+
+var ErrBodyClosed = errors.New("read on closed response body")
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	r := b.response
+	for {
+		if len(r.pending) > 0 {
+			n := copy(p, r.pending)
+			r.pending = r.pending[n:]
+			return n, nil
+		}
+		if r.state == stateDone {
+			return 0, io.EOF
+		}
+
+		readN, err := r.parse(b.reader.buf[:b.reader.bufLen])
+		if err != nil {
+			return 0, err
+		}
+		b.reader.consume(readN)
+		if len(r.pending) > 0 || r.state == stateDone {
+			continue
+		}
+
+		if err := b.reader.fill(); err != nil {
+			if err == io.EOF && r.state == stateReadUntilClose {
+				r.state = stateDone
+				continue
+			}
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+}
+
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
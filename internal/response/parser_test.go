@@ -0,0 +1,188 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+)
+
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+// Read reads up to len(p) or numBytesPerRead bytes from the string per call,
+// simulating a connection that delivers data in small pieces.
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func readAll(t *testing.T, r *Response) string {
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Good status line
+	r, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", numBytesPerRead: 3})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusNotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+
+	// Test: Empty reason phrase
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 \r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+
+	// Test: Malformed status lines
+	for _, line := range []string{"HTTP/2 200 OK", "HTTP/1.1 20 OK", "HTTP/1.1 abc OK", "200 OK", "HTTP/1.1"} {
+		_, err = ResponseFromReader(strings.NewReader(line + "\r\n\r\n"))
+		require.ErrorIs(t, err, ErrBadStatusLine, line)
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	// Test: Content-Length body
+	r, err := ResponseFromReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello, world!",
+		numBytesPerRead: 2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world!", readAll(t, r))
+
+	// Test: Body shorter than Content-Length
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nshort"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Chunked body with extensions and trailers
+	r, err = ResponseFromReader(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+			"5;ext=1\r\nhello\r\n8\r\n, world!\r\n0\r\nX-Sum: abc\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world!", readAll(t, r))
+	sum, _ := r.Trailers.Get("X-Sum")
+	assert.Equal(t, "abc", sum)
+
+	// Test: Malformed chunk size
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, ErrBadChunk)
+
+	// Test: Body runs until the connection closes
+	r, err = ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\n\r\nuntil close", numBytesPerRead: 4})
+	require.NoError(t, err)
+	assert.Equal(t, "until close", readAll(t, r))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Invalid Content-Length
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n"))
+	require.ErrorIs(t, err, ErrBadContentLength)
+}
+
+func TestNoBodyResponses(t *testing.T) {
+	// Test: 204 and 304 have no body whatever the headers say
+	for _, code := range []string{"204 No Content", "304 Not Modified"} {
+		rr := NewReader(strings.NewReader("HTTP/1.1 " + code + "\r\nContent-Length: 5\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		r, err := rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, "", readAll(t, r))
+		r, err = rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", readAll(t, r))
+	}
+
+	// Test: HEAD response keeps its Content-Length but has no body
+	rr := NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"))
+	r, err := rr.ReadResponse("HEAD")
+	require.NoError(t, err)
+	length, _ := r.Headers.Get("Content-Length")
+	assert.Equal(t, "5", length)
+	assert.Equal(t, "", readAll(t, r))
+
+	// Test: Interim responses come before the final one
+	rr = NewReader(&chunkReader{
+		data: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\ndone",
+		numBytesPerRead: 5,
+	})
+	codes := []StatusCode{}
+	for {
+		r, err = rr.ReadResponse("GET")
+		require.NoError(t, err)
+		codes = append(codes, r.StatusLine.StatusCode)
+		if !r.Interim() {
+			break
+		}
+		assert.Equal(t, "", readAll(t, r))
+	}
+	assert.Equal(t, []StatusCode{100, 103, 200}, codes)
+	assert.Equal(t, "done", readAll(t, r))
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: HTTP/1.1 defaults to keep-alive
+	r, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: Connection: close
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 only with an explicit keep-alive
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\nConnection: Keep-Alive\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+}
+
+func TestParseWriterOutput(t *testing.T) {
+	// Test: A chunked response with trailers from Writer parses back
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Done")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	for _, part := range []string{"one ", "two ", "three"} {
+		_, err := w.WriteChunkedBody([]byte(part))
+		require.NoError(t, err)
+	}
+	trailer := headers.NewHeaders()
+	trailer.Set("X-Done", "yes")
+	require.NoError(t, w.WriteTrailers(*trailer))
+	require.NoError(t, w.Flush())
+
+	r, err := ResponseFromReader(&chunkReader{data: out.String(), numBytesPerRead: 7})
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "one two three", readAll(t, r))
+	done, _ := r.Trailers.Get("X-Done")
+	assert.Equal(t, "yes", done)
+}
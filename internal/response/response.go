@@ -1,77 +1,682 @@
 package response
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"strings"
 	"tcp_http/internal/headers"
 )
 
-type Response struct {
-}
+// TimeFormat is the IMF-fixdate format of HTTP dates (RFC 9110 section
+// 5.6.7). Times must be in UTC when formatted with it.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
 type StatusCode int
 
 const (
-	StatusOK            StatusCode = 200
-	StatusBadRequest    StatusCode = 400
-	StatusInternalError StatusCode = 500
+	StatusContinue             StatusCode = 100
+	StatusSwitchingProtocols   StatusCode = 101
+	StatusEarlyHints           StatusCode = 103
+	StatusOK                   StatusCode = 200
+	StatusNoContent            StatusCode = 204
+	StatusPartialContent       StatusCode = 206
+	StatusMovedPermanently     StatusCode = 301
+	StatusFound                StatusCode = 302
+	StatusSeeOther             StatusCode = 303
+	StatusNotModified          StatusCode = 304
+	StatusTemporaryRedirect    StatusCode = 307
+	StatusPermanentRedirect    StatusCode = 308
+	StatusBadRequest           StatusCode = 400
+	StatusForbidden            StatusCode = 403
+	StatusNotFound             StatusCode = 404
+	StatusMethodNotAllowed     StatusCode = 405
+	StatusNotAcceptable        StatusCode = 406
+	StatusProxyAuthRequired    StatusCode = 407
+	StatusPreconditionFailed   StatusCode = 412
+	StatusContentTooLarge      StatusCode = 413
+	StatusUnsupportedMediaType StatusCode = 415
+	StatusRangeNotSatisfiable  StatusCode = 416
+	StatusExpectationFailed    StatusCode = 417
+	StatusUpgradeRequired      StatusCode = 426
+	StatusInternalError        StatusCode = 500
+	StatusBadGateway           StatusCode = 502
+	StatusServiceUnavailable   StatusCode = 503
+	StatusGatewayTimeout       StatusCode = 504
 )
 
+var statusText = map[StatusCode]string{
+	StatusContinue:             "Continue",
+	StatusSwitchingProtocols:   "Switching Protocols",
+	StatusEarlyHints:           "Early Hints",
+	StatusOK:                   "OK",
+	StatusNoContent:            "No Content",
+	StatusPartialContent:       "Partial Content",
+	StatusMovedPermanently:     "Moved Permanently",
+	StatusFound:                "Found",
+	StatusSeeOther:             "See Other",
+	StatusNotModified:          "Not Modified",
+	StatusTemporaryRedirect:    "Temporary Redirect",
+	StatusPermanentRedirect:    "Permanent Redirect",
+	StatusBadRequest:           "Bad Request",
+	StatusForbidden:            "Forbidden",
+	StatusNotFound:             "Not Found",
+	StatusMethodNotAllowed:     "Method Not Allowed",
+	StatusNotAcceptable:        "Not Acceptable",
+	StatusProxyAuthRequired:    "Proxy Authentication Required",
+	StatusPreconditionFailed:   "Precondition Failed",
+	StatusContentTooLarge:      "Content Too Large",
+	StatusUnsupportedMediaType: "Unsupported Media Type",
+	StatusRangeNotSatisfiable:  "Range Not Satisfiable",
+	StatusExpectationFailed:    "Expectation Failed",
+	StatusUpgradeRequired:      "Upgrade Required",
+	StatusInternalError:        "Internal Server Error",
+	StatusBadGateway:           "Bad Gateway",
+	StatusServiceUnavailable:   "Service Unavailable",
+	StatusGatewayTimeout:       "Gateway Timeout",
+}
+
+// StatusText returns the reason phrase for code, or "" if it is unknown.
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
+
+var ErrUnknownStatus = errors.New("unknown status code")
+var ErrNotHijackable = errors.New("underlying connection cannot be hijacked")
+var ErrHijacked = errors.New("connection has been hijacked")
+var ErrStatusWritten = errors.New("final status line already written")
+var ErrNotInterim = errors.New("not an interim status code")
+var ErrAborted = errors.New("response aborted")
+var ErrHeadersWritten = errors.New("headers already written")
+
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
 
+// AddVary appends field to the Vary header unless it is already covered.
+func AddVary(h *headers.Headers, field string) {
+	vary, ok := h.Get("Vary")
+	if !ok {
+		h.Set("Vary", field)
+		return
+	}
+	for _, t := range strings.Split(vary, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.EqualFold(t, field) {
+			return
+		}
+	}
+	h.Set("Vary", field)
+}
+
+// DefaultBufferSize is the size of the write buffer used by NewWriter.
+const DefaultBufferSize = 4096
+
+var ErrNotChunked = errors.New("response is not chunked")
+var ErrBodyDone = errors.New("chunked body already finished")
+
+// Encoder wraps the body of a response, e.g. in a compressor. Whatever the
+// returned writer produces is framed and sent; Close must flush its tail.
+type Encoder func(dst io.Writer) io.WriteCloser
+
+// HeaderHook runs just before the header block is written. It may edit the
+// headers and may return an Encoder for the body, or nil to leave the body
+// untouched. Middleware uses hooks to rewrite responses on the fly.
+type HeaderHook func(status StatusCode, h *headers.Headers) Encoder
+
+// Writer writes a response through a write buffer, so a handler that writes
+// many small pieces does not pay a syscall for each of them. Buffered bytes
+// go out when the buffer fills, when Flush is called, or when the server
+// finishes the response after the handler returns.
+//
+// The Writer owns the body framing: once the headers declare
+// "Transfer-Encoding: chunked", every body write is sent as a chunk. An
+// HTTP/1.0 client does not know chunking, so for one the field is dropped
+// and the body is sent as it is, delimited by closing the connection.
 type Writer struct {
-	writer io.Writer
+	writer   io.Writer
+	buf      *bufio.Writer
+	conn     io.ReadWriteCloser
+	reader   io.Reader
+	hijacked bool
+	version  string
+
+	status       StatusCode
+	reason       string
+	wroteHeaders bool
+	chunked      bool
+	unchunked    bool
+	bodyDone     bool
+	trailersDone bool
+	aborted      bool
+
+	hooks          []HeaderHook
+	finishHooks    []func()
+	doneHooks      []func()
+	connectionHook func(StatusCode, *headers.Headers)
+	encoders       []io.WriteCloser
+	body           io.Writer
+	written        int64
+	sent           int64
 }
 
 func NewWriter(writer io.Writer) *Writer {
-	return &Writer{writer: writer}
+	return NewWriterSize(writer, DefaultBufferSize)
+}
+
+// NewWriterSize returns a Writer with a write buffer of size bytes. A size
+// <= 0 disables buffering and every write goes straight to writer.
+func NewWriterSize(writer io.Writer, size int) *Writer {
+	w := &Writer{writer: writer}
+	if size > 0 {
+		w.buf = bufio.NewWriterSize(writer, size)
+		w.writer = w.buf
+	}
+	if conn, ok := writer.(io.ReadWriteCloser); ok {
+		w.conn = conn
+		w.reader = conn
+	}
+	w.body = w.framing()
+	return w
+}
+
+// NewConnWriter returns a Writer for conn with a write buffer of size bytes.
+// reader is what a hijacker reads from; it should yield any bytes the
+// request parser already pulled off the connection before reading from conn
+// itself.
+func NewConnWriter(conn io.ReadWriteCloser, reader io.Reader, size int) *Writer {
+	w := NewWriterSize(conn, size)
+	w.reader = reader
+	return w
+}
+
+// AddHeaderHook registers hook to run when the headers are written. Hooks
+// run in the order they were added; the encoder of the first hook ends up
+// closest to the connection.
+func (w *Writer) AddHeaderHook(hook HeaderHook) {
+	w.hooks = append(w.hooks, hook)
+}
+
+// AddFinishHook registers hook to run once, when Finish is first called
+// and before the response is completed. Anything writing to the response
+// from another goroutine uses it to stop before the server finishes it.
+func (w *Writer) AddFinishHook(hook func()) {
+	w.finishHooks = append(w.finishHooks, hook)
+}
+
+// AddDoneHook registers hook to run once, when Finish has completed the
+// response, whether or not that succeeded. Access logs use it to see the
+// body as it was finally sent.
+func (w *Writer) AddDoneHook(hook func()) {
+	w.doneHooks = append(w.doneHooks, hook)
+}
+
+// SetVersion sets the HTTP version the response is labelled with, "1.1"
+// unless the client spoke "1.0".
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+func (w *Writer) http10() bool {
+	return w.version == "1.0"
+}
+
+// SetConnectionHook registers hook to run after every header hook, once the
+// headers are final. The server uses it to decide whether the connection
+// stays open and to say so in the Connection header.
+func (w *Writer) SetConnectionHook(hook func(status StatusCode, h *headers.Headers)) {
+	w.connectionHook = hook
+}
+
+// Status returns the status code written so far, or 0.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// SetStatus replaces the status of a response whose headers have not gone
+// out yet. A header hook uses it to answer with something other than what
+// the handler wrote, replacing the headers and the body to match.
+func (w *Writer) SetStatus(statusCode StatusCode) error {
+	if w.wroteHeaders {
+		return ErrHeadersWritten
+	}
+	text, ok := statusText[statusCode]
+	if !ok {
+		return ErrUnknownStatus
+	}
+	w.status, w.reason = statusCode, text
+	return nil
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// Flush sends any buffered bytes to the connection. Streaming handlers call
+// it whenever the client should see what has been written so far. Body
+// encoders that support flushing are flushed too.
+func (w *Writer) Flush() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	for i := len(w.encoders) - 1; i >= 0; i-- {
+		if f, ok := w.encoders[i].(flusher); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if w.buf == nil {
+		return nil
+	}
+	return w.buf.Flush()
+}
+
+// Abort gives up on a response that cannot be completed, such as one
+// relaying an upstream body that failed partway through. Later body writes
+// fail with ErrAborted, and Finish sends what was written without ending a
+// chunked body and returns ErrAborted, so the server closes the connection
+// and the client cannot take the truncated body for a complete one.
+func (w *Writer) Abort() {
+	w.aborted = true
+}
+
+// Aborted reports whether Abort was called.
+func (w *Writer) Aborted() bool {
+	return w.aborted
+}
+
+// Finish completes the response: it closes body encoders, terminates a
+// chunked body that the handler left open and flushes. The server calls it
+// once the handler returns.
+func (w *Writer) Finish() error {
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for _, hook := range hooks {
+		hook()
+	}
+	defer w.done()
+	if w.hijacked {
+		return nil
+	}
+	if w.aborted {
+		w.Flush()
+		return ErrAborted
+	}
+	if w.wroteHeaders {
+		if w.chunked {
+			if !w.bodyDone {
+				if _, err := w.WriteChunkedBodyDone(); err != nil {
+					return err
+				}
+			}
+			if !w.trailersDone {
+				if err := w.WriteTrailers(*headers.NewHeaders()); err != nil {
+					return err
+				}
+			}
+		} else if err := w.closeEncoders(); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (w *Writer) done() {
+	hooks := w.doneHooks
+	w.doneHooks = nil
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+func (w *Writer) closeEncoders() error {
+	for i := len(w.encoders) - 1; i >= 0; i-- {
+		if err := w.encoders[i].Close(); err != nil {
+			return err
+		}
+	}
+	w.encoders = nil
+	w.body = w.framing()
+	return nil
+}
+
+// framing returns the writer that frames body bytes for the connection,
+// counting them as sent on the way.
+func (w *Writer) framing() io.Writer {
+	var dst io.Writer = w.writer
+	if w.chunked {
+		dst = chunkWriter{w.writer}
+	}
+	return sentCounter{dst, &w.sent}
+}
+
+// sentCounter counts the body bytes handed to the framing, which are the
+// body as sent: after content coding, without chunk framing.
+type sentCounter struct {
+	writer io.Writer
+	n      *int64
+}
+
+func (c sentCounter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	*c.n += int64(n)
+	return n, err
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	statusLine := ""
-	switch statusCode {
-	case StatusOK:
-		statusLine = "HTTP/1.1 200 OK\r\n"
-	case StatusBadRequest:
-		statusLine = "HTTP/1.1 400 Bad Request\r\n"
-	case StatusInternalError:
-		statusLine = "HTTP/1.1 500 Internal Server Error\r\n"
-	default:
-		return errors.New("unknown status code")
-	}
-
-	_, err := w.writer.Write([]byte(statusLine))
-	return err
+	if w.hijacked {
+		return ErrHijacked
+	}
+	text, ok := statusText[statusCode]
+	if !ok {
+		return ErrUnknownStatus
+	}
+	return w.WriteStatusLineReason(statusCode, text)
+}
+
+// WriteInterim sends an informational 1xx response ahead of the final one
+// and flushes it, so the client sees it while the handler keeps working.
+// Any number of interim responses may precede the final status line. Header
+// hooks do not run for them. 101 is not accepted here since it ends the
+// exchange; write it with WriteStatusLine. HTTP/1.0 clients do not expect
+// interim responses, so nothing is sent to them.
+func (w *Writer) WriteInterim(statusCode StatusCode, h headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if w.status != 0 {
+		return ErrStatusWritten
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusSwitchingProtocols {
+		return ErrNotInterim
+	}
+	if w.http10() {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", statusCode, statusText[statusCode]); err != nil {
+		return err
+	}
+	if err := writeFields(w.writer, h); err != nil {
+		return err
+	}
+	return w.Flush()
+}
 
+// WriteContinue sends a "100 Continue" interim response, telling a client
+// that waits on "Expect: 100-continue" to go ahead with the body.
+func (w *Writer) WriteContinue() error {
+	return w.WriteInterim(StatusContinue, *headers.NewHeaders())
 }
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+
+// WriteEarlyHints sends a "103 Early Hints" response listing resources the
+// final response is likely to need, so the client can start fetching them.
+// Each link is a Link field value such as "</style.css>; rel=preload;
+// as=style".
+func (w *Writer) WriteEarlyHints(links ...string) error {
+	h := headers.NewHeaders()
+	for _, link := range links {
+		h.Set("Link", link)
+	}
+	return w.WriteInterim(StatusEarlyHints, *h)
+}
+
+// WriteStatusLineReason writes a status line with any three-digit code and
+// the given reason phrase, e.g. to relay a response from another server.
+// The line goes out with the headers, so header hooks can still replace
+// the status.
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reason string) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if statusCode < 100 || statusCode > 999 {
+		return ErrUnknownStatus
+	}
+	w.status, w.reason = statusCode, reason
+	return nil
+}
+
+// writeStatusLine sends the status line held back by WriteStatusLineReason.
+func (w *Writer) writeStatusLine() error {
+	version := "1.1"
+	if w.http10() {
+		version = "1.0"
+	}
+	_, err := fmt.Fprintf(w.writer, "HTTP/%s %d %s\r\n", version, w.status, w.reason)
+	return err
+}
+
+func writeFields(dst io.Writer, h headers.Headers) error {
 	b := []byte{}
 
-	headers.ForEach(func(n, v string) {
+	h.ForEach(func(n, v string) {
 		b = fmt.Appendf(b, "%s: %s\r\n", n, v)
 	})
 	b = fmt.Appendf(b, "\r\n")
-	_, err := w.writer.Write(b)
+	_, err := dst.Write(b)
 	return err
+}
+
+func (w *Writer) WriteHeaders(headers headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	var encoders []Encoder
+	for _, hook := range w.hooks {
+		if enc := hook(w.status, &headers); enc != nil {
+			encoders = append(encoders, enc)
+		}
+	}
+	te, _ := headers.Get("Transfer-Encoding")
+	w.chunked = strings.Contains(strings.ToLower(te), "chunked")
+	if w.chunked && w.http10() {
+		headers.Delete("Transfer-Encoding")
+		w.chunked = false
+		w.unchunked = true
+	}
+	if w.connectionHook != nil {
+		w.connectionHook(w.status, &headers)
+	}
+	w.wroteHeaders = true
+
+	w.body = w.framing()
+	for _, enc := range encoders {
+		encoder := enc(w.body)
+		w.encoders = append(w.encoders, encoder)
+		w.body = encoder
+	}
+
+	if w.status != 0 {
+		if err := w.writeStatusLine(); err != nil {
+			return err
+		}
+	}
+	return writeFields(w.writer, headers)
 
 }
+
+// WriteBody writes body bytes. On a chunked response each call is sent as
+// a chunk.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	n, err := w.writer.Write(p)
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.aborted {
+		return 0, ErrAborted
+	}
+	if w.bodyDone {
+		return 0, ErrBodyDone
+	}
+	n, err := w.body.Write(p)
+	w.written += int64(n)
 	return n, err
+}
 
+// BodyBytes reports how many body bytes have been written so far, before
+// any content coding and without chunk framing.
+func (w *Writer) BodyBytes() int64 {
+	return w.written
 }
 
-// func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+// SentBodyBytes reports how many body bytes have been written so far as
+// they go out: after any content coding, without chunk framing. This is
+// the size access logs record.
+func (w *Writer) SentBodyBytes() int64 {
+	return w.sent
+}
 
-// }
+// chunkWriter frames every write as one chunk of a chunked body.
+type chunkWriter struct {
+	writer io.Writer
+}
 
-// func (w *Writer) WriteChunkedBodyDone() (int, error) {
+func (c chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(c.writer, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = c.writer.Write([]byte("\r\n"))
+	return n, err
+}
+
+// WriteChunkedBody sends p as a chunk of a chunked response.
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if !w.chunked && !w.unchunked {
+		return 0, ErrNotChunked
+	}
+	return w.WriteBody(p)
+}
+
+// WriteChunkedBodyDone ends a chunked body with the zero length chunk.
+// Trailers may follow with WriteTrailers.
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if !w.chunked && !w.unchunked {
+		return 0, ErrNotChunked
+	}
+	if w.bodyDone {
+		return 0, ErrBodyDone
+	}
+	if err := w.closeEncoders(); err != nil {
+		return 0, err
+	}
+	w.bodyDone = true
+	if w.unchunked {
+		return 0, nil
+	}
+	return w.writer.Write([]byte("0\r\n"))
+}
+
+// WriteTrailers writes the trailer section after WriteChunkedBodyDone.
+func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if !w.bodyDone {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	w.trailersDone = true
+	// Without chunking there is nowhere to put trailers.
+	if w.unchunked {
+		return nil
+	}
+	return writeFields(w.writer, h)
+}
 
-// }
+// writerOnly hides any ReadFrom method of the wrapped writer so io.Copy takes
+// the plain read/write loop.
+type writerOnly struct {
+	io.Writer
+}
+
+// isFile reports whether r reads straight from a file, which is what the
+// kernel can copy to a socket without passing through user space.
+func isFile(r io.Reader) bool {
+	switch src := r.(type) {
+	case *os.File:
+		return true
+	case *io.LimitedReader:
+		_, ok := src.R.(*os.File)
+		return ok
+	}
+	return false
+}
+
+// ReadFrom copies r into the response body. When the connection is a plain
+// *net.TCPConn, the body is neither chunked nor encoded, and r is an
+// *os.File or an io.LimitedReader over one, the buffer is flushed and the
+// copy is handed to the connection's ReadFrom, which uses sendfile/splice on
+// Linux. Anything else, including TLS connections, goes through the write
+// buffer.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.aborted {
+		return 0, ErrAborted
+	}
+	if w.bodyDone {
+		return 0, ErrBodyDone
+	}
+	tcp, ok := w.conn.(*net.TCPConn)
+	if ok && !w.chunked && len(w.encoders) == 0 && isFile(r) {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+		n, err := tcp.ReadFrom(r)
+		w.written += n
+		w.sent += n
+		return n, err
+	}
+	n, err := io.Copy(writerOnly{w.body}, r)
+	w.written += n
+	return n, err
+}
+
+// Hijack hands the underlying connection to the caller. The returned reader
+// yields the bytes already buffered by the request parser followed by the
+// rest of the connection. Once hijacked the server stops managing the
+// connection, no longer closes it when the handler returns, and every write
+// through the Writer fails with ErrHijacked. Anything still buffered is
+// flushed first.
+func (w *Writer) Hijack() (io.ReadWriteCloser, *bufio.Reader, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.conn == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.status != 0 && !w.wroteHeaders {
+		if err := w.writeStatusLine(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return w.conn, bufio.NewReader(w.reader), nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
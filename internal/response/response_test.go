@@ -0,0 +1,454 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+)
+
+type fakeConn struct {
+	io.Reader
+	bytes.Buffer
+	closed bool
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHijack(t *testing.T) {
+	// Test: Hijack returns buffered bytes before the connection
+	conn := &fakeConn{Reader: strings.NewReader(" from the socket")}
+	buffered := io.MultiReader(strings.NewReader("already parsed"), conn)
+	w := NewConnWriter(conn, buffered, DefaultBufferSize)
+	hijacked, reader, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Same(t, conn, hijacked)
+	assert.True(t, w.Hijacked())
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "already parsed from the socket", string(rest))
+
+	// Test: Writes after hijacking fail
+	require.ErrorIs(t, w.WriteStatusLine(StatusOK), ErrHijacked)
+	_, err = w.WriteBody([]byte("late"))
+	require.ErrorIs(t, err, ErrHijacked)
+	assert.Equal(t, 0, conn.Len())
+
+	// Test: Hijacking twice fails
+	_, _, err = w.Hijack()
+	require.ErrorIs(t, err, ErrHijacked)
+
+	// Test: Plain writers cannot be hijacked
+	_, _, err = NewWriter(&bytes.Buffer{}).Hijack()
+	require.ErrorIs(t, err, ErrNotHijackable)
+}
+
+// countingWriter counts how many writes reach the underlying connection.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestBuffering(t *testing.T) {
+	// Test: Small writes are coalesced until Flush
+	out := &countingWriter{}
+	w := NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(10)))
+	for i := 0; i < 10; i++ {
+		_, err := w.WriteBody([]byte("x"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, out.writes)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, 1, out.writes)
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nxxxxxxxxxx"))
+
+	// Test: Unbuffered writer writes straight through
+	out = &countingWriter{}
+	w = NewWriterSize(out, 0)
+	_, err := w.WriteBody([]byte("x"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, out.writes)
+	require.NoError(t, w.Flush())
+
+	// Test: Hijack flushes what was buffered
+	conn := &fakeConn{Reader: strings.NewReader("")}
+	w = NewConnWriter(conn, conn, DefaultBufferSize)
+	require.NoError(t, w.WriteStatusLine(StatusSwitchingProtocols))
+	assert.Equal(t, 0, conn.Len())
+	_, _, err = w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", conn.String())
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server, err := listener.Accept()
+	require.NoError(t, err)
+	return client, server
+}
+
+func tempFile(t testing.TB, size int) *os.File {
+	f, err := os.CreateTemp(t.TempDir(), "body")
+	require.NoError(t, err)
+	_, err = f.Write(bytes.Repeat([]byte("0123456789abcdef"), size/16))
+	require.NoError(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	return f
+}
+
+// plainConn hides the *net.TCPConn so the Writer cannot use zero-copy.
+type plainConn struct {
+	net.Conn
+}
+
+func TestReadFrom(t *testing.T) {
+	// Test: File body after buffered headers over TCP
+	client, server := tcpPair(t)
+	defer client.Close()
+	f := tempFile(t, 64*1024)
+	defer f.Close()
+
+	w := NewWriter(server)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(1000)))
+	n, err := w.ReadFrom(io.LimitReader(f, 1000))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	require.NoError(t, w.Flush())
+	server.Close()
+
+	raw, err := io.ReadAll(client)
+	require.NoError(t, err)
+	head, body, ok := strings.Cut(string(raw), "\r\n\r\n")
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"))
+	assert.Equal(t, strings.Repeat("0123456789abcdef", 1000/16)+"01234567", body)
+
+	// Test: Non-file readers go through the buffer
+	out := &countingWriter{}
+	w = NewWriter(out)
+	_, err = w.ReadFrom(strings.NewReader("small"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, out.writes)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "small", out.String())
+}
+
+func benchmarkReadFrom(b *testing.B, wrap func(net.Conn) io.ReadWriteCloser) {
+	const size = 4 * 1024 * 1024
+	client, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+	f := tempFile(b, size)
+	defer f.Close()
+	go io.Copy(io.Discard, client)
+
+	w := NewWriter(wrap(server))
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.ReadFrom(f); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFromZeroCopy(b *testing.B) {
+	benchmarkReadFrom(b, func(c net.Conn) io.ReadWriteCloser { return c })
+}
+
+func BenchmarkReadFromBuffered(b *testing.B) {
+	benchmarkReadFrom(b, func(c net.Conn) io.ReadWriteCloser { return plainConn{c} })
+}
+
+func TestChunked(t *testing.T) {
+	// Test: Body writes are framed as chunks and Finish terminates the body
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte(", world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	_, body, _ := strings.Cut(out.String(), "\r\n\r\n")
+	assert.Equal(t, "5\r\nhello\r\n7\r\n, world\r\n0\r\n\r\n", body)
+
+	// Test: Trailers
+	out.Reset()
+	w = NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	trailer := headers.NewHeaders()
+	trailer.Set("X-Checksum", "123")
+	require.NoError(t, w.WriteTrailers(*trailer))
+	require.NoError(t, w.Finish())
+	_, body, _ = strings.Cut(out.String(), "\r\n\r\n")
+	assert.Equal(t, "3\r\nabc\r\n0\r\nx-checksum: 123\r\n\r\n", body)
+	_, err = w.WriteBody([]byte("late"))
+	require.ErrorIs(t, err, ErrBodyDone)
+
+	// Test: An aborted chunked body is not terminated
+	out.Reset()
+	w = NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteBody([]byte("part"))
+	require.NoError(t, err)
+	w.Abort()
+	_, err = w.WriteBody([]byte("more"))
+	require.ErrorIs(t, err, ErrAborted)
+	done := 0
+	w.AddDoneHook(func() { done++ })
+	require.ErrorIs(t, w.Finish(), ErrAborted)
+	assert.Equal(t, 1, done)
+	_, body, _ = strings.Cut(out.String(), "\r\n\r\n")
+	assert.Equal(t, "4\r\npart\r\n", body)
+
+	// Test: Chunked writes need chunked headers
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(0)))
+	_, err = w.WriteChunkedBody([]byte("x"))
+	require.ErrorIs(t, err, ErrNotChunked)
+}
+
+func TestHeaderHook(t *testing.T) {
+	// Test: Hook edits headers and encodes the body
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	w.AddHeaderHook(func(status StatusCode, h *headers.Headers) Encoder {
+		assert.Equal(t, StatusOK, status)
+		h.Replace("X-Hooked", "yes")
+		return func(dst io.Writer) io.WriteCloser {
+			return upperEncoder{dst}
+		}
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(5)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	head, body, _ := strings.Cut(out.String(), "\r\n\r\n")
+	assert.Contains(t, head, "x-hooked: yes")
+	assert.Equal(t, "HELLO", body)
+
+	// Test: Hook replaces the status before the status line goes out, and
+	// later hooks see the new one
+	out = &bytes.Buffer{}
+	w = NewWriter(out)
+	w.AddHeaderHook(func(status StatusCode, h *headers.Headers) Encoder {
+		require.NoError(t, w.SetStatus(StatusNotAcceptable))
+		return nil
+	})
+	w.AddHeaderHook(func(status StatusCode, h *headers.Headers) Encoder {
+		assert.Equal(t, StatusNotAcceptable, status)
+		return nil
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(0)))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 406 Not Acceptable\r\n"), out.String())
+	assert.Equal(t, StatusNotAcceptable, w.Status())
+	require.ErrorIs(t, w.SetStatus(StatusOK), ErrHeadersWritten)
+}
+
+type upperEncoder struct {
+	io.Writer
+}
+
+func (u upperEncoder) Write(p []byte) (int, error) {
+	return u.Writer.Write(bytes.ToUpper(p))
+}
+
+func (u upperEncoder) Close() error {
+	return nil
+}
+
+func TestInterim(t *testing.T) {
+	// Test: Early hints go out ahead of the final response and are flushed
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	hookRan := 0
+	w.AddHeaderHook(func(StatusCode, *headers.Headers) Encoder {
+		hookRan++
+		return nil
+	})
+	require.NoError(t, w.WriteEarlyHints("</style.css>; rel=preload; as=style", "</app.js>; rel=preload; as=script"))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script\r\n\r\n", out.String())
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, StatusCode(0), w.Status())
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(*GetDefaultHeaders(2))
+	w.WriteBody([]byte("ok"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, hookRan)
+
+	// Test: Parser reads the interim responses before the final one
+	reader := NewReader(out)
+	resp, err := reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusEarlyHints, resp.StatusLine.StatusCode)
+	assert.True(t, resp.Interim())
+	assert.Equal(t, "</style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script", headerValue(resp.Headers, "Link"))
+	resp, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusContinue, resp.StatusLine.StatusCode)
+	resp, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, resp.StatusLine.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ok", string(body))
+
+	// Test: Interim responses cannot follow the final status or use 101 or 2xx
+	assert.ErrorIs(t, w.WriteEarlyHints("</a>; rel=preload"), ErrStatusWritten)
+	w = NewWriter(&bytes.Buffer{})
+	assert.ErrorIs(t, w.WriteInterim(StatusSwitchingProtocols, *headers.NewHeaders()), ErrNotInterim)
+	assert.ErrorIs(t, w.WriteInterim(StatusOK, *headers.NewHeaders()), ErrNotInterim)
+}
+
+func TestBodyBytes(t *testing.T) {
+	// Test: Chunked bodies count the payload without the chunk framing
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	w.WriteBody([]byte("ab"))
+	w.WriteBody([]byte("cde"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, int64(5), w.BodyBytes())
+
+	// Test: ReadFrom through the buffer is counted
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(7)))
+	w.WriteBody([]byte("ab"))
+	_, err := w.ReadFrom(strings.NewReader("cdefg"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), w.BodyBytes())
+
+	// Test: A file handed to the TCP connection is counted
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	f := tempFile(t, 1024)
+	defer f.Close()
+	w = NewWriter(server)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*GetDefaultHeaders(1002)))
+	w.WriteBody([]byte("ab"))
+	_, err = w.ReadFrom(io.LimitReader(f, 1000))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1002), w.BodyBytes())
+	assert.Equal(t, int64(1002), w.SentBodyBytes())
+
+	// Test: The sent size is that of the coded body
+	out.Reset()
+	w = NewWriter(out)
+	w.AddHeaderHook(func(StatusCode, *headers.Headers) Encoder {
+		return func(dst io.Writer) io.WriteCloser { return gzip.NewWriter(dst) }
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	w.WriteBody(bytes.Repeat([]byte("a"), 1000))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, int64(1000), w.BodyBytes())
+	resp, err := NewReader(out).ReadResponse("GET")
+	require.NoError(t, err)
+	coded, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(coded)), w.SentBodyBytes())
+	assert.Less(t, w.SentBodyBytes(), w.BodyBytes())
+}
+
+func TestSetCookie(t *testing.T) {
+	// Test: Every attribute is rendered
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Expires:     time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600)),
+		MaxAge:      3600,
+		Domain:      ".example.com",
+		Path:        "/app",
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	value, err := c.String()
+	require.NoError(t, err)
+	assert.Equal(t, "session=abc123; Expires=Wed, 02 Jan 2030 02:04:05 GMT; Max-Age=3600; Domain=example.com; Path=/app; Secure; HttpOnly; SameSite=None; Partitioned", value)
+
+	// Test: A negative MaxAge deletes the cookie
+	value, err = (&Cookie{Name: "old", MaxAge: -1, SameSite: SameSiteLax}).String()
+	require.NoError(t, err)
+	assert.Equal(t, "old=; Max-Age=0; SameSite=Lax", value)
+
+	// Test: Invalid cookies are refused
+	for _, bad := range []*Cookie{
+		{Name: "", Value: "x"},
+		{Name: "a b", Value: "x"},
+		{Name: "a", Value: "x;y"},
+		{Name: "a", Value: "x", Path: "/\r\nX-Evil: 1"},
+		{Name: "a", Value: "x", SameSite: SameSiteNone},
+		{Name: "a", Value: "x", Partitioned: true},
+	} {
+		_, err := bad.String()
+		assert.ErrorIs(t, err, ErrInvalidCookie, bad.Name)
+	}
+
+	// Test: Each cookie is written as a separate header line
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	h := GetDefaultHeaders(0)
+	require.NoError(t, SetCookie(h, &Cookie{Name: "a", Value: "1"}))
+	require.NoError(t, SetCookie(h, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(*h))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "set-cookie: a=1\r\n")
+	assert.Contains(t, out.String(), "set-cookie: b=2; HttpOnly\r\n")
+}
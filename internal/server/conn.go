@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"time"
+)
+
+// connection serves the requests that arrive on one client connection. The
+// request reader lives as long as the connection, so bytes read past the
+// end of one request are where the next one is parsed from.
+type connection struct {
+	server *Server
+	conn   io.ReadWriteCloser
+	reader *request.Reader
+}
+
+func runConnection(s *Server, conn io.ReadWriteCloser) {
+	c := &connection{server: s, conn: conn, reader: request.NewReader(conn)}
+	if s.options.KeepAlive && s.options.ConcurrentPipelining {
+		c.servePipelined()
+	} else {
+		c.serveSequential()
+	}
+}
+
+// readRequest parses the next request head. Waiting for a request after
+// the first one is bounded by the idle timeout.
+func (c *connection) readRequest(first bool) (*request.Request, error) {
+	nc, isNet := c.conn.(net.Conn)
+	if !first && isNet {
+		nc.SetReadDeadline(time.Now().Add(c.server.options.idleTimeout()))
+		defer nc.SetReadDeadline(time.Time{})
+	}
+	req, err := c.reader.ReadRequestHead()
+	if err != nil {
+		return nil, err
+	}
+	if isNet {
+		req.RemoteAddr = nc.RemoteAddr().String()
+	}
+	return req, nil
+}
+
+func (c *connection) newWriter() *response.Writer {
+	return response.NewConnWriter(c.conn, c.reader, c.server.options.writeBufferSize())
+}
+
+// idleEnd reports whether a failed read only means the client is done with
+// a kept-alive connection: it closed it or let it sit past the idle timeout.
+func idleEnd(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// badRequest answers a request that could not be parsed. The connection is
+// closed afterwards since the rest of the stream cannot be made sense of.
+func (c *connection) badRequest(w *response.Writer) {
+	h := response.GetDefaultHeaders(0)
+	h.Replace("Connection", "close")
+	w.WriteStatusLine(response.StatusBadRequest)
+	w.WriteHeaders(*h)
+	w.Finish()
+	if rejected := c.server.options.Rejected; rejected != nil {
+		req := &request.Request{Headers: headers.NewHeaders()}
+		if nc, ok := c.conn.(net.Conn); ok {
+			req.RemoteAddr = nc.RemoteAddr().String()
+		}
+		rejected(w, req)
+	}
+}
+
+func (c *connection) serveSequential() {
+	for first := true; ; first = false {
+		req, err := c.readRequest(first)
+		w := c.newWriter()
+		if err != nil {
+			if first || !idleEnd(err) {
+				c.badRequest(w)
+			}
+			c.conn.Close()
+			return
+		}
+		keep := c.prepare(req, w).run(c.server.handler)
+		if w.Hijacked() {
+			return
+		}
+		if !keep {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// servePipelined keeps reading requests while earlier ones are handled.
+// Each response goes through an orderedWriter that holds it back until the
+// responses before it are complete.
+func (c *connection) servePipelined() {
+	depth := make(chan struct{}, c.server.options.maxPipelineDepth())
+	var closing atomic.Bool
+	hijacked := false
+	prev := make(chan struct{})
+	close(prev)
+	defer func() {
+		<-prev
+		if !hijacked {
+			c.conn.Close()
+		}
+	}()
+
+	for first := true; !closing.Load(); first = false {
+		depth <- struct{}{}
+		req, err := c.readRequest(first)
+		if err != nil {
+			<-prev
+			if !closing.Load() && (first || !idleEnd(err)) {
+				c.badRequest(c.newWriter())
+			}
+			return
+		}
+
+		if c.takesOver(req) {
+			<-prev
+			if closing.Load() {
+				return
+			}
+			w := c.newWriter()
+			keep := c.prepare(req, w).run(c.server.handler)
+			<-depth
+			hijacked = w.Hijacked()
+			if !keep {
+				return
+			}
+			continue
+		}
+
+		out := newOrderedWriter(c.conn, prev, &closing)
+		prev = out.done
+		x := c.prepare(req, response.NewWriterSize(out, c.server.options.writeBufferSize()))
+		// A request that asks to close is the last one read.
+		last := !x.keep
+		go func() {
+			keep := x.run(c.server.handler)
+			out.finish(!keep)
+			if !keep {
+				c.conn.Close()
+			}
+			<-depth
+		}()
+		if last {
+			return
+		}
+	}
+}
+
+// takesOver reports whether a request has to have the connection to itself:
+// it may be hijacked, or its body is only read once the handler asks for it.
+func (c *connection) takesOver(req *request.Request) bool {
+	if req.RequestLine.Method == "CONNECT" {
+		return true
+	}
+	if c.server.options.StreamRequestBodies && req.BodyPending() {
+		return true
+	}
+	_, upgrade := req.Headers.Get("Upgrade")
+	_, expect := req.Headers.Get("Expect")
+	return upgrade || expect
+}
+
+// exchange is one request and the writer for its response.
+type exchange struct {
+	req *request.Request
+	w   *response.Writer
+	// ready is false when the request was already answered with an error.
+	ready bool
+	// keep is whether the connection may carry another request afterwards.
+	keep      bool
+	wroteHead bool
+	http10    bool
+	rejected  func(*response.Writer, *request.Request)
+}
+
+// prepare handles the request's expectations and body before the handler
+// runs.
+func (c *connection) prepare(req *request.Request, w *response.Writer) *exchange {
+	opts := c.server.options
+	http10 := req.RequestLine.HttpVersion == "1.0"
+	x := &exchange{req: req, w: w, ready: true, http10: http10, rejected: opts.Rejected}
+	// HTTP/1.0 connections close after each exchange unless the client
+	// asks for keep-alive.
+	if http10 {
+		x.keep = opts.KeepAlive && hasToken(req.Headers, "Connection", "keep-alive")
+	} else {
+		x.keep = opts.KeepAlive && !hasToken(req.Headers, "Connection", "close")
+	}
+	// Chunked request bodies are not parsed, so the next request cannot be
+	// found after one.
+	if _, ok := req.Headers.Get("Transfer-Encoding"); ok {
+		x.keep = false
+	}
+	w.SetVersion(req.RequestLine.HttpVersion)
+	w.SetConnectionHook(x.connectionHook)
+
+	// Host is only optional before HTTP/1.1 (RFC 9112 section 3.2).
+	if _, ok := req.Headers.Get("Host"); !ok && !http10 {
+		x.ready = false
+		x.keep = false
+		(&HandlerError{StatusCode: response.StatusBadRequest, Message: "Missing Host header"}).Write(w)
+		return x
+	}
+
+	// An HTTP/1.0 client cannot have meant to send Expect, so it is ignored
+	// (RFC 9110 section 10.1.1).
+	expectContinue := false
+	if expect, ok := req.Headers.Get("Expect"); ok && !http10 {
+		if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+			x.ready = false
+			(&HandlerError{StatusCode: response.StatusExpectationFailed, Message: "Unsupported expectation"}).Write(w)
+			return x
+		}
+		expectContinue = req.BodyPending()
+	}
+	req.SetBodyLoader(func() error {
+		// The client only sends the body once it sees 100 Continue, unless
+		// the handler has already answered without needing it.
+		if expectContinue && w.Status() == 0 {
+			if err := w.WriteContinue(); err != nil {
+				return err
+			}
+		}
+		if err := c.reader.ReadBody(req); err != nil {
+			return err
+		}
+		if opts.DecodeRequestBodies {
+			return req.DecodeBody(opts.maxDecodedBodySize())
+		}
+		return nil
+	})
+	req.SetBodyStream(func() (io.Reader, error) {
+		if expectContinue && w.Status() == 0 {
+			if err := w.WriteContinue(); err != nil {
+				return nil, err
+			}
+		}
+		body := c.reader.BodyReader(req)
+		if opts.DecodeRequestBodies {
+			return req.DecodeReader(body, opts.maxDecodedBodySize())
+		}
+		return body, nil
+	})
+	// Without an expectation the body is read up front, so handlers can
+	// use the Body field directly, unless it is left to be streamed.
+	if !expectContinue && !opts.StreamRequestBodies {
+		if _, err := req.ReadBody(); err != nil {
+			x.ready = false
+			x.keep = false
+			BodyError(err).Write(w)
+		}
+	}
+	return x
+}
+
+// connectionHook settles whether the connection stays open once the
+// response headers are final, and tells the client when it does not.
+func (x *exchange) connectionHook(status response.StatusCode, h *headers.Headers) {
+	if status < 200 || x.req.RequestLine.Method == "CONNECT" && status < 300 {
+		return
+	}
+	x.wroteHead = true
+	// A body the client is still holding back would be taken for the next
+	// request.
+	if hasToken(h, "Connection", "close") || x.req.BodyPending() || !framed(x.req, status, h) {
+		x.keep = false
+	}
+	switch {
+	case !x.keep:
+		h.Replace("Connection", "close")
+	case x.http10:
+		h.Replace("Connection", "keep-alive")
+	}
+}
+
+// run calls handler unless the request was already answered, completes the
+// response and reports whether the connection can carry another request.
+func (x *exchange) run(handler Handler) bool {
+	if x.ready {
+		handler(x.w, x.req)
+	}
+	if x.w.Hijacked() {
+		return false
+	}
+	err := x.w.Finish()
+	if !x.ready && x.rejected != nil {
+		x.rejected(x.w, x.req)
+	}
+	if err != nil {
+		return false
+	}
+	return x.keep && x.wroteHead
+}
+
+// hasToken reports whether the comma separated field name lists token.
+func hasToken(h *headers.Headers, name, token string) bool {
+	value, _ := h.Get(name)
+	for _, item := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// framed reports whether the client can tell where the response body ends
+// without the connection being closed.
+func framed(req *request.Request, status response.StatusCode, h *headers.Headers) bool {
+	if req.RequestLine.Method == "HEAD" || status == response.StatusNoContent || status == response.StatusNotModified {
+		return true
+	}
+	if _, ok := h.Get("Content-Length"); ok {
+		return true
+	}
+	te, _ := h.Get("Transfer-Encoding")
+	return strings.Contains(strings.ToLower(te), "chunked")
+}
+
+// orderedWriter buffers a pipelined response until the response before it
+// is complete, then writes straight through to the connection. Once the
+// connection is closing, responses whose turn comes are dropped.
+type orderedWriter struct {
+	mu      sync.Mutex
+	conn    io.Writer
+	closing *atomic.Bool
+	buf     bytes.Buffer
+	direct  bool
+	dropped bool
+	// live is closed once the response is being written to the connection;
+	// done once it is complete, which is the next response's turn.
+	live chan struct{}
+	done chan struct{}
+}
+
+func newOrderedWriter(conn io.Writer, turn <-chan struct{}, closing *atomic.Bool) *orderedWriter {
+	o := &orderedWriter{conn: conn, closing: closing, live: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		<-turn
+		o.mu.Lock()
+		if closing.Load() {
+			o.dropped = true
+		} else if _, err := o.conn.Write(o.buf.Bytes()); err != nil {
+			o.dropped = true
+		}
+		o.buf.Reset()
+		o.direct = true
+		o.mu.Unlock()
+		close(o.live)
+	}()
+	return o
+}
+
+func (o *orderedWriter) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch {
+	case o.dropped:
+		return 0, net.ErrClosed
+	case o.direct:
+		return o.conn.Write(p)
+	}
+	return o.buf.Write(p)
+}
+
+// finish waits until the whole response has reached the connection and
+// then lets the next one through, or marks the connection as closing when
+// this was the last response it carries.
+func (o *orderedWriter) finish(last bool) {
+	<-o.live
+	if last {
+		o.closing.Store(true)
+	}
+	close(o.done)
+}
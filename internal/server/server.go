@@ -1,44 +1,175 @@
 package server
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"sync/atomic"
+	"tcp_http/internal/headers"
 	"tcp_http/internal/request"
 	"tcp_http/internal/response"
+	"time"
 )
 
 type Server struct {
-	closed   bool
+	closed   atomic.Bool
 	handler  Handler
 	listener net.Listener
+	options  Options
+}
+
+// Options tunes how a Server handles its connections. The zero value is
+// usable and matches what Serve does.
+type Options struct {
+	// WriteBufferSize is the size of each connection's response buffer.
+	// Zero uses response.DefaultBufferSize, a negative value disables
+	// buffering.
+	WriteBufferSize int
+	// DecodeRequestBodies undoes a gzip or deflate Content-Encoding on
+	// request bodies before the handler sees them. Other codings are
+	// answered with 415.
+	DecodeRequestBodies bool
+	// StreamRequestBodies leaves request bodies on the connection until the
+	// handler reads them with Request.ReadBody or Request.BodyReader, so a
+	// large upload can be streamed instead of held in memory. Handlers then
+	// must not use the Body field before calling ReadBody.
+	StreamRequestBodies bool
+	// MaxDecodedBodySize caps a decoded request body; larger bodies are
+	// answered with 413. Zero uses DefaultMaxDecodedBodySize.
+	MaxDecodedBodySize int64
+	// KeepAlive keeps connections open for further requests, pipelined
+	// ones included, unless the request or the response asks to close or
+	// the response body is delimited by closing. By default a connection
+	// serves a single request.
+	KeepAlive bool
+	// IdleTimeout bounds the wait for the next request on a kept-alive
+	// connection. Zero uses DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// ConcurrentPipelining runs the handlers of pipelined requests side by
+	// side; their responses are still written in request order. Requests
+	// that take over the connection or wait on "Expect: 100-continue" are
+	// run on their own once the responses before them are out.
+	ConcurrentPipelining bool
+	// MaxPipelineDepth caps how many requests of a connection are read
+	// ahead of the response being written. Zero uses
+	// DefaultMaxPipelineDepth.
+	MaxPipelineDepth int
+	// Rejected is called for each request the server answers itself
+	// without calling the handler: a malformed request or a missing Host
+	// (400), an unsupported expectation (417) or a body that cannot be
+	// read (413, 415 or 400). It runs once the response is complete. A
+	// request that could not be parsed only has RemoteAddr set. Access
+	// logs use it to record what never reaches their middleware.
+	Rejected func(w *response.Writer, req *request.Request)
+}
+
+const (
+	DefaultMaxDecodedBodySize = 10 << 20
+	DefaultIdleTimeout        = 60 * time.Second
+	DefaultMaxPipelineDepth   = 16
+)
+
+func (o Options) idleTimeout() time.Duration {
+	if o.IdleTimeout == 0 {
+		return DefaultIdleTimeout
+	}
+	return o.IdleTimeout
+}
+
+func (o Options) maxPipelineDepth() int {
+	if o.MaxPipelineDepth <= 0 {
+		return DefaultMaxPipelineDepth
+	}
+	return o.MaxPipelineDepth
+}
+
+func (o Options) maxDecodedBodySize() int64 {
+	if o.MaxDecodedBodySize == 0 {
+		return DefaultMaxDecodedBodySize
+	}
+	return o.MaxDecodedBodySize
+}
+
+// BodyError maps a failure to read, decode or bind a request body to the
+// response to send.
+func BodyError(err error) *HandlerError {
+	switch {
+	case errors.Is(err, request.ErrUnsupportedEncoding):
+		h := headers.NewHeaders()
+		h.Set("Accept-Encoding", "gzip, deflate")
+		return &HandlerError{StatusCode: response.StatusUnsupportedMediaType, Message: "Unsupported Content-Encoding", Headers: h}
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return &HandlerError{StatusCode: response.StatusContentTooLarge, Message: "Decoded body too large"}
+	case errors.Is(err, request.ErrContentTooLarge):
+		return &HandlerError{StatusCode: response.StatusContentTooLarge, Message: "Request body too large"}
+	case errors.Is(err, request.ErrUnsupportedMediaType):
+		return &HandlerError{StatusCode: response.StatusUnsupportedMediaType, Message: "Unsupported Content-Type"}
+	case errors.Is(err, request.ErrBadForm):
+		return &HandlerError{StatusCode: response.StatusBadRequest, Message: "Malformed form body"}
+	case errors.Is(err, request.ErrBadJSON):
+		return &HandlerError{StatusCode: response.StatusBadRequest, Message: "Malformed JSON body"}
+	}
+	return &HandlerError{StatusCode: response.StatusBadRequest, Message: "Malformed request body"}
+}
+
+func (o Options) writeBufferSize() int {
+	if o.WriteBufferSize == 0 {
+		return response.DefaultBufferSize
+	}
+	return o.WriteBufferSize
 }
 
 type HandlerError struct {
 	StatusCode response.StatusCode
 	Message    string
+	// Headers are extra response headers, e.g. Allow for a 405.
+	Headers *headers.Headers
+}
+
+func (he *HandlerError) Error() string {
+	return he.Message
+}
+
+// Write renders the error as a plain text response.
+func (he *HandlerError) Write(w *response.Writer) error {
+	body := []byte(he.Message + "\n")
+	h := response.GetDefaultHeaders(len(body))
+	if he.Headers != nil {
+		he.Headers.ForEach(func(n, v string) {
+			h.Delete(n)
+		})
+		he.Headers.ForEach(func(n, v string) {
+			h.Add(n, v)
+		})
+	}
+	if err := w.WriteStatusLine(he.StatusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
+	return err
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
-func runConnection(s *Server, conn io.ReadWriteCloser) {
-	defer conn.Close()
-	responseWriter := response.NewWriter(conn)
+// Middleware wraps a Handler with extra behaviour.
+type Middleware func(Handler) Handler
 
-	r, err := request.RequestFromReader(conn)
-	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(*response.GetDefaultHeaders(0))
-		return
+// Chain wraps handler in middlewares. The first middleware listed is the
+// outermost one and sees the request first.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
 	}
-	s.handler(responseWriter, r)
-
+	return handler
 }
 
 func runServer(s *Server, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
-		if s.closed {
+		if s.closed.Load() {
 			return
 		}
 		if err != nil {
@@ -50,14 +181,18 @@ func runServer(s *Server, listener net.Listener) {
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
+	return ServeWithOptions(port, handler, Options{})
+}
+
+func ServeWithOptions(port int, handler Handler, options Options) (*Server, error) {
 	listener, error := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if error != nil {
 		return nil, error
 	}
 	server := &Server{
-		closed:   false,
 		handler:  handler,
 		listener: listener,
+		options:  options,
 	}
 	go runServer(server, listener)
 
@@ -65,11 +200,16 @@ func Serve(port int, handler Handler) (*Server, error) {
 }
 
 func (s *Server) Close() error {
-	s.closed = true
+	s.closed.Store(true)
 	s.listener.Close()
 	return nil
 }
 
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) Listen() {
 
 }
@@ -0,0 +1,437 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+func echoBody(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(len(req.Body))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(req.Body))
+}
+
+func startServer(t *testing.T, handler Handler, options Options) *Server {
+	s, err := ServeWithOptions(0, handler, options)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// roundTrip sends raw on a new connection and returns everything the server
+// writes until it closes the connection.
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func post(headers, body string) string {
+	return "POST /upload HTTP/1.1\r\nHost: localhost\r\n" + headers +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+}
+
+func TestServe(t *testing.T) {
+	s := startServer(t, echoBody, Options{})
+
+	// Test: Request is answered and the connection closed
+	out := roundTrip(t, s, post("", "hello"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: Malformed request
+	out = roundTrip(t, s, "BREW /pot HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+}
+
+func TestDecodeRequestBodies(t *testing.T) {
+	payload := strings.Repeat("compressed upload ", 100)
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(payload))
+	gz.Close()
+
+	// Test: Bodies are left alone unless decoding is enabled
+	s := startServer(t, echoBody, Options{})
+	out := roundTrip(t, s, post("Content-Encoding: gzip\r\n", buf.String()))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+buf.String()))
+
+	// Test: gzip body is decoded
+	s = startServer(t, echoBody, Options{DecodeRequestBodies: true})
+	out = roundTrip(t, s, post("Content-Encoding: gzip\r\n", buf.String()))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+payload))
+
+	// Test: Unsupported coding
+	out = roundTrip(t, s, post("Content-Encoding: br\r\n", "abc"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+	assert.Contains(t, out, "accept-encoding: gzip, deflate\r\n")
+
+	// Test: Decoded size limit
+	s = startServer(t, echoBody, Options{DecodeRequestBodies: true, MaxDecodedBodySize: 100})
+	out = roundTrip(t, s, post("Content-Encoding: gzip\r\n", buf.String()))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+}
+
+// streamBody echoes a body it reads through Request.BodyReader.
+func streamBody(w *response.Writer, req *request.Request) {
+	body, err := req.BodyReader()
+	if err != nil {
+		BodyError(err).Write(w)
+		return
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		BodyError(err).Write(w)
+		return
+	}
+	h := response.GetDefaultHeaders(len(data))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteBody(data)
+}
+
+func TestStreamRequestBodies(t *testing.T) {
+	// Test: The body is left on the connection for the handler
+	s := startServer(t, func(w *response.Writer, req *request.Request) {
+		assert.True(t, req.BodyPending())
+		assert.Equal(t, "", req.Body)
+		streamBody(w, req)
+	}, Options{StreamRequestBodies: true})
+	out := roundTrip(t, s, post("", "hello"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: A pipelined request after a streamed body is still answered
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method == "POST" {
+			streamBody(w, req)
+			return
+		}
+		echoTarget(w, req)
+	}, Options{StreamRequestBodies: true, KeepAlive: true, ConcurrentPipelining: true})
+	bodies, _ := pipeline(t, s, post("", "hello")+get("/next", "Connection: close\r\n"))
+	assert.Equal(t, []string{"hello", "/next"}, bodies)
+
+	// Test: A body the handler leaves unread closes the connection
+	s = startServer(t, echoTarget, Options{StreamRequestBodies: true, KeepAlive: true})
+	out = roundTrip(t, s, post("", "unread")+get("/next"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: Streamed bodies are decoded
+	payload := strings.Repeat("compressed upload ", 100)
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(payload))
+	gz.Close()
+	s = startServer(t, streamBody, Options{StreamRequestBodies: true, DecodeRequestBodies: true})
+	out = roundTrip(t, s, post("Content-Encoding: gzip\r\n", buf.String()))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+payload))
+}
+
+func TestBindErrors(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) {
+		var v struct {
+			Name string `json:"name"`
+		}
+		if err := req.BindJSON(&v, request.BindOptions{Strict: true, MaxSize: 64}); err != nil {
+			BodyError(err).Write(w)
+			return
+		}
+		h := response.GetDefaultHeaders(len(v.Name))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(v.Name))
+	}, Options{})
+
+	// Test: A bound body reaches the handler
+	out := roundTrip(t, s, post("Content-Type: application/json\r\n", `{"name":"ok"}`))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nok"))
+
+	// Test: Binding errors are rendered as 415, 400 and 413
+	out = roundTrip(t, s, post("Content-Type: text/plain\r\n", `{"name":"ok"}`))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+	out = roundTrip(t, s, post("Content-Type: application/json\r\n", `{"nom":"ok"}`))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.True(t, strings.HasSuffix(out, "Malformed JSON body\n"))
+	out = roundTrip(t, s, post("Content-Type: application/json\r\n", `{"name":"`+strings.Repeat("x", 64)+`"}`))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+}
+
+func TestExpectContinue(t *testing.T) {
+	readBody := func(w *response.Writer, req *request.Request) {
+		body, err := req.ReadBody()
+		if err != nil {
+			BodyError(err).Write(w)
+			return
+		}
+		h := response.GetDefaultHeaders(len(body))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(body))
+	}
+	s := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/reject" {
+			(&HandlerError{StatusCode: response.StatusContentTooLarge, Message: "Too large"}).Write(w)
+			return
+		}
+		readBody(w, req)
+	}, Options{})
+	head := "POST /upload HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+
+	// Test: 100 Continue is sent once the handler reads the body
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(head))
+	require.NoError(t, err)
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	_, err = io.ReadFull(conn, interim)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(interim))
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nhello"))
+
+	// Test: Handler can reject without the body being sent
+	out2 := roundTrip(t, s, strings.Replace(head, "/upload", "/reject", 1))
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.NotContains(t, out2, "100 Continue")
+
+	// Test: Unknown expectations get 417
+	out2 = roundTrip(t, s, post("Expect: teapot\r\n", "hello"))
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: Body is decoded once it arrives
+	s = startServer(t, readBody, Options{DecodeRequestBodies: true})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	out2 = roundTrip(t, s, post("Expect: 100-continue\r\nContent-Encoding: gzip\r\n", gz.String()))
+	assert.True(t, strings.HasPrefix(out2, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out2, "\r\n\r\nhello"))
+}
+
+// readResponses parses every response the server sends until it closes the
+// connection and returns their bodies.
+func readResponses(t *testing.T, conn net.Conn) ([]string, []*response.Response) {
+	reader := response.NewReader(conn)
+	var bodies []string
+	var responses []*response.Response
+	for {
+		resp, err := reader.ReadResponse("GET")
+		if err != nil {
+			return bodies, responses
+		}
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		responses = append(responses, resp)
+	}
+}
+
+func headerValue(h *headers.Headers, name string) string {
+	v, _ := h.Get(name)
+	return v
+}
+
+func pipeline(t *testing.T, s *Server, raw string) ([]string, []*response.Response) {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	return readResponses(t, conn)
+}
+
+func get(target string, extra ...string) string {
+	return "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(extra, "") + "\r\n"
+}
+
+func echoTarget(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.RequestTarget
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: By default a connection serves a single request
+	s := startServer(t, echoTarget, Options{})
+	bodies, responses := pipeline(t, s, get("/a")+get("/b"))
+	assert.Equal(t, []string{"/a"}, bodies)
+	assert.Equal(t, "close", headerValue(responses[0].Headers, "Connection"))
+
+	// Test: Pipelined requests, including bytes left over from a POST, are answered in order
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method == "POST" {
+			echoBody(w, req)
+			return
+		}
+		echoTarget(w, req)
+	}, Options{KeepAlive: true})
+	bodies, responses = pipeline(t, s, get("/a")+post("", "hello")+get("/c", "Connection: close\r\n")+get("/ignored"))
+	assert.Equal(t, []string{"/a", "hello", "/c"}, bodies)
+	assert.Equal(t, "", headerValue(responses[0].Headers, "Connection"))
+	assert.Equal(t, "close", headerValue(responses[2].Headers, "Connection"))
+
+	// Test: A close-delimited response ends the connection
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte("stream"))
+	}, Options{KeepAlive: true})
+	out := roundTrip(t, s, get("/a")+get("/b"))
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: Idle connection is closed quietly after the timeout
+	s = startServer(t, echoTarget, Options{KeepAlive: true, IdleTimeout: 50 * time.Millisecond})
+	bodies, _ = pipeline(t, s, get("/a"))
+	assert.Equal(t, []string{"/a"}, bodies)
+
+	// Test: Malformed follow-up request gets 400 and a close
+	bodies, responses = pipeline(t, s, get("/a")+"BREW /pot HTTP/1.1\r\n\r\n")
+	require.Len(t, responses, 2)
+	assert.Equal(t, response.StatusBadRequest, responses[1].StatusLine.StatusCode)
+
+	// Test: A bad Content-Length gets 400 and its body is not taken for a request
+	for _, options := range []Options{{KeepAlive: true}, {KeepAlive: true, ConcurrentPipelining: true, StreamRequestBodies: true}} {
+		s = startServer(t, echoTarget, options)
+		for _, length := range []string{"abc", "-1", "5, 10", "+5"} {
+			smuggled := get("/smuggled")
+			bodies, responses = pipeline(t, s, "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+length+"\r\n\r\n"+smuggled)
+			require.Len(t, responses, 1, length)
+			assert.Equal(t, response.StatusBadRequest, responses[0].StatusLine.StatusCode, length)
+			assert.Equal(t, "close", headerValue(responses[0].Headers, "Connection"))
+		}
+	}
+
+	// Test: Repeated identical Content-Length values are accepted
+	s = startServer(t, echoBody, Options{KeepAlive: true})
+	bodies, _ = pipeline(t, s, "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"+get("/b", "Connection: close\r\n"))
+	assert.Equal(t, []string{"hello", ""}, bodies)
+}
+
+func TestConcurrentPipelining(t *testing.T) {
+	var active, peak, started, want atomic.Int32
+	slow := func(w *response.Writer, req *request.Request) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		// Wait a little for the other requests, so they overlap if they can.
+		started.Add(1)
+		for deadline := time.Now().Add(200 * time.Millisecond); started.Load() < want.Load() && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		// Earlier requests take longer, so out-of-order completion would show.
+		delay, _ := strconv.Atoi(strings.TrimPrefix(req.RequestLine.RequestTarget, "/"))
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		active.Add(-1)
+		echoTarget(w, req)
+	}
+
+	// Test: Handlers run side by side and responses keep request order
+	want.Store(3)
+	s := startServer(t, slow, Options{KeepAlive: true, ConcurrentPipelining: true})
+	bodies, _ := pipeline(t, s, get("/80")+get("/40")+get("/0", "Connection: close\r\n"))
+	assert.Equal(t, []string{"/80", "/40", "/0"}, bodies)
+	assert.Equal(t, int32(3), peak.Load())
+
+	// Test: Pipeline depth caps the requests in flight
+	peak.Store(0)
+	started.Store(0)
+	want.Store(4)
+	s = startServer(t, slow, Options{KeepAlive: true, ConcurrentPipelining: true, MaxPipelineDepth: 2})
+	bodies, _ = pipeline(t, s, get("/30")+get("/30")+get("/30")+get("/30", "Connection: close\r\n"))
+	assert.Len(t, bodies, 4)
+	assert.Equal(t, int32(2), peak.Load())
+
+	// Test: A response that closes drops the ones after it
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/close" {
+			h := response.GetDefaultHeaders(0)
+			h.Replace("Connection", "close")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(*h)
+			return
+		}
+		echoTarget(w, req)
+	}, Options{KeepAlive: true, ConcurrentPipelining: true})
+	bodies, _ = pipeline(t, s, get("/a")+get("/close")+get("/b"))
+	assert.Equal(t, []string{"/a", ""}, bodies)
+}
+
+func TestHTTP10(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/chunked" {
+			echoTarget(w, req)
+			return
+		}
+		w.WriteEarlyHints("</style.css>; rel=preload")
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(*h)
+		w.WriteChunkedBody([]byte("hello, "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteTrailers(*headers.NewHeaders())
+	}, Options{KeepAlive: true})
+
+	// Test: Host is optional and the connection closes by default
+	out := roundTrip(t, s, "GET /a HTTP/1.0\r\n\r\n"+get("/b"))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.Equal(t, 1, strings.Count(out, "HTTP/1.0"))
+
+	// Test: Keep-alive when the client asks for it
+	bodies, responses := pipeline(t, s, "GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /b HTTP/1.0\r\n\r\n")
+	assert.Equal(t, []string{"/a", "/b"}, bodies)
+	assert.Equal(t, "keep-alive", headerValue(responses[0].Headers, "Connection"))
+	assert.Equal(t, "close", headerValue(responses[1].Headers, "Connection"))
+
+	// Test: Chunked bodies fall back to close-delimited, without interim responses
+	out = roundTrip(t, s, "GET /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n"))
+	assert.NotContains(t, out, "transfer-encoding")
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello, world"))
+
+	// Test: Expect is ignored from HTTP/1.0 clients
+	out = roundTrip(t, s, "POST /a HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n"))
+
+	// Test: HTTP/1.1 requests need a Host
+	out = roundTrip(t, s, "GET /a HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+}
@@ -0,0 +1,114 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore is a Store that keeps one gob encoded file per session in a
+// directory, so sessions survive a restart. Values of types other than
+// the basic ones must be registered with gob.Register. Each file's
+// modification time is set to the session's expiry, which is what the
+// periodic sweep goes by.
+type FileStore struct {
+	dir string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// fileRecord is what a session file holds. The ID is kept so a lookup can
+// tell its session apart from one whose ID hashes the same.
+type fileRecord struct {
+	ID     string
+	Record *Record
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, lastSweep: time.Now()}, nil
+}
+
+func (s *FileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *FileStore) Get(id string) (*Record, bool) {
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	stored := fileRecord{}
+	if err := gob.NewDecoder(f).Decode(&stored); err != nil || stored.ID != id || stored.Record == nil {
+		return nil, false
+	}
+	if stored.Record.expired(time.Now()) {
+		os.Remove(f.Name())
+		return nil, false
+	}
+	return stored.Record, true
+}
+
+// Set writes the session to a temporary file and renames it into place,
+// so a reader never sees a half-written session.
+func (s *FileStore) Set(id string, record *Record) error {
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(fileRecord{ID: id, Record: record}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), record.Expires, record.Expires); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(id)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+	return nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) sweep(now time.Time) {
+	s.lastSweep = now
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if info, err := e.Info(); err == nil && !now.Before(info.ModTime()) {
+			os.Remove(filepath.Join(s.dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+const (
+	DefaultCookieName = "session"
+	DefaultTTL        = 24 * time.Hour
+)
+
+var ErrNoSecret = errors.New("session secret must be at least 32 bytes")
+var ErrEncryptionKey = errors.New("session encryption key must be 16, 24 or 32 bytes")
+
+type Options struct {
+	// Store holds the sessions. Nil uses a new MemoryStore.
+	Store Store
+	// Secret signs session IDs so a client cannot make one up. It must be
+	// at least 32 bytes.
+	Secret []byte
+	// EncryptionKey, when set, also encrypts the cookie with AES-GCM so the
+	// session ID is not visible to the client. It must be an AES key.
+	EncryptionKey []byte
+	// CookieName is the name of the session cookie. Empty uses
+	// DefaultCookieName.
+	CookieName string
+	// TTL is how long a session lasts without requests. Every request that
+	// uses the session extends it. Zero uses DefaultTTL.
+	TTL time.Duration
+	// Domain, Path, Secure and SameSite set the cookie's attributes. Path
+	// defaults to "/" and SameSite to Lax. The cookie is always HttpOnly.
+	Domain   string
+	Path     string
+	Secure   bool
+	SameSite response.SameSite
+}
+
+// Session is the state kept for one client across requests. Handlers get
+// it with FromRequest or use the typed Get and Set.
+type Session struct {
+	mu     sync.Mutex
+	id     string
+	values map[string]any
+	// oldID is a replaced ID whose record is removed on save.
+	oldID string
+	// dirty is set when the session changed since it was last saved.
+	dirty bool
+}
+
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// IsNew reports whether the session has not been stored yet.
+func (s *Session) IsNew() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id == ""
+}
+
+func (s *Session) Value(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *Session) SetValue(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.dirty = true
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	s.dirty = true
+}
+
+// Regenerate moves the session's values to a new ID. Call it whenever the
+// client's privileges change, such as on login, so an ID an attacker
+// planted or saw before is worthless afterwards.
+func (s *Session) Regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.regenerate()
+}
+
+func (s *Session) regenerate() {
+	if s.id != "" && s.oldID == "" {
+		s.oldID = s.id
+	}
+	s.id = ""
+	s.dirty = true
+}
+
+// Destroy removes the session's values from the store and the cookie from
+// the client, e.g. on logout.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[string]any{}
+	s.regenerate()
+}
+
+type contextKey struct{}
+
+// FromRequest returns the request's session, or nil when the session
+// middleware is not in front of the handler.
+func FromRequest(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+// Get returns the session value stored under key if it has type T.
+func Get[T any](req *request.Request, key string) (T, bool) {
+	var zero T
+	s := FromRequest(req)
+	if s == nil {
+		return zero, false
+	}
+	v, ok := s.Value(key)
+	if !ok {
+		return zero, false
+	}
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Set stores value in the request's session under key.
+func Set[T any](req *request.Request, key string, value T) {
+	if s := FromRequest(req); s != nil {
+		s.SetValue(key, value)
+	}
+}
+
+type manager struct {
+	options Options
+	store   Store
+	aead    cipher.AEAD
+}
+
+// Middleware keeps a Session for each client, identified by a signed
+// cookie. A session is only stored and its cookie only sent once a value
+// has been set in it. Each response to a request with a session extends
+// its expiry and sends the cookie again.
+func Middleware(options Options) (server.Middleware, error) {
+	if len(options.Secret) < 32 {
+		return nil, ErrNoSecret
+	}
+	m := &manager{options: options, store: options.Store}
+	if m.store == nil {
+		m.store = NewMemoryStore()
+	}
+	if options.EncryptionKey != nil {
+		block, err := aes.NewCipher(options.EncryptionKey)
+		if err != nil {
+			return nil, ErrEncryptionKey
+		}
+		if m.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if m.options.CookieName == "" {
+		m.options.CookieName = DefaultCookieName
+	}
+	if m.options.TTL == 0 {
+		m.options.TTL = DefaultTTL
+	}
+	if m.options.Path == "" {
+		m.options.Path = "/"
+	}
+	if m.options.SameSite == response.SameSiteDefault {
+		m.options.SameSite = response.SameSiteLax
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			m.serve(w, req, next)
+		}
+	}, nil
+}
+
+func (m *manager) serve(w *response.Writer, req *request.Request, next server.Handler) {
+	s := m.load(req)
+	req.SetContext(context.WithValue(req.Context(), contextKey{}, s))
+	sent := false
+	w.AddHeaderHook(func(status response.StatusCode, h *headers.Headers) response.Encoder {
+		sent = true
+		if cookie := m.save(s); cookie != nil {
+			response.SetCookie(h, cookie)
+		}
+		return nil
+	})
+	next(w, req)
+	// Changes made once the headers are out are still stored, but a new ID
+	// cannot reach the client any more.
+	s.mu.Lock()
+	late := sent && s.dirty && s.id != ""
+	s.mu.Unlock()
+	if !sent || late {
+		m.save(s)
+	}
+}
+
+// load finds the session named by the request's cookie, or starts a new
+// one.
+func (m *manager) load(req *request.Request) *Session {
+	s := &Session{values: map[string]any{}}
+	value, ok := req.Cookie(m.options.CookieName)
+	if !ok {
+		return s
+	}
+	id, ok := m.decode(value)
+	if !ok {
+		return s
+	}
+	if record, ok := m.store.Get(id); ok {
+		s.id = id
+		s.values = maps.Clone(record.Values)
+		if s.values == nil {
+			s.values = map[string]any{}
+		}
+	} else {
+		// Remove the stale cookie if nothing is stored in its place.
+		s.oldID = id
+	}
+	return s
+}
+
+// save stores the session and returns the cookie to send, if any.
+func (m *manager) save(s *Session) *response.Cookie {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = false
+	if s.oldID != "" {
+		m.store.Delete(s.oldID)
+	}
+	if len(s.values) == 0 {
+		hadCookie := s.id != "" || s.oldID != ""
+		if s.id != "" {
+			m.store.Delete(s.id)
+		}
+		s.id, s.oldID = "", ""
+		if !hadCookie {
+			return nil
+		}
+		cookie := m.cookie("")
+		cookie.MaxAge = -1
+		return cookie
+	}
+	s.oldID = ""
+	if s.id == "" {
+		s.id = newID()
+	}
+	record := &Record{Values: maps.Clone(s.values), Expires: time.Now().Add(m.options.TTL)}
+	if err := m.store.Set(s.id, record); err != nil {
+		return nil
+	}
+	cookie := m.cookie(m.encode(s.id))
+	cookie.MaxAge = int(m.options.TTL / time.Second)
+	return cookie
+}
+
+func (m *manager) cookie(value string) *response.Cookie {
+	return &response.Cookie{
+		Name:     m.options.CookieName,
+		Value:    value,
+		Domain:   m.options.Domain,
+		Path:     m.options.Path,
+		Secure:   m.options.Secure,
+		HttpOnly: true,
+		SameSite: m.options.SameSite,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (m *manager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.options.Secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encode turns an ID into a cookie value: the ID and its signature,
+// encrypted when there is an encryption key.
+func (m *manager) encode(id string) string {
+	signed := id + "." + m.sign(id)
+	if m.aead == nil {
+		return signed
+	}
+	nonce := make([]byte, m.aead.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(m.aead.Seal(nonce, nonce, []byte(signed), nil))
+}
+
+func (m *manager) decode(value string) (string, bool) {
+	if m.aead != nil {
+		sealed, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(sealed) < m.aead.NonceSize() {
+			return "", false
+		}
+		nonce, ciphertext := sealed[:m.aead.NonceSize()], sealed[m.aead.NonceSize():]
+		plain, err := m.aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return "", false
+		}
+		value = string(plain)
+	}
+	id, signature, ok := strings.Cut(value, ".")
+	if !ok || id == "" || !hmac.Equal([]byte(signature), []byte(m.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+	"tcp_http/internal/server"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+// app counts visits and logs users in and out, depending on the target.
+func app(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/login":
+		session := FromRequest(req)
+		session.Regenerate()
+		Set(req, "user", "ada")
+	case "/logout":
+		FromRequest(req).Destroy()
+	case "/visit":
+		visits, _ := Get[int](req, "visits")
+		Set(req, "visits", visits+1)
+	}
+	user, _ := Get[string](req, "user")
+	visits, _ := Get[int](req, "visits")
+	body := user + ":" + strings.Repeat("*", visits)
+	h := response.GetDefaultHeaders(len(body))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+// do runs one request through handler, sending cookie when it is set, and
+// returns the body and the session cookie the response sets.
+func do(t *testing.T, handler server.Handler, target, cookie string) (string, string) {
+	raw := "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	if cookie != "" {
+		raw += "Cookie: " + cookie + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	resp, err := response.NewReader(out).ReadResponse("GET")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	setCookies := resp.Headers.Values("Set-Cookie")
+	require.LessOrEqual(t, len(setCookies), 1)
+	if len(setCookies) == 0 {
+		return string(body), ""
+	}
+	return string(body), setCookies[0]
+}
+
+// cookieValue returns the name=value part of a Set-Cookie line.
+func cookieValue(setCookie string) string {
+	value, _, _ := strings.Cut(setCookie, ";")
+	return value
+}
+
+func TestSession(t *testing.T) {
+	store := NewMemoryStore()
+	mw, err := Middleware(Options{Store: store, Secret: secret, TTL: time.Hour})
+	require.NoError(t, err)
+	handler := server.Chain(app, mw)
+
+	// Test: No cookie is sent until something is stored
+	body, setCookie := do(t, handler, "/", "")
+	assert.Equal(t, ":", body)
+	assert.Empty(t, setCookie)
+	assert.Equal(t, 0, store.Len())
+
+	// Test: Values are kept across requests with their types
+	body, setCookie = do(t, handler, "/visit", "")
+	assert.Equal(t, ":*", body)
+	assert.Contains(t, setCookie, "; Max-Age=3600; Path=/; HttpOnly; SameSite=Lax")
+	cookie := cookieValue(setCookie)
+	body, setCookie = do(t, handler, "/visit", cookie)
+	assert.Equal(t, ":**", body)
+	// Test: The expiry slides with every request
+	assert.Equal(t, cookie, cookieValue(setCookie))
+
+	// Test: A tampered cookie starts a new session
+	name, value, _ := strings.Cut(cookie, "=")
+	id, _, _ := strings.Cut(value, ".")
+	body, _ = do(t, handler, "/", name+"="+id+".forged")
+	assert.Equal(t, ":", body)
+
+	// Test: Regenerate moves the values to a new ID and drops the old one
+	body, setCookie = do(t, handler, "/login", cookie)
+	assert.Equal(t, "ada:**", body)
+	loggedIn := cookieValue(setCookie)
+	assert.NotEqual(t, cookie, loggedIn)
+	body, _ = do(t, handler, "/", cookie)
+	assert.Equal(t, ":", body)
+	body, _ = do(t, handler, "/", loggedIn)
+	assert.Equal(t, "ada:**", body)
+	assert.Equal(t, 1, store.Len())
+
+	// Test: Destroy deletes the session and expires the cookie
+	body, setCookie = do(t, handler, "/logout", loggedIn)
+	assert.Equal(t, ":", body)
+	assert.Contains(t, setCookie, "session=; Max-Age=0")
+	assert.Equal(t, 0, store.Len())
+	body, _ = do(t, handler, "/", loggedIn)
+	assert.Equal(t, ":", body)
+
+	// Test: A short secret is refused
+	_, err = Middleware(Options{Secret: []byte("short")})
+	assert.ErrorIs(t, err, ErrNoSecret)
+}
+
+func TestEncryptedSession(t *testing.T) {
+	mw, err := Middleware(Options{Secret: secret, EncryptionKey: bytes.Repeat([]byte("k"), 32), CookieName: "sid"})
+	require.NoError(t, err)
+	handler := server.Chain(app, mw)
+
+	// Test: The cookie does not reveal the ID and still round trips
+	var id string
+	_, setCookie := do(t, handler, "/visit", "")
+	require.True(t, strings.HasPrefix(setCookie, "sid="))
+	cookie := cookieValue(setCookie)
+	capture := func(w *response.Writer, req *request.Request) {
+		id = FromRequest(req).ID()
+		app(w, req)
+	}
+	body, _ := do(t, server.Chain(capture, mw), "/", cookie)
+	assert.Equal(t, ":*", body)
+	require.NotEmpty(t, id)
+	assert.NotContains(t, cookie, id)
+
+	// Test: A signed but unencrypted cookie is not accepted
+	plain, err := Middleware(Options{Secret: secret, CookieName: "sid"})
+	require.NoError(t, err)
+	_, setCookie = do(t, server.Chain(app, plain), "/visit", "")
+	body, _ = do(t, handler, "/", cookieValue(setCookie))
+	assert.Equal(t, ":", body)
+
+	// Test: A bad encryption key is refused
+	_, err = Middleware(Options{Secret: secret, EncryptionKey: []byte("short")})
+	assert.ErrorIs(t, err, ErrEncryptionKey)
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Record is a stored session.
+type Record struct {
+	Values  map[string]any
+	Expires time.Time
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return !now.Before(r.Expires)
+}
+
+// Store keeps sessions by ID. Records handed to and returned by a Store
+// must not be modified. A Store does not return a record past its
+// expiry. Implementations must be safe for concurrent use.
+type Store interface {
+	Get(id string) (*Record, bool)
+	Set(id string, record *Record) error
+	Delete(id string) error
+}
+
+// sweepInterval is how often stores look for expired sessions to remove.
+const sweepInterval = time.Minute
+
+// MemoryStore is a Store that holds sessions in memory. Expired sessions
+// are dropped when they are looked up and swept out periodically as new
+// ones are stored.
+type MemoryStore struct {
+	mu        sync.Mutex
+	records   map[string]*Record
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]*Record{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryStore) Get(id string) (*Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, false
+	}
+	if record.expired(time.Now()) {
+		delete(s.records, id)
+		return nil, false
+	}
+	return record, true
+}
+
+func (s *MemoryStore) Set(id string, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[id] = record
+	if now := time.Now(); now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+// Len returns the number of sessions held, expired ones not yet swept
+// included.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	s.lastSweep = now
+	for id, record := range s.records {
+		if record.expired(now) {
+			delete(s.records, id)
+		}
+	}
+}
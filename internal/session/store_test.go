@@ -0,0 +1,75 @@
+package session
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	live := &Record{Values: map[string]any{"n": 1}, Expires: time.Now().Add(time.Hour)}
+	expired := &Record{Values: map[string]any{"n": 2}, Expires: time.Now().Add(-time.Second)}
+
+	// Test: Live records are returned, expired ones dropped on lookup
+	require.NoError(t, s.Set("live", live))
+	require.NoError(t, s.Set("expired", expired))
+	got, ok := s.Get("live")
+	require.True(t, ok)
+	assert.Equal(t, 1, got.Values["n"])
+	_, ok = s.Get("expired")
+	assert.False(t, ok)
+	assert.Equal(t, 1, s.Len())
+
+	// Test: The sweep removes expired records nobody looks up
+	require.NoError(t, s.Set("expired", expired))
+	s.lastSweep = time.Now().Add(-sweepInterval)
+	require.NoError(t, s.Set("other", live))
+	assert.Equal(t, 2, s.Len())
+
+	// Test: Delete
+	require.NoError(t, s.Delete("live"))
+	_, ok = s.Get("live")
+	assert.False(t, ok)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+	live := &Record{Values: map[string]any{"user": "ada", "visits": 3}, Expires: time.Now().Add(time.Hour)}
+
+	// Test: Records keep their value types and survive a new store
+	require.NoError(t, s.Set("abc", live))
+	s, err = NewFileStore(dir)
+	require.NoError(t, err)
+	got, ok := s.Get("abc")
+	require.True(t, ok)
+	assert.Equal(t, "ada", got.Values["user"])
+	assert.Equal(t, 3, got.Values["visits"])
+
+	// Test: Expired records are removed on lookup
+	require.NoError(t, s.Set("old", &Record{Values: map[string]any{"a": 1}, Expires: time.Now().Add(-time.Second)}))
+	_, ok = s.Get("old")
+	assert.False(t, ok)
+	_, err = os.Stat(s.path("old"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: The sweep removes expired files nobody looks up
+	require.NoError(t, s.Set("old", &Record{Values: map[string]any{"a": 1}, Expires: time.Now().Add(-time.Second)}))
+	s.lastSweep = time.Now().Add(-sweepInterval)
+	require.NoError(t, s.Set("new", live))
+	_, err = os.Stat(s.path("old"))
+	assert.True(t, os.IsNotExist(err))
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 2)
+
+	// Test: Delete, also of a missing record
+	require.NoError(t, s.Delete("abc"))
+	require.NoError(t, s.Delete("abc"))
+	_, ok = s.Get("abc")
+	assert.False(t, ok)
+}
@@ -0,0 +1,185 @@
+package sse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+var ErrInvalidField = errors.New("sse field must not contain line breaks")
+var ErrClosed = errors.New("sse stream closed")
+
+const DefaultHeartbeat = 15 * time.Second
+
+// Event is a single server-sent event. Only Data is required.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Stream writes events to a text/event-stream response. Events may be sent
+// from several goroutines.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	err    error
+	done   chan struct{}
+	ticker *time.Ticker
+}
+
+// NewStream writes the response head for an event stream and starts sending
+// heartbeat comments every heartbeat interval (DefaultHeartbeat when zero,
+// disabled when negative). Heartbeats keep proxies from timing out the idle
+// connection and are how a client that went away gets noticed: the first
+// write that fails closes the stream and Done is signalled.
+func NewStream(w *response.Writer, req *request.Request, heartbeat time.Duration) (*Stream, error) {
+	h := response.GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Replace("Content-Type", "text/event-stream")
+	h.Replace("Cache-Control", "no-cache")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:    w,
+		done: make(chan struct{}),
+	}
+	s.lastEventID, _ = req.Headers.Get("Last-Event-ID")
+	// The heartbeat must not write once the server finishes the response,
+	// which it does as soon as the handler returns.
+	w.AddFinishHook(s.Close)
+
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeat
+	}
+	if heartbeat > 0 {
+		s.ticker = time.NewTicker(heartbeat)
+		go s.heartbeat()
+	}
+	return s, nil
+}
+
+// LastEventID is the id the client last saw before reconnecting, taken from
+// the Last-Event-ID request header. It is empty on a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream has stopped, either because Close was
+// called or because the client disconnected.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Stream) heartbeat() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ticker.C:
+			s.Comment("heartbeat")
+		}
+	}
+}
+
+func encodeEvent(e Event) ([]byte, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return nil, ErrInvalidField
+	}
+
+	b := []byte{}
+	if e.Event != "" {
+		b = fmt.Appendf(b, "event: %s\n", e.Event)
+	}
+	if e.ID != "" {
+		b = fmt.Appendf(b, "id: %s\n", e.ID)
+	}
+	if e.Retry > 0 {
+		b = fmt.Appendf(b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	// Every line of the payload gets its own data field; the client joins
+	// them back together with "\n".
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b = fmt.Appendf(b, "data: %s\n", line)
+	}
+	b = append(b, '\n')
+	return b, nil
+}
+
+// write sends one complete event or comment and flushes it so it reaches
+// the client as soon as it is produced.
+func (s *Stream) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.w.WriteBody(b)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.stop(err)
+		return err
+	}
+	return nil
+}
+
+// stop records why the stream ended and signals Done. Callers hold s.mu.
+func (s *Stream) stop(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	close(s.done)
+}
+
+func (s *Stream) Send(e Event) error {
+	b, err := encodeEvent(e)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+// Comment sends a comment, which clients ignore. Each line of text gets
+// its own comment line, so no line ending in it can start a field.
+func (s *Stream) Comment(text string) error {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	b := []byte{}
+	for _, line := range strings.Split(text, "\n") {
+		b = fmt.Appendf(b, ": %s\n", line)
+	}
+	return s.write(append(b, '\n'))
+}
+
+// Close stops the heartbeat. It also runs when the response is finished,
+// so a handler may return without calling it. The connection itself is
+// closed by the server once the handler returns.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop(ErrClosed)
+}
@@ -0,0 +1,111 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+// syncBuffer is a bytes.Buffer that can fail on demand, standing in for a
+// connection whose client went away.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	broken bool
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.broken {
+		return 0, errors.New("broken pipe")
+	}
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newRequest(t *testing.T, extraHeaders string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost:42069\r\n" + extraHeaders + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestEncodeEvent(t *testing.T) {
+	// Test: All fields
+	b, err := encodeEvent(Event{ID: "7", Event: "progress", Data: "50%", Retry: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "event: progress\nid: 7\nretry: 3000\ndata: 50%\n\n", string(b))
+
+	// Test: Multi-line data
+	b, err = encodeEvent(Event{Data: "line one\r\nline two\nline three"})
+	require.NoError(t, err)
+	assert.Equal(t, "data: line one\ndata: line two\ndata: line three\n\n", string(b))
+
+	// Test: Line break in the event name
+	_, err = encodeEvent(Event{Event: "bad\nname", Data: "x"})
+	require.ErrorIs(t, err, ErrInvalidField)
+}
+
+func TestStream(t *testing.T) {
+	// Test: Headers, events and Last-Event-ID
+	out := &syncBuffer{}
+	s, err := NewStream(response.NewWriter(out), newRequest(t, "Last-Event-ID: 41\r\n"), -1)
+	require.NoError(t, err)
+	assert.Equal(t, "41", s.LastEventID())
+	require.NoError(t, s.Send(Event{ID: "42", Data: "hello"}))
+	require.NoError(t, s.Comment("still here"))
+	require.NoError(t, s.Comment("a\rdata: x\r\nb"))
+	s.Close()
+
+	written := out.String()
+	assert.True(t, strings.HasPrefix(written, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, written, "content-type: text/event-stream\r\n")
+	assert.Contains(t, written, "cache-control: no-cache\r\n")
+	assert.NotContains(t, written, "content-length")
+	assert.True(t, strings.HasSuffix(written, "\r\n\r\nid: 42\ndata: hello\n\n: still here\n\n: a\n: data: x\n: b\n\n"))
+	require.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+
+	// Test: Heartbeat notices the client went away
+	out = &syncBuffer{}
+	s, err = NewStream(response.NewWriter(out), newRequest(t, ""), 10*time.Millisecond)
+	require.NoError(t, err)
+	out.mu.Lock()
+	out.broken = true
+	out.mu.Unlock()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream not stopped after the client disconnected")
+	}
+	require.Error(t, s.Send(Event{Data: "gone"}))
+
+	// Test: Finishing the response stops a stream the handler left open
+	out = &syncBuffer{}
+	w := response.NewWriter(out)
+	s, err = NewStream(w, newRequest(t, ""), time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, w.Finish())
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("stream still running after the response was finished")
+	}
+	finished := out.String()
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, finished, out.String())
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// permessage-deflate (RFC 7692). Both directions are negotiated without
+// context takeover so every message is compressed on its own and no
+// sliding window has to be kept between messages.
+
+const deflateExtension = "permessage-deflate"
+
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+type extensionOffer struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions splits a Sec-WebSocket-Extensions value into its offers,
+// e.g. "permessage-deflate; client_max_window_bits, x-foo".
+func parseExtensions(value string) []extensionOffer {
+	offers := []extensionOffer{}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			continue
+		}
+		offer := extensionOffer{name: strings.ToLower(name), params: map[string]string{}}
+		for _, p := range parts[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			offer.params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+// acceptDeflate reports whether a permessage-deflate offer can be honoured.
+// compress/flate always uses a 32KB window, so an offer that restricts the
+// server window to anything smaller has to be declined.
+func acceptDeflate(offer extensionOffer) bool {
+	for k, v := range offer.params {
+		switch k {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if v != "" {
+				return false
+			}
+		case "client_max_window_bits":
+			if v != "" && !validWindowBits(v) {
+				return false
+			}
+		case "server_max_window_bits":
+			if v != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validWindowBits(v string) bool {
+	n, err := strconv.Atoi(v)
+	return err == nil && n >= 8 && n <= 15
+}
+
+func negotiateDeflate(value string) (string, bool) {
+	for _, offer := range parseExtensions(value) {
+		if offer.name == deflateExtension && acceptDeflate(offer) {
+			return deflateExtension + "; server_no_context_takeover; client_no_context_takeover", true
+		}
+	}
+	return "", false
+}
+
+func compressMessage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompressMessage inflates a message payload. limit caps the inflated size
+// so a small frame cannot expand into an arbitrarily large message.
+func decompressMessage(data []byte, limit int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	fr := flate.NewReader(src)
+	defer fr.Close()
+
+	var r io.Reader = fr
+	if limit > 0 {
+		r = io.LimitReader(fr, limit+1)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if limit > 0 && int64(len(out)) > limit {
+		return nil, ErrMessageTooBig
+	}
+	return out, nil
+}
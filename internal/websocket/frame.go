@@ -0,0 +1,176 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xA
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+	rsv3Bit = 0x10
+	maskBit = 0x80
+
+	maxControlPayload = 125
+)
+
+var ErrProtocol = fmt.Errorf("websocket protocol error")
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  opcode
+	masked  bool
+	payload []byte
+}
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+func (op opcode) valid() bool {
+	switch op {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+		return true
+	}
+	return false
+}
+
+// readFrame reads a single frame from r. limit caps the payload size; a
+// value <= 0 or above MaxReadLimit is taken as MaxReadLimit. An oversized
+// length is rejected before anything is allocated for the payload.
+func readFrame(r io.Reader, limit int64) (*frame, error) {
+	if limit <= 0 || limit > MaxReadLimit {
+		limit = MaxReadLimit
+	}
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    head[0]&finBit != 0,
+		rsv1:   head[0]&rsv1Bit != 0,
+		opcode: opcode(head[0] & 0x0F),
+		masked: head[1]&maskBit != 0,
+	}
+	if head[0]&(rsv2Bit|rsv3Bit) != 0 {
+		return nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	if !f.opcode.valid() {
+		return nil, fmt.Errorf("%w: unknown opcode %d", ErrProtocol, f.opcode)
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+		if length>>63 != 0 {
+			return nil, fmt.Errorf("%w: invalid payload length", ErrProtocol)
+		}
+	}
+
+	if f.opcode.isControl() {
+		if !f.fin {
+			return nil, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if length > maxControlPayload {
+			return nil, fmt.Errorf("%w: control frame too large", ErrProtocol)
+		}
+	}
+	if length > uint64(limit) {
+		return nil, ErrMessageTooBig
+	}
+
+	var key [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// writeFrame encodes f onto w, masking the payload when f.masked is set.
+func writeFrame(w io.Writer, f *frame) error {
+	b := make([]byte, 0, 14+len(f.payload))
+
+	first := byte(f.opcode)
+	if f.fin {
+		first |= finBit
+	}
+	if f.rsv1 {
+		first |= rsv1Bit
+	}
+	b = append(b, first)
+
+	var second byte
+	if f.masked {
+		second = maskBit
+	}
+	length := len(f.payload)
+	switch {
+	case length <= 125:
+		b = append(b, second|byte(length))
+	case length <= 0xFFFF:
+		b = append(b, second|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, second|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+
+	if f.masked {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		b = append(b, key[:]...)
+		start := len(b)
+		b = append(b, f.payload...)
+		maskBytes(key, b[start:])
+	} else {
+		b = append(b, f.payload...)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
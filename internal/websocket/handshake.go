@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"tcp_http/internal/headers"
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = fmt.Errorf("bad websocket handshake")
+var ErrOriginNotAllowed = fmt.Errorf("websocket origin not allowed")
+
+// Upgrader turns an HTTP request into a WebSocket connection.
+type Upgrader struct {
+	// Subprotocols lists the supported subprotocols in order of preference.
+	Subprotocols []string
+	// EnableCompression negotiates permessage-deflate when the client offers it.
+	EnableCompression bool
+	// CheckOrigin rejects the handshake with 403 when it returns false. A nil
+	// CheckOrigin accepts every origin.
+	CheckOrigin func(req *request.Request) bool
+	// ReadLimit caps the size of a single incoming message. Zero uses
+	// DefaultReadLimit, and values above MaxReadLimit are lowered to it.
+	ReadLimit int64
+}
+
+const (
+	// DefaultReadLimit is the message size limit of an Upgrader that sets
+	// none.
+	DefaultReadLimit = 16 << 20
+	// MaxReadLimit is the hard cap on an incoming message, so a forged
+	// length cannot make the reader allocate without bound.
+	MaxReadLimit = 1 << 30
+)
+
+func (u *Upgrader) readLimit() int64 {
+	switch {
+	case u.ReadLimit <= 0:
+		return DefaultReadLimit
+	case u.ReadLimit > MaxReadLimit:
+		return MaxReadLimit
+	}
+	return u.ReadLimit
+}
+
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerTokens returns the comma separated tokens of a header, lower cased.
+func headerTokens(h *headers.Headers, name string) []string {
+	value, ok := h.Get(name)
+	if !ok {
+		return nil
+	}
+	tokens := []string{}
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, strings.ToLower(t))
+		}
+	}
+	return tokens
+}
+
+func hasToken(h *headers.Headers, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUpgrade reports whether req asks to be upgraded to a WebSocket.
+func IsUpgrade(req *request.Request) bool {
+	return hasToken(req.Headers, "Connection", "upgrade") && hasToken(req.Headers, "Upgrade", "websocket")
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := headerTokens(req.Headers, "Sec-WebSocket-Protocol")
+	for _, supported := range u.Subprotocols {
+		for _, o := range offered {
+			if strings.EqualFold(o, supported) {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+func reject(w *response.Writer, status response.StatusCode, extra *headers.Headers) {
+	body := []byte(fmt.Sprintf("%d websocket handshake failed\n", status))
+	h := response.GetDefaultHeaders(len(body))
+	if extra != nil {
+		extra.ForEach(func(n, v string) {
+			h.Replace(n, v)
+		})
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
+}
+
+// Upgrade validates the opening handshake, writes the 101 response and takes
+// over the connection. On failure an error response has already been written
+// and the handler should simply return.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if req.RequestLine.Method != "GET" || !IsUpgrade(req) {
+		reject(w, response.StatusBadRequest, nil)
+		return nil, ErrBadHandshake
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); version != "13" {
+		extra := headers.NewHeaders()
+		extra.Set("Sec-WebSocket-Version", "13")
+		reject(w, response.StatusUpgradeRequired, extra)
+		return nil, ErrBadHandshake
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		reject(w, response.StatusBadRequest, nil)
+		return nil, ErrBadHandshake
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(req) {
+		reject(w, response.StatusForbidden, nil)
+		return nil, ErrOriginNotAllowed
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", computeAcceptKey(key))
+
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	compress := false
+	if offer, ok := req.Headers.Get("Sec-WebSocket-Extensions"); ok && u.EnableCompression {
+		var ext string
+		ext, compress = negotiateDeflate(offer)
+		if compress {
+			h.Set("Sec-WebSocket-Extensions", ext)
+		}
+	}
+
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return nil, err
+	}
+	conn, reader, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(conn, reader, true)
+	c.subprotocol = subprotocol
+	c.compress = compress
+	c.readLimit = u.readLimit()
+	return c, nil
+}
@@ -0,0 +1,300 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+type CloseCode uint16
+
+const (
+	CloseNormal             CloseCode = 1000
+	CloseGoingAway          CloseCode = 1001
+	CloseProtocolError      CloseCode = 1002
+	CloseUnsupportedData    CloseCode = 1003
+	CloseNoStatus           CloseCode = 1005
+	CloseAbnormal           CloseCode = 1006
+	CloseInvalidPayload     CloseCode = 1007
+	ClosePolicyViolation    CloseCode = 1008
+	CloseMessageTooBig      CloseCode = 1009
+	CloseMandatoryExtension CloseCode = 1010
+	CloseInternalError      CloseCode = 1011
+)
+
+// CloseError is returned by ReadMessage once the peer has sent a close frame.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+var ErrMessageTooBig = errors.New("websocket message too big")
+var ErrInvalidUTF8 = errors.New("websocket text message is not valid utf-8")
+var ErrClosed = errors.New("websocket connection closed")
+
+// Conn is a message oriented WebSocket connection. One goroutine may read
+// while others write; writes are serialised internally.
+type Conn struct {
+	conn     io.ReadWriteCloser
+	reader   *bufio.Reader
+	isServer bool
+
+	subprotocol string
+	compress    bool
+	readLimit   int64
+
+	// PongHandler is called with the payload of every pong received.
+	PongHandler func(data []byte)
+
+	writeMu    sync.Mutex
+	closeSent  bool
+	closeOnce  sync.Once
+	closeError error
+}
+
+func newConn(conn io.ReadWriteCloser, reader *bufio.Reader, isServer bool) *Conn {
+	return &Conn{
+		conn:      conn,
+		reader:    reader,
+		isServer:  isServer,
+		readLimit: DefaultReadLimit,
+	}
+}
+
+// Subprotocol returns the negotiated subprotocol, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compressed reports whether permessage-deflate was negotiated.
+func (c *Conn) Compressed() bool {
+	return c.compress
+}
+
+func (c *Conn) writeFrame(f *frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if f.opcode == opClose {
+		c.closeSent = true
+	}
+	// Only clients mask their frames (RFC 6455 section 5.1).
+	f.masked = !c.isServer
+	return writeFrame(c.conn, f)
+}
+
+// WriteMessage sends data as a single unfragmented message.
+func (c *Conn) WriteMessage(mt MessageType, data []byte) error {
+	if mt != TextMessage && mt != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", mt)
+	}
+	f := &frame{fin: true, opcode: opcode(mt), payload: data}
+	if c.compress {
+		compressed, err := compressMessage(data)
+		if err != nil {
+			return err
+		}
+		f.payload = compressed
+		f.rsv1 = true
+	}
+	return c.writeFrame(f)
+}
+
+// WriteFragmented sends data as a message split into frames of at most
+// fragmentSize bytes.
+func (c *Conn) WriteFragmented(mt MessageType, data []byte, fragmentSize int) error {
+	if fragmentSize <= 0 || len(data) <= fragmentSize {
+		return c.WriteMessage(mt, data)
+	}
+	op := opcode(mt)
+	for len(data) > 0 {
+		n := min(fragmentSize, len(data))
+		f := &frame{fin: n == len(data), opcode: op, payload: data[:n]}
+		if err := c.writeFrame(f); err != nil {
+			return err
+		}
+		data = data[n:]
+		op = opContinuation
+	}
+	return nil
+}
+
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrMessageTooBig
+	}
+	return c.writeFrame(&frame{fin: true, opcode: opPing, payload: data})
+}
+
+func closePayload(code CloseCode, reason string) []byte {
+	if code == CloseNoStatus {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	b = append(b, reason...)
+	if len(b) > maxControlPayload {
+		b = b[:maxControlPayload]
+	}
+	return b
+}
+
+// Close sends a close frame with the given code and closes the connection.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	err := c.writeFrame(&frame{fin: true, opcode: opClose, payload: closePayload(code, reason)})
+	if errors.Is(err, ErrClosed) {
+		err = nil
+	}
+	c.closeOnce.Do(func() {
+		c.closeError = c.conn.Close()
+	})
+	if err != nil {
+		return err
+	}
+	return c.closeError
+}
+
+// fail closes the connection with code after a protocol violation and
+// returns the original error to the reader.
+func (c *Conn) fail(code CloseCode, err error) error {
+	c.Close(code, "")
+	return err
+}
+
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, ErrProtocol)
+	case len(payload) >= 2:
+		closeErr.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, ErrProtocol)
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseInvalidPayload, ErrInvalidUTF8)
+		}
+	}
+	c.Close(closeErr.Code, "")
+	return closeErr
+}
+
+func (c *Conn) readLimitLeft(have int) int64 {
+	left := c.readLimit - int64(have)
+	if left <= 0 {
+		return -1
+	}
+	return left
+}
+
+// ReadMessage returns the next complete data message. Fragmented messages
+// are reassembled, pings are answered and pongs passed to PongHandler. When
+// the peer closes the connection a *CloseError is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		mt         MessageType
+		message    []byte
+		compressed bool
+		inMessage  bool
+	)
+
+	for {
+		limit := c.readLimitLeft(len(message))
+		if limit < 0 {
+			return 0, nil, c.fail(CloseMessageTooBig, ErrMessageTooBig)
+		}
+		f, err := readFrame(c.reader, limit)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrMessageTooBig):
+				return 0, nil, c.fail(CloseMessageTooBig, err)
+			case errors.Is(err, ErrProtocol):
+				return 0, nil, c.fail(CloseProtocolError, err)
+			}
+			return 0, nil, err
+		}
+		if c.isServer && !f.masked {
+			return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: unmasked client frame", ErrProtocol))
+		}
+		if f.rsv1 && (!c.compress || f.opcode.isControl() || f.opcode == opContinuation) {
+			return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: unexpected rsv1", ErrProtocol))
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(&frame{fin: true, opcode: opPong, payload: f.payload}); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.PongHandler != nil {
+				c.PongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: expected continuation frame", ErrProtocol))
+			}
+			inMessage = true
+			mt = MessageType(f.opcode)
+			compressed = f.rsv1
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, c.fail(CloseProtocolError, fmt.Errorf("%w: unexpected continuation frame", ErrProtocol))
+			}
+		}
+
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			message, err = decompressMessage(message, c.readLimit)
+			if errors.Is(err, ErrMessageTooBig) {
+				return 0, nil, c.fail(CloseMessageTooBig, err)
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseProtocolError, err)
+			}
+		}
+		if mt == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, ErrInvalidUTF8)
+		}
+		if message == nil {
+			message = []byte{}
+		}
+		return mt, message, nil
+	}
+}
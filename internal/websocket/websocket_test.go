@@ -0,0 +1,253 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"tcp_http/internal/request"
+	"tcp_http/internal/response"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Test: Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestFrames(t *testing.T) {
+	// Test: Masked frame round trip
+	buf := &bytes.Buffer{}
+	err := writeFrame(buf, &frame{fin: true, opcode: opText, masked: true, payload: []byte("hello")})
+	require.NoError(t, err)
+	f, err := readFrame(buf, 0)
+	require.NoError(t, err)
+	assert.True(t, f.fin)
+	assert.True(t, f.masked)
+	assert.Equal(t, opText, f.opcode)
+	assert.Equal(t, "hello", string(f.payload))
+
+	// Test: 16 and 64 bit payload lengths
+	for _, size := range []int{126, 70000} {
+		buf.Reset()
+		payload := bytes.Repeat([]byte("a"), size)
+		require.NoError(t, writeFrame(buf, &frame{fin: true, opcode: opBinary, payload: payload}))
+		f, err = readFrame(buf, 0)
+		require.NoError(t, err)
+		assert.Equal(t, payload, f.payload)
+	}
+
+	// Test: Fragmented control frame
+	_, err = readFrame(bytes.NewReader([]byte{byte(opPing), 0x00}), 0)
+	require.ErrorIs(t, err, ErrProtocol)
+
+	// Test: Payload over the limit
+	buf.Reset()
+	require.NoError(t, writeFrame(buf, &frame{fin: true, opcode: opBinary, payload: make([]byte, 20)}))
+	_, err = readFrame(buf, 10)
+	require.ErrorIs(t, err, ErrMessageTooBig)
+
+	// Test: Without a limit a forged 64 bit length hits the hard cap
+	_, err = readFrame(bytes.NewReader([]byte{finBit | byte(opBinary), 127, 0, 0, 1, 0, 0, 0, 0, 0}), 0)
+	require.ErrorIs(t, err, ErrMessageTooBig)
+}
+
+func TestDeflate(t *testing.T) {
+	// Test: Extension negotiation
+	ext, ok := negotiateDeflate("permessage-deflate; client_max_window_bits")
+	assert.True(t, ok)
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", ext)
+	_, ok = negotiateDeflate("permessage-deflate; server_max_window_bits=10")
+	assert.False(t, ok)
+	_, ok = negotiateDeflate("x-webkit-deflate-frame")
+	assert.False(t, ok)
+
+	// Test: Compress round trip
+	data := []byte(strings.Repeat("websocket ", 100))
+	compressed, err := compressMessage(data)
+	require.NoError(t, err)
+	assert.Less(t, len(compressed), len(data))
+	out, err := decompressMessage(compressed, 0)
+	require.NoError(t, err)
+	assert.Equal(t, data, out)
+
+	// Test: Inflated size over the limit
+	_, err = decompressMessage(compressed, 100)
+	require.ErrorIs(t, err, ErrMessageTooBig)
+}
+
+// dial performs the opening handshake over a loopback connection and returns
+// the client side of the connection together with the raw handshake response.
+func dial(t *testing.T, u *Upgrader, extraHeaders string, handler func(c *Conn)) (*Conn, string) {
+	return dialWithEarlyData(t, u, extraHeaders, nil, handler)
+}
+
+// dialWithEarlyData sends early right behind the handshake request, in the
+// same write, as a client that does not wait for the 101 would.
+func dialWithEarlyData(t *testing.T, u *Upgrader, extraHeaders string, early []byte, handler func(c *Conn)) (*Conn, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverConn, err := listener.Accept()
+	require.NoError(t, err)
+
+	go func() {
+		requestReader := request.NewReader(serverConn)
+		req, err := requestReader.ReadRequest()
+		if err != nil {
+			serverConn.Close()
+			return
+		}
+		w := response.NewConnWriter(serverConn, requestReader, response.DefaultBufferSize)
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			w.Flush()
+			serverConn.Close()
+			return
+		}
+		handler(c)
+	}()
+
+	_, err = clientConn.Write([]byte("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		extraHeaders +
+		"\r\n" +
+		string(early)))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(clientConn)
+	head := ""
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+		if line == "\r\n" {
+			break
+		}
+	}
+	return newConn(clientConn, reader, false), head
+}
+
+func echo(c *Conn) {
+	for {
+		mt, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.WriteMessage(mt, data)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	// Test: Successful handshake with subprotocol and echo
+	u := &Upgrader{Subprotocols: []string{"chat"}}
+	client, head := dial(t, u, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: superchat, chat\r\n", echo)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat\r\n")
+
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("hi there")))
+	mt, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "hi there", string(data))
+
+	// Test: Fragmented message is reassembled
+	require.NoError(t, client.WriteFragmented(BinaryMessage, []byte("fragmented message"), 4))
+	mt, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, mt)
+	assert.Equal(t, "fragmented message", string(data))
+
+	// Test: Ping is answered with a pong
+	pong := make(chan string, 1)
+	client.PongHandler = func(data []byte) { pong <- string(data) }
+	require.NoError(t, client.Ping([]byte("are you there")))
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("after ping")))
+	_, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+	assert.Equal(t, "are you there", <-pong)
+
+	// Test: Close handshake echoes the close code
+	require.NoError(t, client.writeFrame(&frame{fin: true, opcode: opClose, payload: closePayload(CloseGoingAway, "bye")}))
+	_, _, err = client.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+
+	// Test: Compressed echo
+	u = &Upgrader{EnableCompression: true}
+	client, head = dial(t, u, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: permessage-deflate\r\n", echo)
+	assert.Contains(t, head, "sec-websocket-extensions: permessage-deflate")
+	client.compress = true
+	message := strings.Repeat("compress me ", 50)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte(message)))
+	_, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, message, string(data))
+	client.Close(CloseNormal, "")
+
+	// Test: Wrong version is rejected
+	client, head = dial(t, u, "Sec-WebSocket-Version: 8\r\n", echo)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 426 Upgrade Required\r\n"))
+	assert.Contains(t, head, "sec-websocket-version: 13\r\n")
+}
+
+func TestUnmaskedClientFrame(t *testing.T) {
+	// Test: Server closes with 1002 when the client does not mask
+	result := make(chan error, 1)
+	client, _ := dial(t, &Upgrader{}, "Sec-WebSocket-Version: 13\r\n", func(c *Conn) {
+		_, _, err := c.ReadMessage()
+		result <- err
+	})
+	require.NoError(t, writeFrame(client.conn, &frame{fin: true, opcode: opText, payload: []byte("unmasked")}))
+	_, _, err := client.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseProtocolError, closeErr.Code)
+	require.ErrorIs(t, <-result, ErrProtocol)
+}
+
+func TestDefaultReadLimit(t *testing.T) {
+	// Test: A frame over the default limit is refused with 1009 before its
+	// payload arrives
+	assert.Equal(t, int64(DefaultReadLimit), (&Upgrader{}).readLimit())
+	assert.Equal(t, int64(MaxReadLimit), (&Upgrader{ReadLimit: 1 << 40}).readLimit())
+	result := make(chan error, 1)
+	client, _ := dial(t, &Upgrader{}, "Sec-WebSocket-Version: 13\r\n", func(c *Conn) {
+		_, _, err := c.ReadMessage()
+		result <- err
+	})
+	head := []byte{finBit | byte(opBinary), maskBit | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(head[2:], DefaultReadLimit+1)
+	_, err := client.conn.Write(head)
+	require.NoError(t, err)
+	_, _, err = client.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+	require.ErrorIs(t, <-result, ErrMessageTooBig)
+}
+
+func TestEarlyData(t *testing.T) {
+	// Test: A frame sent together with the handshake is not lost
+	early := &bytes.Buffer{}
+	require.NoError(t, writeFrame(early, &frame{fin: true, opcode: opText, masked: true, payload: []byte("eager")}))
+	client, head := dialWithEarlyData(t, &Upgrader{}, "Sec-WebSocket-Version: 13\r\n", early.Bytes(), echo)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	_, data, err := client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "eager", string(data))
+	client.Close(CloseNormal, "")
+}